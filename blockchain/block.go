@@ -2,19 +2,67 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"time"
 )
 
+const BLOCK_VERSION = 1
+
+// HEADER_NONCE_OFFSET is where the big-endian nonce starts in
+// BlockHeader.Bytes, which lets miners patch it in place instead of
+// re-encoding the header.
+const HEADER_NONCE_OFFSET = 4 + 32 + 32 + 8 + 4
+
+// BlockHeader carries every field the proof of work commits to. The block
+// hash is computed over the header alone, so a header can be checked and
+// relayed without its transactions.
+type BlockHeader struct {
+	Version    int32
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	Bits       uint32
+	Nonce      uint32
+	Height     int
+}
+
+// Bytes returns the fixed width big endian encoding of the header that is
+// fed into the hash. Hashes are zero padded to 32 bytes, so the genesis
+// block's empty PrevHash encodes as all zeroes. CheckBlockSanity turns away
+// blocks with hashes of any other length, which would encode the same as
+// the hash they are padded or cut to.
+func (h *BlockHeader) Bytes() []byte {
+
+	var prevHash, merkleRoot [32]byte
+	copy(prevHash[:], h.PrevHash)
+	copy(merkleRoot[:], h.MerkleRoot)
+
+	var buff bytes.Buffer
+
+	binary.Write(&buff, binary.BigEndian, h.Version)
+	buff.Write(prevHash[:])
+	buff.Write(merkleRoot[:])
+	binary.Write(&buff, binary.BigEndian, h.Timestamp)
+	binary.Write(&buff, binary.BigEndian, h.Bits)
+	binary.Write(&buff, binary.BigEndian, h.Nonce)
+	binary.Write(&buff, binary.BigEndian, int64(h.Height))
+
+	return buff.Bytes()
+}
+
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Bytes())
+	return hash[:]
+}
+
 type Block struct {
-	Timestamp    int64
-	Height       int
-	Nonce        int
-	PrevHash     []byte
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
 }
@@ -23,7 +71,12 @@ func (b *Block) Print() {
 
 	fmt.Printf("\n> Hash:		%s", hex.EncodeToString(b.Hash))
 	fmt.Printf("\n> PrevHash:	%x", b.PrevHash)
-	fmt.Printf("\n\n> Nonce:	%d", b.Nonce)
+	fmt.Printf("\n> MerkleRoot:	%x", b.MerkleRoot)
+
+	fmt.Printf("\n\n> Version:	%d", b.Version)
+	fmt.Printf("\n> Height:	%d", b.Height)
+	fmt.Printf("\n> Nonce:	%d", b.Nonce)
+	fmt.Printf("\n> Bits:		%08x", b.Bits)
 	fmt.Printf("\n> Timestamp:	%d", b.Timestamp)
 
 	pow := NewProof(b)
@@ -39,15 +92,23 @@ func (b *Block) Print() {
 
 func (b *Block) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
+		Version      int32          `json:"version"`
+		Height       int            `json:"height"`
 		Timestamp    int64          `json:"timestamp"`
-		Nonce        int            `json:"nonce"`
+		Nonce        uint32         `json:"nonce"`
+		Bits         uint32         `json:"bits"`
 		PrevHash     string         `json:"prev_hash"`
+		MerkleRoot   string         `json:"merkle_root"`
 		Hash         string         `json:"hash"`
 		Transactions []*Transaction `json:"transactions"`
 	}{
+		Version:      b.Version,
+		Height:       b.Height,
 		Timestamp:    b.Timestamp,
 		Nonce:        b.Nonce,
+		Bits:         b.Bits,
 		PrevHash:     hex.EncodeToString(b.PrevHash),
+		MerkleRoot:   hex.EncodeToString(b.MerkleRoot),
 		Hash:         hex.EncodeToString(b.Hash),
 		Transactions: b.Transactions,
 	})
@@ -78,28 +139,25 @@ func (b *Block) HashTransactions() []byte {
 	return tree.RootNode.Data
 }
 
-func Genesis(coinbase *Transaction) (*Block, error) {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
-}
+// TransactionProof returns the merkle proof that the transaction at index
+// is committed to by the block's merkle root.
+func (b *Block) TransactionProof(index int) (*MerkleProof, error) {
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) (*Block, error) {
+	var txHashes [][]byte
 
-	block := &Block{
-		Timestamp:    time.Now().UnixNano(),
-		Height:       height,
-		Nonce:        0,
-		PrevHash:     prevHash,
-		Hash:         []byte{},
-		Transactions: txs,
+	for _, tx := range b.Transactions {
+		txHashes = append(txHashes, tx.Serialize())
 	}
 
-	pow := NewProof(block)
-	nonce, hash, err := pow.Run()
+	return NewMerkleProof(txHashes, index)
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func Genesis(coinbase *Transaction) (*Block, error) {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, Params.PowLimitBits)
+}
 
-	return block, err
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) (*Block, error) {
+	return DefaultMiner.CreateBlock(context.Background(), txs, prevHash, height, bits)
 }
 
 func DeserializeBlock(data []byte) (*Block, error) {
@@ -4,24 +4,30 @@ import (
 	"bytes"
 	"context"
 	"crypto/ecdsa"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/i101dev/blockchain-Tensor/util"
-	"github.com/i101dev/blockchain-Tensor/wallet"
 )
 
 const (
 	DB_PATH       = "../tmp/blocks_%d"
 	LAST_HASH_KEY = "lastHash"
+	UTXO_TIP_KEY  = "utxoTip"
 	GENESIS_DATA  = "GENESIS"
 )
 
+var (
+	workPrefix    = []byte("work-")
+	invalidPrefix = []byte("invalid-")
+)
+
 type NullLogger struct{}
 
 func (l *NullLogger) Errorf(string, ...interface{})   {}
@@ -33,10 +39,27 @@ type Blockchain struct {
 	Path     string
 	LastHash []byte
 	Database *badger.DB
+	Orphans  *OrphanPool
+
+	dbMu   sync.Mutex
+	dbRefs int
+
+	// mu serializes changes to the chain. Connecting a block validates it,
+	// stores it and moves the tip and the UTXO set over several database
+	// transactions, which must not interleave with another block's.
+	mu sync.Mutex
 }
 
+// CloseDB releases the database and closes it once no caller holds it open.
 func (chain *Blockchain) CloseDB() {
 
+	chain.dbMu.Lock()
+	defer chain.dbMu.Unlock()
+
+	if chain.dbRefs--; chain.dbRefs > 0 {
+		return
+	}
+
 	_, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -114,92 +137,368 @@ func (chain *Blockchain) PostBlockToDB(lastHash []byte, newBlock *Block, db *bad
 //		return newBlock, err
 //	}
 
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+// MineBlock mines the transactions into a block on top of the current tip,
+// preceded by a coinbase that pays the block subsidy and the transaction
+// fees to the given address. It returns a RuleError when a transaction is
+// invalid.
+func (chain *Blockchain) MineBlock(to string, transactions []*Transaction) (*Block, error) {
 
-	for _, tx := range transactions {
-		if !chain.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
-		}
+	lastHash, err := chain.GetLastHash(chain.Database)
+	util.HandleError(err, "MineBlock 1")
+
+	lastBlock, err := chain.GetBlock(lastHash)
+	util.HandleError(err, "MineBlock 2")
+
+	fees, err := chain.CalcFees(transactions, lastBlock.Height+1)
+	if err != nil {
+		return nil, err
 	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		util.HandleError(err, "MineBlock 1")
+	bits, err := chain.CalcNextBits(lastBlock)
+	util.HandleError(err, "MineBlock 3")
 
-		lastHash, _ = item.ValueCopy(nil)
-		// util.Handle(err, "MineBlock 2")
+	cbTx := CoinbaseTX(to, "", CalcBlockSubsidy(lastBlock.Height+1)+fees)
+	transactions = append([]*Transaction{cbTx}, transactions...)
 
-		item, _ = txn.Get(lastHash)
-		// util.Handle(err, "MineBlock 3")
+	newBlock, err := CreateBlock(transactions, lastHash, lastBlock.Height+1, bits)
+	util.HandleError(err, "MineBlock 4")
 
-		lastBlockData, _ := item.ValueCopy(nil)
-		// util.Handle(err, "MineBlock 4")
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+// AddBlock validates the block and stores it together with the total work of
+// the branch it extends. When that branch carries more accumulated work than
+// the current tip, the chain is reorganized onto it and the UTXO set follows.
+func (chain *Blockchain) AddBlock(block *Block) error {
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	return chain.addBlock(block)
+}
 
-		lastBlock, _ := DeserializeBlock(lastBlockData)
-		// util.Handle(err, "MineBlock 5")
+// addBlock is AddBlock for callers that hold chain.mu.
+func (chain *Blockchain) addBlock(block *Block) error {
 
-		lastHeight = lastBlock.Height
+	if chain.IsInvalid(block.Hash) {
+		return ruleError(RejectKnownInvalid, "block %x is known to be invalid", block.Hash)
+	}
 
+	if chain.HasBlock(block.Hash) {
 		return nil
-	})
+	}
 
-	util.HandleError(err, "MineBlock 3")
+	//
+	// invalid blocks are removed from disk, so without this check their
+	// children would be taken for orphans
+	//
+	if chain.IsInvalid(block.PrevHash) {
+		return ruleError(RejectInvalidAncestor, "block %x builds on invalid block %x", block.Hash, block.PrevHash)
+	}
 
-	newBlock, _ := CreateBlock(transactions, lastHash, lastHeight+1)
+	if err := chain.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	parentWork, err := chain.GetChainWork(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	chainWork := new(big.Int).Add(parentWork, NewProof(block).Work())
 
 	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		util.HandleError(err, "MineBlock 4")
-		err = txn.Set([]byte("lh"), newBlock.Hash)
 
-		chain.LastHash = newBlock.Hash
+		// ----------------------------------------------------------
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return fmt.Errorf("failed to set serialized block in database")
+		}
 
-		return err
+		// ----------------------------------------------------------
+		if err := txn.Set(workKey(block.Hash), chainWork.Bytes()); err != nil {
+			return fmt.Errorf("failed to set chain work in database")
+		}
+
+		return nil
 	})
-	util.HandleError(err, "MineBlock 5")
+	if err != nil {
+		return err
+	}
+
+	lastHash, err := chain.GetLastHash(chain.Database)
+	if err != nil {
+		return err
+	}
 
-	return newBlock
+	tipWork, err := chain.GetChainWork(lastHash)
+	if err != nil {
+		return err
+	}
+
+	if chainWork.Cmp(tipWork) <= 0 {
+		return nil
+	}
+
+	return chain.reorganize(lastHash, block)
 }
 
-func (chain *Blockchain) AddBlock(block *Block) (*Block, error) {
+// ProcessBlock is how blocks received from other nodes enter the chain. A
+// block whose parent is unknown is kept in the orphan pool and reported with
+// isOrphan set, so the caller can ask for the missing parents. Once a block
+// is accepted, any orphans waiting on it are connected in turn.
+func (chain *Blockchain) ProcessBlock(block *Block) (bool, error) {
 
-	var b Block
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
 
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
+	if chain.IsInvalid(block.Hash) {
+		return false, ruleError(RejectKnownInvalid, "block %x is known to be invalid", block.Hash)
+	}
+
+	if chain.HasBlock(block.Hash) || chain.Orphans.Has(block.Hash) {
+		return false, nil
+	}
+
+	err := chain.addBlock(block)
+
+	if IsRejectReason(err, RejectOrphan) {
+		chain.Orphans.Add(block)
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	chain.processOrphans(block.Hash)
+
+	return false, nil
+}
+
+// processOrphans connects the orphans waiting on hash, and those waiting on
+// them in turn. The caller holds chain.mu.
+func (chain *Blockchain) processOrphans(hash []byte) {
+
+	parents := [][]byte{hash}
+
+	for len(parents) > 0 {
+
+		parent := parents[0]
+		parents = parents[1:]
+
+		for _, orphan := range chain.Orphans.RemoveChildren(parent) {
+
+			if err := chain.addBlock(orphan); err != nil {
+				fmt.Printf("Rejected orphan block %x: %s\n", orphan.Hash, err)
+				continue
+			}
+
+			fmt.Printf("Connected orphan block %x\n", orphan.Hash)
+			parents = append(parents, orphan.Hash)
 		}
+	}
+}
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		util.HandleError(err, "AddBlock 1")
+// reorganize moves the tip from oldTip to newTip. Blocks that are only on the
+// old branch are disconnected from the UTXO set, newest first, and blocks
+// that are only on the new branch are checked and connected, oldest first.
+// If a block on the new branch turns out to be invalid, the old branch is
+// restored, and that block and the ones built on it are marked invalid and
+// removed. The caller holds chain.mu.
+func (chain *Blockchain) reorganize(oldTip []byte, newTip *Block) error {
 
-		item, err := txn.Get([]byte("lh"))
-		util.HandleError(err, "AddBlock 2")
-		lastHash, _ := item.ValueCopy(nil)
+	detach, attach, err := chain.findFork(oldTip, newTip)
+	if err != nil {
+		return err
+	}
 
-		item, err = txn.Get(lastHash)
-		util.HandleError(err, "AddBlock 3")
-		lastBlockData, _ := item.ValueCopy(nil)
+	if len(detach) > 0 {
+		fmt.Printf("Reorganizing chain: disconnecting %d and connecting %d blocks\n", len(detach), len(attach))
+	}
+
+	UTXOSet := UTXOSet{chain}
+
+	for _, block := range detach {
+		UTXOSet.Disconnect(block)
+		chain.LastHash = block.PrevHash
+	}
 
-		lastBlock, _ := DeserializeBlock(lastBlockData)
+	for i, block := range attach {
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			util.HandleError(err, "AddBlock 4")
-			chain.LastHash = block.Hash
+		err := chain.checkBlockTransactions(block)
+		if err == nil {
+			err = UTXOSet.Update(block)
 		}
 
-		b = *lastBlock
+		if err != nil {
+
+			if _, ok := err.(RuleError); ok {
+				if markErr := chain.markInvalid(attach[i:]); markErr != nil {
+					return markErr
+				}
+			}
+
+			for j := i - 1; j >= 0; j-- {
+				UTXOSet.Disconnect(attach[j])
+				chain.LastHash = attach[j].PrevHash
+			}
+
+			for j := len(detach) - 1; j >= 0; j-- {
+				util.HandleError(UTXOSet.Update(detach[j]), "reorganize")
+				chain.LastHash = detach[j].Hash
+			}
+
+			return err
+		}
+
+		chain.LastHash = block.Hash
+	}
+
+	return chain.setLastHash(newTip.Hash)
+}
+
+// findFork walks both branches back to their common ancestor. It returns the
+// blocks to disconnect ordered from the old tip down, and the blocks to
+// connect ordered from the fork point up to the new tip.
+func (chain *Blockchain) findFork(oldTip []byte, newTip *Block) ([]*Block, []*Block, error) {
+
+	var detach []*Block
+	var attach []*Block
+
+	oldBlock, err := chain.GetBlock(oldTip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newBlock := newTip
+
+	for oldBlock.Height > newBlock.Height {
+		detach = append(detach, oldBlock)
+		if oldBlock, err = chain.GetBlock(oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for newBlock.Height > oldBlock.Height {
+		attach = append([]*Block{newBlock}, attach...)
+		if chain.IsInvalid(newBlock.PrevHash) {
+			return nil, nil, ruleError(RejectInvalidAncestor, "block %x builds on invalid block %x", newBlock.Hash, newBlock.PrevHash)
+		}
+		if newBlock, err = chain.GetBlock(newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+
+		if len(oldBlock.PrevHash) == 0 || len(newBlock.PrevHash) == 0 {
+			return nil, nil, fmt.Errorf("blocks %x and %x share no common ancestor", oldTip, newTip.Hash)
+		}
 
+		detach = append(detach, oldBlock)
+		attach = append([]*Block{newBlock}, attach...)
+
+		if oldBlock, err = chain.GetBlock(oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+		if newBlock, err = chain.GetBlock(newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return detach, attach, nil
+}
+
+func (chain *Blockchain) setLastHash(hash []byte) error {
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(LAST_HASH_KEY), hash); err != nil {
+			return fmt.Errorf("failed to set LAST_HASH in database")
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	chain.LastHash = hash
+
+	return nil
+}
+
+func (chain *Blockchain) HasBlock(hash []byte) bool {
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(hash)
+		return err
+	})
+
+	return err == nil
+}
+
+// GetChainWork returns the total work of the chain ending at the given block.
+func (chain *Blockchain) GetChainWork(hash []byte) (*big.Int, error) {
+
+	var work []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+
+		item, err := txn.Get(workKey(hash))
+		if err != nil {
+			return fmt.Errorf("chain work for block %x not found", hash)
+		}
+
+		work, err = item.ValueCopy(nil)
+
+		return err
+	})
+
+	return new(big.Int).SetBytes(work), err
+}
+
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), hash...)
+}
 
-	util.HandleError(err, "AddBlock 5")
+func invalidKey(hash []byte) []byte {
+	return append(append([]byte{}, invalidPrefix...), hash...)
+}
+
+// IsInvalid reports whether the block was found to break a rule that is
+// checked against the UTXO set. Such blocks are kept out of the chain for
+// good, along with every block built on them.
+func (chain *Blockchain) IsInvalid(hash []byte) bool {
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(invalidKey(hash))
+		return err
+	})
 
-	return &b, err
+	return err == nil
+}
+
+// markInvalid records the blocks as invalid and removes them and their chain
+// work from disk.
+func (chain *Blockchain) markInvalid(blocks []*Block) error {
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			if err := txn.Set(invalidKey(block.Hash), []byte{}); err != nil {
+				return err
+			}
+			if err := txn.Delete(block.Hash); err != nil {
+				return err
+			}
+			if err := txn.Delete(workKey(block.Hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (chain *Blockchain) GetBlock(blockHash []byte) (*Block, error) {
@@ -296,6 +595,15 @@ func (chain *Blockchain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
+// TipHash returns the hash of the current tip. Unlike reading LastHash, it is
+// safe while blocks are being connected.
+func (chain *Blockchain) TipHash() []byte {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	return chain.LastHash
+}
+
 func (chain *Blockchain) GetBestHeight() int {
 
 	var lastBlock *Block
@@ -319,34 +627,33 @@ func (chain *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
-func (chain *Blockchain) GetUnspentOutputs(db *badger.DB, address string) ([]*TxOutput, error) {
-
-	var utxoSet []*TxOutput
+func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 	iter := chain.NewIterator()
 
 	for {
-
 		block, err := iter.IterateNext()
 		if err != nil {
 			break
 		}
 
 		for _, tx := range block.Transactions {
-
-			for _, out := range tx.Outputs {
-
-				if wallet.PubKeyHashToAddr(out.PubKeyHash) == address {
-					utxoSet = append(utxoSet, &out)
-				}
+			if bytes.Equal(tx.HashID, ID) {
+				return *tx, nil
 			}
 		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
 	}
 
-	return utxoSet, nil
+	return Transaction{}, errors.New("Transaction does not exist")
 }
 
-func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+// FindSpender returns the transaction on the main chain that spends output
+// index of transaction ID.
+func (chain *Blockchain) FindSpender(ID []byte, index int) (*Transaction, error) {
 
 	iter := chain.NewIterator()
 
@@ -357,8 +664,10 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 
 		for _, tx := range block.Transactions {
-			if bytes.Equal(tx.HashID, ID) {
-				return *tx, nil
+			for _, in := range tx.Inputs {
+				if bytes.Equal(in.ID, ID) && in.Out == index {
+					return tx, nil
+				}
 			}
 		}
 
@@ -367,48 +676,67 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return nil, fmt.Errorf("output %x:%d is not spent on the main chain", ID, index)
 }
 
+// SignTransaction signs tx with privKey. Every output it spends has to be in
+// the UTXO set.
 func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
 
-	prevTXs := make(map[string]Transaction)
+	prevOuts, err := bc.prevOutputs(tx)
+	util.HandleError(err, "SignTransaction")
 
-	for _, txInput := range tx.Inputs {
-
-		prevTX, err := bc.FindTransaction(txInput.ID)
-		util.HandleError(err, "SignTransaction")
-
-		prevTXID := hex.EncodeToString(prevTX.HashID)
-		prevTXs[prevTXID] = prevTX
-	}
-
-	tx.Sign(privKey, prevTXs)
+	tx.Sign(privKey, prevOuts)
 }
 
+// VerifyTransaction checks the signatures of tx against the outputs it
+// spends. It is false when one of them is not in the UTXO set.
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	prevTXs := make(map[string]Transaction)
+	prevOuts, err := bc.prevOutputs(tx)
+	if err != nil {
+		return false
+	}
+
+	return tx.Verify(prevOuts)
+}
+
+// prevOutputs looks up the outputs spent by tx in the UTXO set.
+func (bc *Blockchain) prevOutputs(tx *Transaction) (map[string]TxOutput, error) {
+
+	UTXOSet := UTXOSet{bc}
+	prevOuts := make(map[string]TxOutput)
 
 	for _, in := range tx.Inputs {
 
-		prevTX, err := bc.FindTransaction(in.ID)
-		util.HandleError(err, "VerifyTransaction")
+		entry, found := UTXOSet.GetUTXO(in.ID, in.Out)
+		if !found {
+			return nil, fmt.Errorf("output %x:%d is not in the UTXO set", in.ID, in.Out)
+		}
 
-		prevTXID := hex.EncodeToString(prevTX.HashID)
-		prevTXs[prevTXID] = prevTX
+		prevOuts[OutpointKey(in.ID, in.Out)] = entry.Output
 	}
 
-	return tx.Verify(prevTXs)
+	return prevOuts, nil
 }
 
 // -----------------------------------------------------------------------
+// OpenDB opens the chain's database, or shares it when another caller still
+// has it open. Every OpenDB must be paired with a CloseDB.
 func OpenDB(chain *Blockchain) *badger.DB {
 
+	chain.dbMu.Lock()
+	defer chain.dbMu.Unlock()
+
+	if chain.dbRefs > 0 {
+		chain.dbRefs++
+		return chain.Database
+	}
+
 	opts := badger.DefaultOptions(chain.Path)
 	opts.Logger = &NullLogger{}
 
@@ -416,6 +744,7 @@ func OpenDB(chain *Blockchain) *badger.DB {
 	util.HandleError(err, "Open BadgerDB 1")
 
 	chain.Database = db
+	chain.dbRefs = 1
 
 	return db
 }
@@ -428,7 +757,8 @@ func NewChain(nodeID uint16) *Blockchain {
 	}
 
 	return &Blockchain{
-		Path: path,
+		Path:    path,
+		Orphans: NewOrphanPool(),
 	}
 }
 
@@ -442,7 +772,8 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 	}
 
 	newChain := &Blockchain{
-		Path: path,
+		Path:    path,
+		Orphans: NewOrphanPool(),
 	}
 
 	// -------------------------------------------------------
@@ -455,7 +786,7 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 		if _, err := dbTXN.Get([]byte(LAST_HASH_KEY)); err == badger.ErrKeyNotFound {
 
 			// ----------------------------------------------------------
-			cbtx := CoinbaseTX(address, GENESIS_DATA)
+			cbtx := CoinbaseTX(address, GENESIS_DATA, CalcBlockSubsidy(0))
 			genesis, err := Genesis(cbtx)
 			if err != nil {
 				return err
@@ -467,6 +798,12 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 				return fmt.Errorf("failed to set serialized block in database")
 			}
 
+			// ----------------------------------------------------------
+			err = dbTXN.Set(workKey(genesis.Hash), NewProof(genesis).Work().Bytes())
+			if err != nil {
+				return fmt.Errorf("failed to set chain work in database")
+			}
+
 			// ----------------------------------------------------------
 			err = dbTXN.Set([]byte(LAST_HASH_KEY), genesis.Hash)
 			if err != nil {
@@ -487,58 +824,16 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 
 	newChain.LastHash = lastHash
 
+	//
+	// the UTXO set is only rebuilt when it is missing or was left behind
+	// the chain, such as by a crash between storing a block and connecting it
+	//
 	UTXOSet := UTXOSet{newChain}
-	UTXOSet.Reindex()
-
-	return newChain, err
-}
-
-func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
-
-	UTXO := make(map[string]TxOutputs)
-	spentTXOs := make(map[string][]int)
-
-	iter := chain.NewIterator()
-
-	for {
-
-		block, err := iter.IterateNext()
-		if err != nil {
-			break
-		}
-
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.HashID)
-
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
-
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
-				}
-			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	if err == nil && !bytes.Equal(UTXOSet.TipHash(), lastHash) {
+		UTXOSet.Reindex()
 	}
 
-	return UTXO
+	return newChain, err
 }
 
 // -----------------------------------------------------------------------
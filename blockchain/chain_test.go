@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// newTestChain loads a fresh chain whose genesis pays account, with its
+// database open. Coinbase outputs can be spent right away.
+func newTestChain(t *testing.T, nodeID uint16, account *wallet.Account) *Blockchain {
+	t.Helper()
+
+	path := fmt.Sprintf(DB_PATH, nodeID)
+	os.RemoveAll(path)
+
+	maturity := Params.CoinbaseMaturity
+	Params.CoinbaseMaturity = 0
+
+	chain, err := LoadBlockchain(string(account.Address()), nodeID)
+	if err != nil {
+		t.Fatalf("LoadBlockchain: %v", err)
+	}
+	OpenDB(chain)
+
+	t.Cleanup(func() {
+		chain.CloseDB()
+		os.RemoveAll(path)
+		Params.CoinbaseMaturity = maturity
+	})
+
+	return chain
+}
+
+// createOn mines a block with txs on top of parent, paying the subsidy to
+// to, without adding it to the chain.
+func createOn(t *testing.T, chain *Blockchain, parent *Block, to *wallet.Account, txs ...*Transaction) *Block {
+	t.Helper()
+
+	bits, err := chain.CalcNextBits(parent)
+	if err != nil {
+		t.Fatalf("CalcNextBits: %v", err)
+	}
+
+	coinbase := CoinbaseTX(string(to.Address()), "", CalcBlockSubsidy(parent.Height+1))
+
+	block, err := CreateBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1, bits)
+	if err != nil {
+		t.Fatalf("CreateBlock: %v", err)
+	}
+
+	return block
+}
+
+// mineOn mines a block with txs on top of parent and adds it to the chain.
+func mineOn(t *testing.T, chain *Blockchain, parent *Block, to *wallet.Account, txs ...*Transaction) *Block {
+	t.Helper()
+
+	block := createOn(t, chain, parent, to, txs...)
+
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock at height %d: %v", block.Height, err)
+	}
+
+	return block
+}
+
+// utxoSnapshot returns every entry of the UTXO set by outpoint.
+func utxoSnapshot(chain *Blockchain) map[string]UTXOEntry {
+	snapshot := make(map[string]UTXOEntry)
+
+	UTXOSet{chain}.forEachEntry(func(entry UTXOEntry) {
+		snapshot[OutpointKey(entry.TxID, entry.Index)] = entry
+	})
+
+	return snapshot
+}
+
+func tipBlock(t *testing.T, chain *Blockchain) *Block {
+	t.Helper()
+
+	block, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatalf("GetBlock: %v", err)
+	}
+	return block
+}
+
+// checkReorganized checks that the chain ends at tip and that its UTXO set
+// is the one a reindex builds, with pay confirmed or not.
+func checkReorganized(t *testing.T, chain *Blockchain, tip *Block, pay *Transaction, confirmed bool) {
+	t.Helper()
+
+	if string(chain.LastHash) != string(tip.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.LastHash, tip.Hash)
+	}
+
+	reorganized := utxoSnapshot(chain)
+
+	UTXOSet{chain}.Reindex()
+	if reindexed := utxoSnapshot(chain); !reflect.DeepEqual(reorganized, reindexed) {
+		t.Fatalf("the UTXO set has %d entries, a reindex gives %d", len(reorganized), len(reindexed))
+	}
+
+	spent := pay.Inputs[0]
+	_, hasPay := reorganized[OutpointKey(pay.HashID, 0)]
+	_, hasSpent := reorganized[OutpointKey(spent.ID, spent.Out)]
+
+	if hasPay != confirmed || hasSpent == confirmed {
+		t.Fatalf("payment output present: %v, output it spends present: %v, want the payment confirmed: %v", hasPay, hasSpent, confirmed)
+	}
+}
+
+func TestReorganizeMatchesReindex(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9102, alice)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	fork := mineOn(t, chain, tipBlock(t, chain), alice)
+
+	pay, err := NewTransaction(string(alice.Address()), string(bob.Address()), 5, 1, false, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+
+	a1 := mineOn(t, chain, fork, alice, pay)
+	a2 := mineOn(t, chain, a1, alice)
+	checkReorganized(t, chain, a2, pay, true)
+
+	//
+	// a longer branch without pay takes over
+	//
+	b1 := mineOn(t, chain, fork, bob)
+	b2 := mineOn(t, chain, b1, bob)
+	b3 := mineOn(t, chain, b2, bob)
+	checkReorganized(t, chain, b3, pay, false)
+
+	//
+	// and the first branch takes over again once it is longer
+	//
+	a3 := mineOn(t, chain, a2, alice)
+	a4 := mineOn(t, chain, a3, alice)
+	checkReorganized(t, chain, a4, pay, true)
+}
+
+// forgedSpend returns a transaction paying the coinbase of block, which
+// pays alice, to bob. Its input is signed by bob, so it fails its script.
+func forgedSpend(t *testing.T, block *Block, alice, bob *wallet.Account) *Transaction {
+	t.Helper()
+
+	coinbase := block.Transactions[0]
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: coinbase.HashID, Out: 0, Sequence: SEQUENCE_FINAL}},
+		Outputs: []TxOutput{*NewTXOutput(coinbase.Outputs[0].Value-1, string(bob.Address()))},
+	}
+	tx.HashID = tx.ID()
+
+	signature := signInput(t, tx, 0, bob, coinbase.Outputs[0].Script, SIGHASH_ALL)
+	tx.Inputs[0].Script = P2PKHUnlockingScript(signature, alice.PublicKey)
+
+	return tx
+}
+
+func TestInvalidTipBlockIsRejectedForGood(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9103, alice)
+
+	tip := mineOn(t, chain, tipBlock(t, chain), alice)
+
+	bad := createOn(t, chain, tip, alice, forgedSpend(t, tip, alice, bob))
+
+	if err := chain.AddBlock(bad); !IsRejectReason(err, RejectScriptFailed) {
+		t.Fatalf("expected %s, got %v", RejectScriptFailed, err)
+	}
+
+	if chain.HasBlock(bad.Hash) || !chain.IsInvalid(bad.Hash) {
+		t.Fatal("the invalid block should be marked and not stored")
+	}
+
+	if err := chain.AddBlock(bad); !IsRejectReason(err, RejectKnownInvalid) {
+		t.Fatalf("resubmitting: expected %s, got %v", RejectKnownInvalid, err)
+	}
+
+	if _, err := chain.ProcessBlock(bad); !IsRejectReason(err, RejectKnownInvalid) {
+		t.Fatalf("processing: expected %s, got %v", RejectKnownInvalid, err)
+	}
+
+	child := createOn(t, chain, bad, alice)
+
+	isOrphan, err := chain.ProcessBlock(child)
+	if isOrphan || !IsRejectReason(err, RejectInvalidAncestor) {
+		t.Fatalf("child of the invalid block: expected %s, got orphan %v, %v", RejectInvalidAncestor, isOrphan, err)
+	}
+
+	if string(chain.LastHash) != string(tip.Hash) {
+		t.Fatalf("tip moved to %x", chain.LastHash)
+	}
+}
+
+func TestInvalidSideBranchIsRemoved(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9104, alice)
+
+	fork := mineOn(t, chain, tipBlock(t, chain), alice)
+	a1 := mineOn(t, chain, fork, alice)
+	a2 := mineOn(t, chain, a1, alice)
+
+	//
+	// the side branch only has its transactions checked once it has the
+	// most work, at b3
+	//
+	b1 := mineOn(t, chain, fork, bob)
+	b2 := mineOn(t, chain, b1, bob)
+	b3 := createOn(t, chain, b2, bob, forgedSpend(t, fork, alice, bob))
+
+	if err := chain.AddBlock(b3); !IsRejectReason(err, RejectScriptFailed) {
+		t.Fatalf("expected %s, got %v", RejectScriptFailed, err)
+	}
+
+	if string(chain.LastHash) != string(a2.Hash) {
+		t.Fatalf("tip is %x, want the old tip %x", chain.LastHash, a2.Hash)
+	}
+
+	reorganized := utxoSnapshot(chain)
+	UTXOSet{chain}.Reindex()
+	if reindexed := utxoSnapshot(chain); !reflect.DeepEqual(reorganized, reindexed) {
+		t.Fatalf("the UTXO set has %d entries after the failed reorganization, a reindex gives %d", len(reorganized), len(reindexed))
+	}
+
+	if chain.HasBlock(b3.Hash) || !chain.IsInvalid(b3.Hash) {
+		t.Fatal("the invalid block should be marked and removed")
+	}
+	if !chain.HasBlock(b1.Hash) || !chain.HasBlock(b2.Hash) {
+		t.Fatal("the valid blocks of the side branch should be kept")
+	}
+
+	if err := chain.AddBlock(b3); !IsRejectReason(err, RejectKnownInvalid) {
+		t.Fatalf("resubmitting: expected %s, got %v", RejectKnownInvalid, err)
+	}
+
+	if err := chain.AddBlock(createOn(t, chain, b3, bob)); !IsRejectReason(err, RejectInvalidAncestor) {
+		t.Fatalf("child of the invalid block: expected %s, got %v", RejectInvalidAncestor, err)
+	}
+}
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// A crowdfunding campaign collects pledges towards a goal. Each pledge is a
+// transaction with the campaign's single output of the goal and inputs from
+// one backer, signed ALL|ANYONECANPAY. The signatures commit to the output
+// but not to the other inputs, so pledges can be merged into one
+// transaction. It is only valid once the pledges together cover the goal.
+
+// NewPledge signs outputs of the wallet address from worth at least amount
+// towards a campaign paying goal to campaign. A pledge has no change
+// output, so it spends whole outputs and may pledge more than amount.
+func NewPledge(from, campaign string, goal, amount int, UTXO *UTXOSet, w *wallet.Wallet) (*Transaction, error) {
+
+	account, ok := w.Accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an address of this wallet", from)
+	}
+
+	if amount <= 0 || goal <= 0 {
+		return nil, fmt.Errorf("goal and amount have to be above zero")
+	}
+
+	lockingScript := PayToPubKeyHashScript(wallet.PublicKeyHash(account.PublicKey))
+
+	acc, validOutputs := UTXO.FindSpendableOutputs(lockingScript, amount)
+	if acc < amount {
+		return nil, fmt.Errorf("not enough funds: %s has %d, %d needed", from, acc, amount)
+	}
+
+	var inputs []TxInput
+	for txHash, outs := range validOutputs {
+		txHashID, err := hex.DecodeString(txHash)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, outIndex := range outs {
+			inputs = append(inputs, TxInput{Out: outIndex, ID: txHashID, Sequence: SEQUENCE_FINAL})
+		}
+	}
+
+	tx := Transaction{nil, inputs, []TxOutput{*NewTXOutput(goal, campaign)}, 0}
+	tx.HashID = tx.ID()
+
+	for i := range tx.Inputs {
+		signature, err := tx.SignInput(i, account.PrivateKey, lockingScript, SIGHASH_ALL|SIGHASH_ANYONECANPAY)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs[i].Script = P2PKHUnlockingScript(signature, account.PublicKey)
+	}
+
+	return &tx, nil
+}
+
+// CombinePledges merges pledges to the same campaign into one transaction,
+// which fails unless they cover the goal. What they pledge beyond it goes
+// to the miner as fee.
+func CombinePledges(pledges []*Transaction, UTXO *UTXOSet) (*Transaction, error) {
+
+	if len(pledges) == 0 {
+		return nil, fmt.Errorf("no pledges to combine")
+	}
+
+	goal := pledges[0].Outputs
+	if len(goal) != 1 {
+		return nil, fmt.Errorf("pledge %x has %d outputs, not one", pledges[0].HashID, len(goal))
+	}
+
+	var inputs []TxInput
+	prevOuts := make(map[string]TxOutput)
+	pledged := 0
+
+	for _, pledge := range pledges {
+		if len(pledge.Outputs) != 1 || pledge.Outputs[0].Value != goal[0].Value || !bytes.Equal(pledge.Outputs[0].Script, goal[0].Script) {
+			return nil, fmt.Errorf("pledge %x is for another campaign", pledge.HashID)
+		}
+
+		for _, in := range pledge.Inputs {
+			key := OutpointKey(in.ID, in.Out)
+			if _, seen := prevOuts[key]; seen {
+				return nil, fmt.Errorf("output %x:%d is pledged twice", in.ID, in.Out)
+			}
+
+			entry, found := UTXO.GetUTXO(in.ID, in.Out)
+			if !found {
+				return nil, fmt.Errorf("output %x:%d of pledge %x is not in the UTXO set", in.ID, in.Out, pledge.HashID)
+			}
+
+			prevOuts[key] = entry.Output
+			pledged += entry.Output.Value
+			inputs = append(inputs, in)
+		}
+	}
+
+	if pledged < goal[0].Value {
+		return nil, fmt.Errorf("%d of the goal of %d is pledged", pledged, goal[0].Value)
+	}
+
+	tx := Transaction{nil, inputs, goal, 0}
+	tx.HashID = tx.ID()
+
+	if !tx.Verify(prevOuts) {
+		return nil, fmt.Errorf("a pledge to %x has an invalid signature", tx.HashID)
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,117 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// CompactToTarget expands the compact "bits" representation used in block
+// headers into a full 256 bit target. The top byte is a base 256 exponent
+// and the low 23 bits a mantissa, with bit 23 as the sign.
+func CompactToTarget(compact uint32) *big.Int {
+
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+
+	return target
+}
+
+// TargetToCompact is the inverse of CompactToTarget. Precision beyond the
+// 23 bit mantissa is dropped.
+func TargetToCompact(target *big.Int) uint32 {
+
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(target).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Abs(target)
+		mantissa = uint32(shifted.Rsh(shifted, 8*(exponent-3)).Uint64())
+	}
+
+	// Keep the sign bit clear by moving the mantissa into the next byte
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// CalcNextBits returns the target a block built on top of prev has to meet.
+// The target only changes at the start of each retarget window, where it is
+// scaled by how long the previous window actually took compared to
+// RetargetInterval * TargetBlockTime. A single adjustment is limited to a
+// factor of four in either direction and never exceeds the PowLimit.
+func (chain *Blockchain) CalcNextBits(prev *Block) (uint32, error) {
+
+	interval := Params.RetargetInterval
+	height := prev.Height + 1
+
+	if interval <= 0 || height%interval != 0 {
+		return prev.Bits, nil
+	}
+
+	// The first block of the window that is closing, as in Bitcoin
+	first := prev
+	for i := 0; i < interval-1; i++ {
+
+		if len(first.PrevHash) == 0 {
+			return prev.Bits, nil
+		}
+
+		parent, err := chain.GetBlock(first.PrevHash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find ancestor of block %x for retarget", prev.Hash)
+		}
+
+		first = parent
+	}
+
+	expected := int64(interval) * int64(Params.TargetBlockTime)
+	actual := prev.Timestamp - first.Timestamp
+
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToTarget(prev.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Cmp(Params.PowLimit) > 0 {
+		target.Set(Params.PowLimit)
+	}
+
+	return TargetToCompact(target), nil
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestCompactToTarget(t *testing.T) {
+
+	tests := []struct {
+		compact uint32
+		target  *big.Int
+	}{
+		{0x1d00ffff, new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x1d-3))},
+		{0x1b0404cb, new(big.Int).Lsh(big.NewInt(0x0404cb), 8*(0x1b-3))},
+		{0x03123456, big.NewInt(0x123456)},
+		{0x02123400, big.NewInt(0x1234)},
+		{Params.PowLimitBits, Params.PowLimit},
+	}
+
+	for _, test := range tests {
+		if got := CompactToTarget(test.compact); got.Cmp(test.target) != 0 {
+			t.Errorf("CompactToTarget(%08x) = %x, want %x", test.compact, got, test.target)
+		}
+
+		if got := TargetToCompact(test.target); got != test.compact {
+			t.Errorf("TargetToCompact(%x) = %08x, want %08x", test.target, got, test.compact)
+		}
+	}
+
+	//
+	// a mantissa with its top bit set would read as negative, so it moves
+	// down a byte
+	//
+	if got := TargetToCompact(big.NewInt(0x80)); got != 0x02008000 {
+		t.Errorf("TargetToCompact(0x80) = %08x, want 02008000", got)
+	}
+}
+
+// storeWindow writes a retarget window of blocks at bits straight to the
+// database, the last one span nanoseconds after the first, and returns the
+// last one.
+func storeWindow(t *testing.T, chain *Blockchain, bits uint32, span int64) *Block {
+	t.Helper()
+
+	interval := Params.RetargetInterval
+
+	var prev *Block
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for height := 0; height < interval; height++ {
+			block := &Block{BlockHeader: BlockHeader{Bits: bits, Timestamp: span * int64(height) / int64(interval-1)}}
+			block.Height = height
+			block.Hash = binary.BigEndian.AppendUint32([]byte("window-"), uint32(height))
+			if prev != nil {
+				block.PrevHash = prev.Hash
+			}
+
+			if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+				return err
+			}
+			prev = block
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("storing the window: %v", err)
+	}
+
+	return prev
+}
+
+func TestCalcNextBits(t *testing.T) {
+
+	chain := newTestChain(t, 9109, wallet.MakeAccount())
+
+	expected := int64(Params.RetargetInterval) * int64(Params.TargetBlockTime)
+	start := new(big.Int).Rsh(Params.PowLimit, 4)
+
+	scaled := func(num, den int64) uint32 {
+		target := new(big.Int).Mul(start, big.NewInt(num))
+		return TargetToCompact(target.Div(target, big.NewInt(den)))
+	}
+
+	tests := []struct {
+		name string
+		bits uint32
+		span int64
+		want uint32
+	}{
+		{name: "on schedule", bits: TargetToCompact(start), span: expected, want: TargetToCompact(start)},
+		{name: "twice as fast", bits: TargetToCompact(start), span: expected / 2, want: scaled(1, 2)},
+		{name: "twice as slow", bits: TargetToCompact(start), span: expected * 2, want: scaled(2, 1)},
+		{name: "much faster is limited to four times", bits: TargetToCompact(start), span: expected / 10, want: scaled(1, 4)},
+		{name: "much slower is limited to four times", bits: TargetToCompact(start), span: expected * 10, want: scaled(4, 1)},
+		{name: "never easier than the limit", bits: Params.PowLimitBits, span: expected * 2, want: Params.PowLimitBits},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prev := storeWindow(t, chain, test.bits, test.span)
+
+			bits, err := chain.CalcNextBits(prev)
+			if err != nil {
+				t.Fatalf("CalcNextBits: %v", err)
+			}
+			if bits != test.want {
+				t.Fatalf("bits %08x, want %08x", bits, test.want)
+			}
+		})
+	}
+
+	//
+	// within a window the target stays where it is
+	//
+	prev := storeWindow(t, chain, TargetToCompact(start), expected/10)
+	parent, err := chain.GetBlock(prev.PrevHash)
+	if err != nil {
+		t.Fatalf("GetBlock: %v", err)
+	}
+
+	if bits, err := chain.CalcNextBits(parent); err != nil || bits != TargetToCompact(start) {
+		t.Fatalf("bits %08x (%v) within a window, want %08x", bits, err, TargetToCompact(start))
+	}
+}
@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	MAX_CONFIRM_TARGET  = 25
+	MAX_BUCKET_FEE_RATE = 100000
+	FEE_BUCKET_SPACING  = 1.2
+	FEE_DECAY           = 0.998
+	FEE_SUCCESS_RATE    = 0.85
+	MIN_FEE_SAMPLES     = 3
+)
+
+var ErrInsufficientFeeData = errors.New("not enough confirmed transactions to estimate a fee")
+
+type trackedTx struct {
+	bucket int
+	height int
+}
+
+// FeeEstimator learns which fee rates get transactions confirmed quickly.
+// Transactions are sorted into fee-rate buckets when they enter the
+// mempool; as blocks arrive, each bucket records how many blocks its
+// transactions waited. Older observations fade by FEE_DECAY per block.
+type FeeEstimator struct {
+	mu         sync.Mutex
+	buckets    []int
+	confirmed  [][]float64
+	total      []float64
+	tracked    map[string]trackedTx
+	bestHeight int
+}
+
+func NewFeeEstimator(bestHeight int) *FeeEstimator {
+
+	buckets := []int{0}
+	for rate := 1.0; rate <= MAX_BUCKET_FEE_RATE; rate *= FEE_BUCKET_SPACING {
+		if int(rate) > buckets[len(buckets)-1] {
+			buckets = append(buckets, int(rate))
+		}
+	}
+
+	confirmed := make([][]float64, MAX_CONFIRM_TARGET)
+	for i := range confirmed {
+		confirmed[i] = make([]float64, len(buckets))
+	}
+
+	return &FeeEstimator{
+		buckets:    buckets,
+		confirmed:  confirmed,
+		total:      make([]float64, len(buckets)),
+		tracked:    make(map[string]trackedTx),
+		bestHeight: bestHeight,
+	}
+}
+
+// BestHeight is the height of the last block the estimator has seen.
+func (fe *FeeEstimator) BestHeight() int {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	return fe.bestHeight
+}
+
+// ObserveTransaction starts tracking a transaction accepted to the mempool.
+func (fe *FeeEstimator) ObserveTransaction(desc *TxDesc) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	fe.tracked[hex.EncodeToString(desc.Tx.HashID)] = trackedTx{
+		bucket: fe.bucketFor(desc.FeeRate()),
+		height: desc.Height,
+	}
+}
+
+// ProcessBlock records how long the tracked transactions in a newly
+// connected block waited. Transactions still waiting after
+// MAX_CONFIRM_TARGET blocks count as failures for their bucket.
+func (fe *FeeEstimator) ProcessBlock(block *Block) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if block.Height <= fe.bestHeight {
+		return
+	}
+	fe.bestHeight = block.Height
+
+	for b := range fe.total {
+		fe.total[b] *= FEE_DECAY
+		for target := range fe.confirmed {
+			fe.confirmed[target][b] *= FEE_DECAY
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.HashID)
+
+		tracked, ok := fe.tracked[txID]
+		if !ok {
+			continue
+		}
+		delete(fe.tracked, txID)
+
+		waited := block.Height - tracked.height
+		if waited < 1 {
+			continue
+		}
+
+		for target := waited; target <= MAX_CONFIRM_TARGET; target++ {
+			fe.confirmed[target-1][tracked.bucket]++
+		}
+		fe.total[tracked.bucket]++
+	}
+
+	for txID, tracked := range fe.tracked {
+		if block.Height-tracked.height > MAX_CONFIRM_TARGET {
+			fe.total[tracked.bucket]++
+			delete(fe.tracked, txID)
+		}
+	}
+}
+
+// EstimateFee returns the lowest fee rate, in coins per kilobyte, at which
+// at least FEE_SUCCESS_RATE of past transactions confirmed within target
+// blocks. Buckets are read from the highest fee rate down and merged until
+// they hold MIN_FEE_SAMPLES transactions; the search stops at the first
+// range that falls short.
+func (fe *FeeEstimator) EstimateFee(target int) (int, error) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if target < 1 || target > MAX_CONFIRM_TARGET {
+		return 0, fmt.Errorf("confirmation target must be between 1 and %d blocks", MAX_CONFIRM_TARGET)
+	}
+
+	passing := -1
+	confirmed, total := 0.0, 0.0
+
+	for b := len(fe.buckets) - 1; b >= 0; b-- {
+		confirmed += fe.confirmed[target-1][b]
+		total += fe.total[b]
+
+		if total < MIN_FEE_SAMPLES {
+			continue
+		}
+
+		if confirmed/total < FEE_SUCCESS_RATE {
+			break
+		}
+
+		passing = b
+		confirmed, total = 0, 0
+	}
+
+	if passing < 0 {
+		return 0, ErrInsufficientFeeData
+	}
+
+	return fe.buckets[passing], nil
+}
+
+func (fe *FeeEstimator) bucketFor(feeRate int) int {
+	for b := len(fe.buckets) - 1; b > 0; b-- {
+		if feeRate >= fe.buckets[b] {
+			return b
+		}
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+// observe starts tracking count transactions paying feeRate, accepted at
+// height, and returns them.
+func observe(fe *FeeEstimator, count, feeRate, height int) []*Transaction {
+	var txs []*Transaction
+
+	for i := 0; i < count; i++ {
+		desc := fakeDesc(feeRate, 1000)
+		desc.Height = height
+
+		fe.ObserveTransaction(desc)
+		txs = append(txs, desc.Tx)
+	}
+
+	return txs
+}
+
+func TestEstimateFee(t *testing.T) {
+
+	fe := NewFeeEstimator(0)
+
+	if _, err := fe.EstimateFee(1); !errors.Is(err, ErrInsufficientFeeData) {
+		t.Fatalf("without data: expected %v, got %v", ErrInsufficientFeeData, err)
+	}
+
+	for _, target := range []int{0, MAX_CONFIRM_TARGET + 1} {
+		if _, err := fe.EstimateFee(target); err == nil {
+			t.Fatalf("expected an error for a target of %d", target)
+		}
+	}
+
+	//
+	// transactions paying 100 confirm in the next block, those paying 10
+	// wait five blocks and those paying 50 never make it
+	//
+	fast := observe(fe, 10, 100, 0)
+	slow := observe(fe, 10, 10, 0)
+	observe(fe, 10, 50, 0)
+
+	for height := 1; height <= MAX_CONFIRM_TARGET+1; height++ {
+		block := &Block{BlockHeader: BlockHeader{Height: height}}
+
+		switch height {
+		case 1:
+			block.Transactions = fast
+		case 5:
+			block.Transactions = slow
+		}
+
+		fe.ProcessBlock(block)
+	}
+
+	fastRate := fe.buckets[fe.bucketFor(100)]
+
+	tests := []struct {
+		target int
+		rate   int
+	}{
+		{1, fastRate},
+		{4, fastRate},
+		//
+		// from five blocks on the slow transactions would pass, but the
+		// ones paying 50 fail first and stop the search
+		//
+		{5, fastRate},
+		{MAX_CONFIRM_TARGET, fastRate},
+	}
+
+	for _, test := range tests {
+		rate, err := fe.EstimateFee(test.target)
+		if err != nil || rate != test.rate {
+			t.Errorf("EstimateFee(%d) = %d, %v, want %d", test.target, rate, err, test.rate)
+		}
+	}
+
+	if fe.BestHeight() != MAX_CONFIRM_TARGET+1 {
+		t.Fatalf("best height %d, want %d", fe.BestHeight(), MAX_CONFIRM_TARGET+1)
+	}
+}
+
+func TestEstimateFeeSlowTarget(t *testing.T) {
+
+	fe := NewFeeEstimator(0)
+
+	fast := observe(fe, 10, 100, 0)
+	slow := observe(fe, 10, 10, 0)
+
+	fe.ProcessBlock(&Block{BlockHeader: BlockHeader{Height: 1}, Transactions: fast})
+	for height := 2; height < 5; height++ {
+		fe.ProcessBlock(&Block{BlockHeader: BlockHeader{Height: height}})
+	}
+	fe.ProcessBlock(&Block{BlockHeader: BlockHeader{Height: 5}, Transactions: slow})
+
+	//
+	// a block already seen changes nothing
+	//
+	fe.ProcessBlock(&Block{BlockHeader: BlockHeader{Height: 5}, Transactions: observe(fe, 10, 1000, 0)})
+
+	tests := []struct {
+		target int
+		rate   int
+	}{
+		{1, fe.buckets[fe.bucketFor(100)]},
+		{4, fe.buckets[fe.bucketFor(100)]},
+		{5, fe.buckets[fe.bucketFor(10)]},
+	}
+
+	for _, test := range tests {
+		rate, err := fe.EstimateFee(test.target)
+		if err != nil || rate != test.rate {
+			t.Errorf("EstimateFee(%d) = %d, %v, want %d", test.target, rate, err, test.rate)
+		}
+	}
+}
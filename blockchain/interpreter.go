@@ -0,0 +1,591 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// MAX_SCRIPT_NUM_LEN is the most bytes a value read as a number may have.
+const MAX_SCRIPT_NUM_LEN = 4
+
+// scriptNum is a number as the interpreter sees it: little endian with the
+// sign in the top bit of the last byte, and no more bytes than needed.
+type scriptNum int64
+
+func (n scriptNum) Bytes() []byte {
+
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+
+	// the sign bit goes into a byte of its own when the top byte needs it
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+func makeScriptNum(v []byte, maxLen int) (scriptNum, error) {
+
+	if len(v) > maxLen {
+		return 0, fmt.Errorf("number is %d bytes, the limit is %d", len(v), maxLen)
+	}
+
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	// the top byte may only be a bare sign when the byte below needs its
+	// top bit for the value
+	if v[len(v)-1]&0x7f == 0 && (len(v) == 1 || v[len(v)-2]&0x80 == 0) {
+		return 0, errors.New("number is not minimally encoded")
+	}
+
+	var result int64
+	for i, b := range v {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if v[len(v)-1]&0x80 != 0 {
+		result &^= int64(0x80) << uint(8*(len(v)-1))
+		return scriptNum(-result), nil
+	}
+
+	return scriptNum(result), nil
+}
+
+func asBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			// negative zero is false too
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+
+// scriptEngine runs the scripts of one transaction input. The stack carries
+// over from the unlocking script to the locking script.
+type scriptEngine struct {
+	tx     *Transaction
+	inIdx  int
+	stack  [][]byte
+	numOps int
+}
+
+func (vm *scriptEngine) push(v []byte) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *scriptEngine) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("stack is empty")
+	}
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v, nil
+}
+
+func (vm *scriptEngine) peek(depth int) ([]byte, error) {
+	if depth >= len(vm.stack) {
+		return nil, fmt.Errorf("stack has %d values, %d needed", len(vm.stack), depth+1)
+	}
+	return vm.stack[len(vm.stack)-1-depth], nil
+}
+
+func (vm *scriptEngine) popNum() (scriptNum, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return makeScriptNum(v, MAX_SCRIPT_NUM_LEN)
+}
+
+func (vm *scriptEngine) countOps(n int) error {
+	vm.numOps += n
+	if vm.numOps > MAX_OPS_PER_SCRIPT {
+		return fmt.Errorf("script runs more than %d opcodes", MAX_OPS_PER_SCRIPT)
+	}
+	return nil
+}
+
+func (vm *scriptEngine) popBool() (bool, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+	return asBool(v), nil
+}
+
+// execute runs script on the current stack. Signatures are checked against
+// the transaction with script standing in for the input's unlocking script.
+func (vm *scriptEngine) execute(script []byte) error {
+
+	if len(script) > MAX_SCRIPT_SIZE {
+		return fmt.Errorf("script is %d bytes, the limit is %d", len(script), MAX_SCRIPT_SIZE)
+	}
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	// conditions holds, for each OP_IF being executed, whether its branch
+	// currently runs
+	var conditions []bool
+	vm.numOps = 0
+
+	for _, op := range ops {
+
+		executing := true
+		for _, cond := range conditions {
+			executing = executing && cond
+		}
+
+		if len(op.data) > MAX_SCRIPT_ELEMENT_SIZE {
+			return fmt.Errorf("push of %d bytes exceeds the limit of %d", len(op.data), MAX_SCRIPT_ELEMENT_SIZE)
+		}
+
+		if !op.isPush() {
+			if err := vm.countOps(1); err != nil {
+				return err
+			}
+		}
+
+		switch op.opcode {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing {
+				if branch, err = vm.popBool(); err != nil {
+					return err
+				}
+				if op.opcode == OP_NOTIF {
+					branch = !branch
+				}
+			}
+			conditions = append(conditions, branch)
+			continue
+
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if !executing {
+			continue
+		}
+
+		if err := vm.step(op, script); err != nil {
+			return fmt.Errorf("%s: %w", opcodeName(op.opcode), err)
+		}
+
+		if len(vm.stack) > MAX_STACK_SIZE {
+			return fmt.Errorf("stack holds more than %d values", MAX_STACK_SIZE)
+		}
+	}
+
+	if len(conditions) != 0 {
+		return errors.New("OP_IF without OP_ENDIF")
+	}
+
+	return nil
+}
+
+// step runs a single opcode other than the flow control ones.
+func (vm *scriptEngine) step(op scriptOp, script []byte) error {
+
+	switch {
+	case op.opcode == OP_0:
+		vm.push(nil)
+		return nil
+
+	case op.opcode >= OP_DATA_1 && op.opcode <= OP_PUSHDATA2:
+		vm.push(op.data)
+		return nil
+
+	case op.opcode == OP_1NEGATE || (op.opcode >= OP_1 && op.opcode <= OP_16):
+		vm.push(scriptNum(int(op.opcode) - (OP_1 - 1)).Bytes())
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+
+	case OP_VERIFY:
+		ok, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("verify failed")
+		}
+
+	case OP_RETURN:
+		return errors.New("script is unspendable")
+
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+
+	case OP_DUP, OP_OVER:
+		depth := 0
+		if op.opcode == OP_OVER {
+			depth = 1
+		}
+		v, err := vm.peek(depth)
+		if err != nil {
+			return err
+		}
+		vm.push(v)
+
+	case OP_SWAP:
+		if len(vm.stack) < 2 {
+			return errors.New("stack has fewer than 2 values")
+		}
+		n := len(vm.stack)
+		vm.stack[n-1], vm.stack[n-2] = vm.stack[n-2], vm.stack[n-1]
+
+	case OP_SIZE:
+		v, err := vm.peek(0)
+		if err != nil {
+			return err
+		}
+		vm.push(scriptNum(len(v)).Bytes())
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		equal := bytes.Equal(a, b)
+		if op.opcode == OP_EQUALVERIFY {
+			if !equal {
+				return errors.New("values are not equal")
+			}
+			return nil
+		}
+		vm.push(fromBool(equal))
+
+	case OP_1ADD, OP_1SUB, OP_NOT:
+		n, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+
+		switch op.opcode {
+		case OP_1ADD:
+			vm.push((n + 1).Bytes())
+		case OP_1SUB:
+			vm.push((n - 1).Bytes())
+		case OP_NOT:
+			vm.push(fromBool(n == 0))
+		}
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_LESSTHAN, OP_GREATERTHAN:
+		b, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+
+		switch op.opcode {
+		case OP_ADD:
+			vm.push((a + b).Bytes())
+		case OP_SUB:
+			vm.push((a - b).Bytes())
+		case OP_BOOLAND:
+			vm.push(fromBool(a != 0 && b != 0))
+		case OP_BOOLOR:
+			vm.push(fromBool(a != 0 || b != 0))
+		case OP_NUMEQUAL:
+			vm.push(fromBool(a == b))
+		case OP_LESSTHAN:
+			vm.push(fromBool(a < b))
+		case OP_GREATERTHAN:
+			vm.push(fromBool(a > b))
+		}
+
+	case OP_SHA256:
+		v, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(v)
+		vm.push(hash[:])
+
+	case OP_HASH160:
+		v, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(wallet.Hash160(v))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		if err := checkSignatureEncoding(signature); err != nil {
+			return err
+		}
+		if _, err := parsePubKey(pubKey); err != nil {
+			return err
+		}
+
+		valid := checkTxSignature(vm.tx, vm.inIdx, script, pubKey, signature)
+
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !valid {
+				return errors.New("signature is invalid")
+			}
+			return nil
+		}
+		vm.push(fromBool(valid))
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := vm.checkMultiSig(script)
+		if err != nil {
+			return err
+		}
+
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return errors.New("signatures are invalid")
+			}
+			return nil
+		}
+		vm.push(fromBool(valid))
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		return vm.checkLockTime()
+
+	default:
+		return errors.New("opcode is not defined")
+	}
+
+	return nil
+}
+
+// checkLockTime fails unless the transaction's lock time is at or past the
+// one on top of the stack, and of the same kind, height or time. The input
+// may not be final, or the transaction lock time would not be enforced.
+// The value is left on the stack.
+func (vm *scriptEngine) checkLockTime() error {
+
+	v, err := vm.peek(0)
+	if err != nil {
+		return err
+	}
+
+	// a lock time may need five bytes to reach every uint32
+	lockTime, err := makeScriptNum(v, 5)
+	if err != nil {
+		return err
+	}
+
+	txLockTime := int64(vm.tx.LockTime)
+
+	switch {
+	case lockTime < 0:
+		return errors.New("lock time is negative")
+	case (lockTime < LOCKTIME_THRESHOLD) != (txLockTime < LOCKTIME_THRESHOLD):
+		return fmt.Errorf("lock time %d and transaction lock time %d are not of the same kind", lockTime, txLockTime)
+	case int64(lockTime) > txLockTime:
+		return fmt.Errorf("transaction lock time %d is before %d", txLockTime, lockTime)
+	case vm.tx.Inputs[vm.inIdx].Sequence == SEQUENCE_FINAL:
+		return errors.New("input is final, so the lock time is not enforced")
+	}
+
+	return nil
+}
+
+// checkMultiSig pops <sig>... <m> <pubkey>... <n> and reports whether the m
+// signatures were made by m of the n keys. Signatures have to come in the
+// order of their keys, so each key is tried at most once.
+func (vm *scriptEngine) checkMultiSig(script []byte) (bool, error) {
+
+	n, err := vm.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MAX_PUBKEYS_PER_MULTISIG {
+		return false, fmt.Errorf("%d keys, the limit is %d", n, MAX_PUBKEYS_PER_MULTISIG)
+	}
+	if err := vm.countOps(int(n)); err != nil {
+		return false, err
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := int(n) - 1; i >= 0; i-- {
+		if pubKeys[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := vm.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("cannot require %d of %d signatures", m, n)
+	}
+
+	signatures := make([][]byte, m)
+	for i := int(m) - 1; i >= 0; i-- {
+		if signatures[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+		if err := checkSignatureEncoding(signatures[i]); err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for sigIdx, signature := range signatures {
+		for {
+			// fewer keys left than signatures to match
+			if len(pubKeys)-key < len(signatures)-sigIdx {
+				return false, nil
+			}
+
+			if _, err := parsePubKey(pubKeys[key]); err != nil {
+				return false, err
+			}
+
+			matched := checkTxSignature(vm.tx, vm.inIdx, script, pubKeys[key], signature)
+			key++
+			if matched {
+				break
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// VerifyScript runs the unlocking script of input inIdx of tx and then the
+// locking script of the output it spends. The input is valid when they
+// finish with a single true value on the stack. For pay-to-script-hash
+// outputs the last value pushed by the unlocking script is the redeem
+// script, which is then run on the rest of the values and has to end the
+// same way.
+func VerifyScript(unlocking, locking []byte, tx *Transaction, inIdx int) error {
+
+	if !IsPushOnly(unlocking) {
+		return errors.New("unlocking script may only push data")
+	}
+
+	vm := &scriptEngine{tx: tx, inIdx: inIdx}
+
+	if err := vm.execute(unlocking); err != nil {
+		return fmt.Errorf("unlocking script: %w", err)
+	}
+
+	unlocked := append([][]byte{}, vm.stack...)
+
+	if err := vm.execute(locking); err != nil {
+		return fmt.Errorf("locking script: %w", err)
+	}
+
+	isScriptHash := IsPayToScriptHash(locking)
+
+	if err := vm.finish(!isScriptHash); err != nil {
+		return fmt.Errorf("locking script: %w", err)
+	}
+
+	if !isScriptHash {
+		return nil
+	}
+
+	vm.stack = unlocked
+	redeem, err := vm.pop()
+	if err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+
+	if err := vm.execute(redeem); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+
+	if err := vm.finish(true); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+
+	return nil
+}
+
+// finish checks that a script left a true value on top of the stack. The
+// last script to run has to leave nothing else, so that an unlocking script
+// cannot be padded with values nothing reads.
+func (vm *scriptEngine) finish(last bool) error {
+
+	top, err := vm.peek(0)
+	if err != nil {
+		return err
+	}
+
+	if !asBool(top) {
+		return errors.New("script finished with false on the stack")
+	}
+
+	if last && len(vm.stack) != 1 {
+		return fmt.Errorf("script finished with %d values on the stack instead of 1", len(vm.stack))
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// LOCKTIME_THRESHOLD splits lock times into block heights, below it, and
+	// unix times in seconds, at or above it.
+	LOCKTIME_THRESHOLD = 500000000
+
+	// An input whose sequence has SEQUENCE_LOCKTIME_DISABLE_FLAG cleared
+	// cannot be spent until the output it spends has aged by the low
+	// SEQUENCE_LOCKTIME_MASK bits of the sequence: that many blocks, or, with
+	// SEQUENCE_LOCKTIME_TYPE_FLAG set, that many units of
+	// 2^SEQUENCE_LOCKTIME_GRANULARITY seconds of median time past.
+	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    = 1 << 22
+	SEQUENCE_LOCKTIME_MASK         = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY  = 9
+)
+
+// IsFinal reports whether the transaction may go into a block at height
+// whose parent has the given median time past, in seconds. A LockTime of
+// zero, or one that has passed, makes it final, and so do inputs that are
+// all numbered SEQUENCE_FINAL.
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := int64(height)
+	if tx.LockTime >= LOCKTIME_THRESHOLD {
+		limit = medianTime
+	}
+
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+
+	for _, in := range tx.Inputs {
+		if in.Sequence != SEQUENCE_FINAL {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RelativeLockBlocks returns the input sequence that keeps an output from
+// being spent until it is the given number of blocks deep.
+func RelativeLockBlocks(blocks int) uint32 {
+	return uint32(blocks) & SEQUENCE_LOCKTIME_MASK
+}
+
+// RelativeLockTime returns the input sequence that keeps an output from being
+// spent until the median time past has moved on by at least d since it was
+// confirmed.
+func RelativeLockTime(d time.Duration) uint32 {
+	units := (int64(d/time.Second) + (1 << SEQUENCE_LOCKTIME_GRANULARITY) - 1) >> SEQUENCE_LOCKTIME_GRANULARITY
+	return SEQUENCE_LOCKTIME_TYPE_FLAG | uint32(units)&SEQUENCE_LOCKTIME_MASK
+}
+
+// checkFinal makes sure the transaction's lock time has passed for a block at
+// height on top of the tip.
+func (chain *Blockchain) checkFinal(tx *Transaction, height int) error {
+
+	medianTime := int64(0)
+
+	if tx.LockTime >= LOCKTIME_THRESHOLD {
+		var err error
+		if medianTime, err = chain.medianTimeAt(height - 1); err != nil {
+			return err
+		}
+	}
+
+	if !tx.IsFinal(height, medianTime) {
+		return ruleError(RejectNonFinal, "transaction %x is locked until %s", tx.HashID, describeLockTime(tx.LockTime))
+	}
+
+	return nil
+}
+
+// checkSequenceLocks makes sure every input with a relative lock spends an
+// output that has aged enough by a block at height on top of the tip.
+// coinHeights holds the height each input's output was confirmed at.
+func (chain *Blockchain) checkSequenceLocks(tx *Transaction, coinHeights []int, height int) error {
+
+	for inIdx, in := range tx.Inputs {
+
+		if in.Sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			continue
+		}
+
+		value := int64(in.Sequence & SEQUENCE_LOCKTIME_MASK)
+
+		if in.Sequence&SEQUENCE_LOCKTIME_TYPE_FLAG == 0 {
+			if minHeight := coinHeights[inIdx] + int(value); height < minHeight {
+				return ruleError(RejectSequenceLock, "transaction %x input %d is locked until height %d", tx.HashID, inIdx, minHeight)
+			}
+			continue
+		}
+
+		//
+		// the output counts as confirmed at the median time past of
+		// the block before the one it was confirmed in
+		//
+		coinTime, err := chain.medianTimeAt(coinHeights[inIdx] - 1)
+		if err != nil {
+			return err
+		}
+
+		medianTime, err := chain.medianTimeAt(height - 1)
+		if err != nil {
+			return err
+		}
+
+		if minTime := coinTime + value<<SEQUENCE_LOCKTIME_GRANULARITY; medianTime < minTime {
+			return ruleError(RejectSequenceLock, "transaction %x input %d is locked until %s", tx.HashID, inIdx, time.Unix(minTime, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// medianTimeAt returns the median time past, in seconds, of the block at
+// height on the branch ending at the tip.
+func (chain *Blockchain) medianTimeAt(height int) (int64, error) {
+
+	block, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	for block.Height > max(height, 0) {
+		if block, err = chain.GetBlock(block.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+
+	medianTime, err := chain.CalcPastMedianTime(block)
+	if err != nil {
+		return 0, err
+	}
+
+	return medianTime / int64(time.Second), nil
+}
+
+func describeLockTime(lockTime uint32) string {
+	if lockTime < LOCKTIME_THRESHOLD {
+		return fmt.Sprintf("height %d", lockTime)
+	}
+	return time.Unix(int64(lockTime), 0).UTC().Format(time.RFC3339)
+}
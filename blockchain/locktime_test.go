@@ -0,0 +1,171 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestCheckLockTimeVerify(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		lockTime   int64
+		txLockTime uint32
+		sequence   uint32
+		valid      bool
+	}{
+		{name: "height reached", lockTime: 100, txLockTime: 100, sequence: MAX_RBF_SEQUENCE, valid: true},
+		{name: "height passed", lockTime: 100, txLockTime: 101, sequence: MAX_RBF_SEQUENCE, valid: true},
+		{name: "height one short", lockTime: 100, txLockTime: 99, sequence: MAX_RBF_SEQUENCE},
+		{name: "last height", lockTime: LOCKTIME_THRESHOLD - 1, txLockTime: LOCKTIME_THRESHOLD - 1, sequence: MAX_RBF_SEQUENCE, valid: true},
+		{name: "first time", lockTime: LOCKTIME_THRESHOLD, txLockTime: LOCKTIME_THRESHOLD, sequence: MAX_RBF_SEQUENCE, valid: true},
+		{name: "height against a time", lockTime: LOCKTIME_THRESHOLD - 1, txLockTime: LOCKTIME_THRESHOLD, sequence: MAX_RBF_SEQUENCE},
+		{name: "time against a height", lockTime: LOCKTIME_THRESHOLD, txLockTime: LOCKTIME_THRESHOLD - 1, sequence: MAX_RBF_SEQUENCE},
+		{name: "time one short", lockTime: 1700000000, txLockTime: 1699999999, sequence: MAX_RBF_SEQUENCE},
+		{name: "largest lock time", lockTime: 0xffffffff, txLockTime: 0xffffffff, sequence: MAX_RBF_SEQUENCE, valid: true},
+		{name: "negative", lockTime: -1, txLockTime: 100, sequence: MAX_RBF_SEQUENCE},
+		{name: "final input", lockTime: 100, txLockTime: 100, sequence: SEQUENCE_FINAL},
+		{name: "final but one input", lockTime: 100, txLockTime: 100, sequence: SEQUENCE_FINAL - 1, valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locking, err := NewScriptBuilder().AddInt64(test.lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).Script()
+			if err != nil {
+				t.Fatalf("building the script: %v", err)
+			}
+
+			tx := spendingTx()
+			tx.LockTime = test.txLockTime
+			tx.Inputs[0].Sequence = test.sequence
+
+			err = VerifyScript(nil, locking, tx, 0)
+			if test.valid && err != nil {
+				t.Fatalf("expected the lock time to have passed, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the spend to fail")
+			}
+		})
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+
+	const medianTime = 1700000000
+
+	tests := []struct {
+		name     string
+		lockTime uint32
+		sequence uint32
+		height   int
+		final    bool
+	}{
+		{name: "no lock time", lockTime: 0, sequence: MAX_RBF_SEQUENCE, height: 1, final: true},
+		{name: "height above the lock", lockTime: 100, sequence: MAX_RBF_SEQUENCE, height: 101, final: true},
+		{name: "height at the lock", lockTime: 100, sequence: MAX_RBF_SEQUENCE, height: 100},
+		{name: "height below the lock", lockTime: 100, sequence: MAX_RBF_SEQUENCE, height: 99},
+		{name: "median time above the lock", lockTime: medianTime - 1, sequence: MAX_RBF_SEQUENCE, height: 1, final: true},
+		{name: "median time at the lock", lockTime: medianTime, sequence: MAX_RBF_SEQUENCE, height: 1},
+		{name: "lock with final inputs", lockTime: 100, sequence: SEQUENCE_FINAL, height: 1, final: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := spendingTx()
+			tx.LockTime = test.lockTime
+			tx.Inputs[0].Sequence = test.sequence
+
+			if final := tx.IsFinal(test.height, medianTime); final != test.final {
+				t.Fatalf("IsFinal = %v, want %v", final, test.final)
+			}
+		})
+	}
+}
+
+func TestCheckSequenceLocks(t *testing.T) {
+
+	const coinHeight = 10
+
+	tests := []struct {
+		name     string
+		sequence uint32
+		height   int
+		valid    bool
+	}{
+		{name: "block lock reached", sequence: RelativeLockBlocks(5), height: coinHeight + 5, valid: true},
+		{name: "block lock one short", sequence: RelativeLockBlocks(5), height: coinHeight + 4},
+		{name: "zero blocks", sequence: RelativeLockBlocks(0), height: coinHeight, valid: true},
+		{name: "largest block lock one short", sequence: RelativeLockBlocks(SEQUENCE_LOCKTIME_MASK), height: coinHeight + SEQUENCE_LOCKTIME_MASK - 1},
+		{name: "disabled", sequence: SEQUENCE_LOCKTIME_DISABLE_FLAG | RelativeLockBlocks(5), height: coinHeight, valid: true},
+		{name: "final", sequence: SEQUENCE_FINAL, height: coinHeight, valid: true},
+	}
+
+	chain := &Blockchain{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := spendingTx()
+			tx.Inputs[0].Sequence = test.sequence
+
+			err := chain.checkSequenceLocks(tx, []int{coinHeight}, test.height)
+			if test.valid && err != nil {
+				t.Fatalf("expected the relative lock to have passed, got %v", err)
+			}
+			if !test.valid && !IsRejectReason(err, RejectSequenceLock) {
+				t.Fatalf("expected %s, got %v", RejectSequenceLock, err)
+			}
+		})
+	}
+}
+
+func TestRelativeLockTime(t *testing.T) {
+
+	tests := []struct {
+		d        time.Duration
+		sequence uint32
+	}{
+		{0, SEQUENCE_LOCKTIME_TYPE_FLAG},
+		{512 * time.Second, SEQUENCE_LOCKTIME_TYPE_FLAG | 1},
+		{513 * time.Second, SEQUENCE_LOCKTIME_TYPE_FLAG | 2},
+		{time.Hour, SEQUENCE_LOCKTIME_TYPE_FLAG | 8},
+	}
+
+	for _, test := range tests {
+		if sequence := RelativeLockTime(test.d); sequence != test.sequence {
+			t.Errorf("RelativeLockTime(%s) = %#x, want %#x", test.d, sequence, test.sequence)
+		}
+	}
+}
+
+func TestLockedTransactionWaitsForItsHeight(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9115, alice)
+
+	genesis := tipBlock(t, chain)
+	coinbase := genesis.Transactions[0]
+
+	tx := &Transaction{
+		Inputs:   []TxInput{{ID: coinbase.HashID, Out: 0, Sequence: SEQUENCE_FINAL - 1}},
+		Outputs:  []TxOutput{*NewTXOutput(coinbase.Outputs[0].Value, string(alice.Address()))},
+		LockTime: 2,
+	}
+	tx.HashID = tx.ID()
+	tx.Sign(alice.PrivateKey, map[string]TxOutput{OutpointKey(coinbase.HashID, 0): coinbase.Outputs[0]})
+
+	if err := chain.AddBlock(createOn(t, chain, genesis, alice, tx)); !IsRejectReason(err, RejectNonFinal) {
+		t.Fatalf("block at height 1: expected %s, got %v", RejectNonFinal, err)
+	}
+
+	first := mineOn(t, chain, genesis, alice)
+
+	if _, err := chain.CheckTransactionInputs(tx, nil, 2); !IsRejectReason(err, RejectNonFinal) {
+		t.Fatalf("at height 2: expected %s, got %v", RejectNonFinal, err)
+	}
+
+	second := mineOn(t, chain, first, alice)
+	mineOn(t, chain, second, alice, tx)
+}
@@ -0,0 +1,619 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_MEMPOOL_TXS  = 5000
+	MAX_MEMPOOL_SIZE = 4 << 20
+	MAX_TX_SIZE      = 100000
+	MEMPOOL_EXPIRY   = 24 * time.Hour
+	MEMPOOL_PATH     = "../tmp/mempool_%d.data"
+
+	MAX_REPLACEMENT_EVICTIONS = 100
+	// INCREMENTAL_RELAY_FEE is how much, in coins per kilobyte, BumpFee
+	// has to raise the fee rate of the transaction it replaces.
+	INCREMENTAL_RELAY_FEE = 1
+)
+
+// TxDesc is a transaction in the mempool along with what the pool knows
+// about it. Height is that of the tip when the transaction was accepted.
+type TxDesc struct {
+	Tx     *Transaction
+	Fee    int
+	Size   int
+	Added  time.Time
+	Height int
+}
+
+// FeeRate is the fee paid in coins per kilobyte.
+func (desc *TxDesc) FeeRate() int {
+	return desc.Fee * 1000 / desc.Size
+}
+
+// paysLessThan compares fee rates exactly, without rounding.
+func (desc *TxDesc) paysLessThan(other *TxDesc) bool {
+	return desc.Fee*other.Size < other.Fee*desc.Size
+}
+
+// Mempool holds the transactions that are valid on top of the current tip
+// but not in a block yet. Transactions in the pool may spend each other's
+// outputs, but no two of them spend the same output. It is bounded in count,
+// size and age; when full, the transactions paying the lowest fee rate are
+// evicted first. A Mempool is safe for concurrent use.
+type Mempool struct {
+	// MinFeeRate is the lowest fee rate, in coins per kilobyte, that a
+	// transaction needs to be accepted.
+	MinFeeRate int
+
+	chain     *Blockchain
+	mu        sync.RWMutex
+	pool      map[string]*TxDesc
+	spent     map[string]*TxDesc
+	totalSize int
+}
+
+func NewMempool(chain *Blockchain) *Mempool {
+	return &Mempool{
+		chain: chain,
+		pool:  make(map[string]*TxDesc),
+		spent: make(map[string]*TxDesc),
+	}
+}
+
+// MaybeAcceptTransaction validates tx against the UTXO set and the pool and
+// adds it. It returns a RuleError when the transaction is rejected. A
+// transaction that spends the same outputs as replaceable ones in the pool
+// takes their place, and their descendants are evicted with them, when it
+// pays enough more to make up for them.
+func (mp *Mempool) MaybeAcceptTransaction(tx *Transaction) (*TxDesc, error) {
+	return mp.acceptTransaction(tx, time.Now())
+}
+
+func (mp *Mempool) acceptTransaction(tx *Transaction, added time.Time) (*TxDesc, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	OpenDB(mp.chain)
+	defer mp.chain.CloseDB()
+
+	mp.expire()
+
+	desc, conflicts, err := mp.checkTransaction(tx, mp.chain.GetBestHeight()+1)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// the conflicts are only evicted once the transaction is sure to
+	// stay, so a full pool cannot lose them for nothing
+	//
+	if !mp.hasRoom(desc, conflicts) {
+		return nil, ruleError(RejectMempoolFull, "mempool is full, transaction %x pays too little to stay", tx.HashID)
+	}
+
+	for _, conflict := range conflicts {
+		mp.removeWithDescendants(conflict)
+	}
+
+	desc.Added = added
+	mp.add(desc)
+	mp.trim()
+
+	if _, ok := mp.pool[hex.EncodeToString(tx.HashID)]; !ok {
+		return nil, ruleError(RejectMempoolFull, "mempool is full, transaction %x pays too little to stay", tx.HashID)
+	}
+
+	return desc, nil
+}
+
+// checkStandard applies the relay policy on scripts, which is stricter than
+// consensus: outputs must use one of the standard templates, and there may
+// be one data output, which may not burn any coins.
+func checkStandard(tx *Transaction) error {
+
+	dataOutputs := 0
+
+	for i, out := range tx.Outputs {
+		if !IsStandardScript(out.Script) {
+			return ruleError(RejectNonStandard, "transaction %x output %d has a nonstandard script", tx.HashID, i)
+		}
+
+		if isNullData(out.Script) {
+			if out.Value != 0 {
+				return ruleError(RejectNonStandard, "transaction %x data output %d burns %d coins", tx.HashID, i, out.Value)
+			}
+			dataOutputs++
+		}
+	}
+
+	if dataOutputs > 1 {
+		return ruleError(RejectNonStandard, "transaction %x has %d data outputs, only one is allowed", tx.HashID, dataOutputs)
+	}
+
+	return nil
+}
+
+// checkTransaction applies the acceptance rules to a transaction that is not
+// in the pool and returns its description, along with the pool transactions
+// it would replace.
+func (mp *Mempool) checkTransaction(tx *Transaction, height int) (*TxDesc, []*TxDesc, error) {
+
+	if err := CheckTransactionSanity(tx); err != nil {
+		return nil, nil, err
+	}
+
+	if tx.IsCoinbase() {
+		return nil, nil, ruleError(RejectCoinbaseNotInBlock, "coinbase transaction %x is only valid in a block", tx.HashID)
+	}
+
+	txID := hex.EncodeToString(tx.HashID)
+	if _, ok := mp.pool[txID]; ok {
+		return nil, nil, ruleError(RejectDuplicateTx, "transaction %s is already in the mempool", txID)
+	}
+
+	size := tx.Size()
+	if size > MAX_TX_SIZE {
+		return nil, nil, ruleError(RejectTxTooLarge, "transaction %s is %d bytes, the limit is %d", txID, size, MAX_TX_SIZE)
+	}
+
+	if err := checkStandard(tx); err != nil {
+		return nil, nil, err
+	}
+
+	pending := make(map[string]Transaction)
+	conflicts := make(map[string]*TxDesc)
+
+	for _, in := range tx.Inputs {
+		outpoint := OutpointKey(in.ID, in.Out)
+		if spender, ok := mp.spent[outpoint]; ok {
+			if !spender.Tx.IsReplaceable() {
+				return nil, nil, ruleError(RejectDoubleSpend, "transaction %s spends output %s, already spent by %x in the mempool", txID, outpoint, spender.Tx.HashID)
+			}
+			conflicts[hex.EncodeToString(spender.Tx.HashID)] = spender
+		}
+
+		if parent, ok := mp.pool[hex.EncodeToString(in.ID)]; ok {
+			pending[hex.EncodeToString(in.ID)] = *parent.Tx
+		}
+	}
+
+	fee, err := mp.chain.CheckTransactionInputs(tx, pending, height)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desc := &TxDesc{
+		Tx:     tx,
+		Fee:    fee,
+		Size:   size,
+		Height: height - 1,
+	}
+
+	if desc.FeeRate() < mp.MinFeeRate {
+		return nil, nil, ruleError(RejectInsufficientFee, "transaction %s pays %d coins/kB, the minimum is %d", txID, desc.FeeRate(), mp.MinFeeRate)
+	}
+
+	var replaced []*TxDesc
+	for _, conflict := range conflicts {
+		replaced = append(replaced, conflict)
+	}
+
+	if len(replaced) > 0 {
+		if err := mp.checkReplacement(desc, replaced); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return desc, replaced, nil
+}
+
+// checkReplacement decides whether desc may replace the conflicting pool
+// transactions. It has to pay a higher fee rate than each of them and a
+// higher absolute fee than all of them and their descendants together, and
+// may not spend outputs of any transaction it would evict.
+func (mp *Mempool) checkReplacement(desc *TxDesc, conflicts []*TxDesc) error {
+
+	txID := hex.EncodeToString(desc.Tx.HashID)
+	evicted := make(map[string]*TxDesc)
+
+	for _, conflict := range conflicts {
+		if !conflict.paysLessThan(desc) {
+			return ruleError(RejectInsufficientFee, "replacement %s pays %d coins/kB, no more than the %d of %x", txID, desc.FeeRate(), conflict.FeeRate(), conflict.Tx.HashID)
+		}
+
+		mp.collectDescendants(conflict, evicted)
+	}
+
+	if len(evicted) > MAX_REPLACEMENT_EVICTIONS {
+		return ruleError(RejectTooManyReplacements, "replacement %s would evict %d transactions, the limit is %d", txID, len(evicted), MAX_REPLACEMENT_EVICTIONS)
+	}
+
+	evictedFees := 0
+	for _, victim := range evicted {
+		evictedFees += victim.Fee
+	}
+
+	for _, in := range desc.Tx.Inputs {
+		if _, ok := evicted[hex.EncodeToString(in.ID)]; ok {
+			return ruleError(RejectDoubleSpend, "replacement %s spends an output of %x, which it replaces", txID, in.ID)
+		}
+	}
+
+	if desc.Fee <= evictedFees {
+		return ruleError(RejectInsufficientFee, "replacement %s pays a fee of %d, the transactions it evicts pay %d", txID, desc.Fee, evictedFees)
+	}
+
+	return nil
+}
+
+// collectDescendants adds desc and every pool transaction spending its
+// outputs, directly or further down, to into.
+func (mp *Mempool) collectDescendants(desc *TxDesc, into map[string]*TxDesc) {
+	into[hex.EncodeToString(desc.Tx.HashID)] = desc
+
+	for outIdx := range desc.Tx.Outputs {
+		if child, ok := mp.spent[OutpointKey(desc.Tx.HashID, outIdx)]; ok {
+			mp.collectDescendants(child, into)
+		}
+	}
+}
+
+func (mp *Mempool) Has(txID []byte) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	_, ok := mp.pool[hex.EncodeToString(txID)]
+	return ok
+}
+
+func (mp *Mempool) Get(txID []byte) (*Transaction, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	desc, ok := mp.pool[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+	return desc.Tx, true
+}
+
+func (mp *Mempool) Count() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return len(mp.pool)
+}
+
+// Size is the total size in bytes of the transactions in the pool.
+func (mp *Mempool) Size() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return mp.totalSize
+}
+
+// Descs returns the pool ordered by fee rate, highest first. A transaction
+// that spends another one from the pool always comes after it.
+func (mp *Mempool) Descs() []*TxDesc {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return mp.descs()
+}
+
+func (mp *Mempool) descs() []*TxDesc {
+	sorted := make([]*TxDesc, 0, len(mp.pool))
+	for _, desc := range mp.pool {
+		sorted = append(sorted, desc)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].paysLessThan(sorted[j]) != sorted[j].paysLessThan(sorted[i]) {
+			return sorted[j].paysLessThan(sorted[i])
+		}
+		return sorted[i].Added.Before(sorted[j].Added)
+	})
+
+	ordered := make([]*TxDesc, 0, len(sorted))
+	emitted := make(map[string]bool)
+	waiting := make(map[string][]*TxDesc)
+
+	var emit func(desc *TxDesc)
+	emit = func(desc *TxDesc) {
+		txID := hex.EncodeToString(desc.Tx.HashID)
+		ordered = append(ordered, desc)
+		emitted[txID] = true
+
+		children := waiting[txID]
+		delete(waiting, txID)
+		for _, child := range children {
+			if !emitted[hex.EncodeToString(child.Tx.HashID)] && mp.parentsEmitted(child, emitted) {
+				emit(child)
+			}
+		}
+	}
+
+	for _, desc := range sorted {
+		if emitted[hex.EncodeToString(desc.Tx.HashID)] {
+			continue
+		}
+
+		if mp.parentsEmitted(desc, emitted) {
+			emit(desc)
+			continue
+		}
+
+		for _, in := range desc.Tx.Inputs {
+			parentID := hex.EncodeToString(in.ID)
+			if _, inPool := mp.pool[parentID]; inPool && !emitted[parentID] {
+				waiting[parentID] = append(waiting[parentID], desc)
+			}
+		}
+	}
+
+	return ordered
+}
+
+func (mp *Mempool) parentsEmitted(desc *TxDesc, emitted map[string]bool) bool {
+	for _, in := range desc.Tx.Inputs {
+		parentID := hex.EncodeToString(in.ID)
+		if _, inPool := mp.pool[parentID]; inPool && !emitted[parentID] {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveForBlock drops the transactions a block confirms, and every pool
+// transaction that conflicts with them along with its descendants.
+func (mp *Mempool) RemoveForBlock(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		if desc, ok := mp.pool[hex.EncodeToString(tx.HashID)]; ok {
+			mp.remove(desc)
+		}
+
+		for _, in := range tx.Inputs {
+			if spender, ok := mp.spent[OutpointKey(in.ID, in.Out)]; ok {
+				mp.removeWithDescendants(spender)
+			}
+		}
+	}
+}
+
+// Revalidate checks every transaction in the pool against the current tip
+// again and drops those that are no longer valid, such as after a reorg.
+// Confirmed transactions fail the check too, as their inputs are spent.
+func (mp *Mempool) Revalidate() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	OpenDB(mp.chain)
+	defer mp.chain.CloseDB()
+
+	mp.expire()
+
+	height := mp.chain.GetBestHeight() + 1
+	pending := make(map[string]Transaction)
+
+	for _, desc := range mp.descs() {
+		txID := hex.EncodeToString(desc.Tx.HashID)
+		if _, ok := mp.pool[txID]; !ok {
+			continue
+		}
+
+		//
+		// descendants come later and are checked on their own: they
+		// stay valid when their parent failed only for being confirmed
+		//
+		if _, err := mp.chain.CheckTransactionInputs(desc.Tx, pending, height); err != nil {
+			mp.remove(desc)
+			continue
+		}
+
+		pending[txID] = *desc.Tx
+	}
+}
+
+// Expire drops the transactions that have been waiting longer than
+// MEMPOOL_EXPIRY, along with their descendants.
+func (mp *Mempool) Expire() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.expire()
+}
+
+func (mp *Mempool) expire() {
+	cutoff := time.Now().Add(-MEMPOOL_EXPIRY)
+
+	for _, desc := range mp.pool {
+		if desc.Added.Before(cutoff) {
+			mp.removeWithDescendants(desc)
+		}
+	}
+}
+
+// hasRoom reports whether desc would stay in the pool once conflicts are
+// evicted for it and trim has brought the pool back within its limits.
+func (mp *Mempool) hasRoom(desc *TxDesc, conflicts []*TxDesc) bool {
+
+	gone := make(map[string]*TxDesc)
+	for _, conflict := range conflicts {
+		mp.collectDescendants(conflict, gone)
+	}
+
+	count := len(mp.pool) + 1
+	size := mp.totalSize + desc.Size
+	for _, victim := range gone {
+		count--
+		size -= victim.Size
+	}
+
+	for count > MAX_MEMPOOL_TXS || size > MAX_MEMPOOL_SIZE {
+		worst := desc
+		for txID, other := range mp.pool {
+			if _, ok := gone[txID]; !ok && other.paysLessThan(worst) {
+				worst = other
+			}
+		}
+
+		if worst == desc {
+			return false
+		}
+
+		evicted := make(map[string]*TxDesc)
+		mp.collectDescendants(worst, evicted)
+
+		for txID, victim := range evicted {
+			if _, ok := gone[txID]; !ok {
+				gone[txID] = victim
+				count--
+				size -= victim.Size
+			}
+		}
+
+		for _, in := range desc.Tx.Inputs {
+			if _, ok := gone[hex.EncodeToString(in.ID)]; ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// trim evicts the transactions with the lowest fee rate, with their
+// descendants, until the pool is back within its limits.
+func (mp *Mempool) trim() {
+	for len(mp.pool) > MAX_MEMPOOL_TXS || mp.totalSize > MAX_MEMPOOL_SIZE {
+		var worst *TxDesc
+		for _, desc := range mp.pool {
+			if worst == nil || desc.paysLessThan(worst) {
+				worst = desc
+			}
+		}
+
+		mp.removeWithDescendants(worst)
+	}
+}
+
+func (mp *Mempool) add(desc *TxDesc) {
+	mp.pool[hex.EncodeToString(desc.Tx.HashID)] = desc
+	mp.totalSize += desc.Size
+
+	for _, in := range desc.Tx.Inputs {
+		mp.spent[OutpointKey(in.ID, in.Out)] = desc
+	}
+}
+
+func (mp *Mempool) remove(desc *TxDesc) {
+	txID := hex.EncodeToString(desc.Tx.HashID)
+	if _, ok := mp.pool[txID]; !ok {
+		return
+	}
+
+	delete(mp.pool, txID)
+	mp.totalSize -= desc.Size
+
+	for _, in := range desc.Tx.Inputs {
+		delete(mp.spent, OutpointKey(in.ID, in.Out))
+	}
+}
+
+// removeWithDescendants removes desc and every pool transaction that spends
+// its outputs, directly or further down.
+func (mp *Mempool) removeWithDescendants(desc *TxDesc) {
+	for outIdx := range desc.Tx.Outputs {
+		if child, ok := mp.spent[OutpointKey(desc.Tx.HashID, outIdx)]; ok {
+			mp.removeWithDescendants(child)
+		}
+	}
+
+	mp.remove(desc)
+}
+
+// -----------------------------------------------------------------------
+
+type mempoolRecord struct {
+	Tx    Transaction
+	Added time.Time
+}
+
+// Save writes the transactions in the pool to the file at path, replacing
+// it as a whole so a crash cannot leave a half-written pool behind.
+func (mp *Mempool) Save(path string) error {
+	mp.mu.RLock()
+	var records []mempoolRecord
+	for _, desc := range mp.descs() {
+		records = append(records, mempoolRecord{Tx: *desc.Tx, Added: desc.Added})
+	}
+	mp.mu.RUnlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(records); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Load reads the transactions saved at path back into the pool. Each one
+// goes through the acceptance rules again against the current tip and keeps
+// the time it first arrived, so those that were confirmed, conflicted or
+// expired in the meantime are dropped. It returns how many were accepted.
+func (mp *Mempool) Load(path string) (int, error) {
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var records []mempoolRecord
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&records); err != nil {
+		return 0, fmt.Errorf("reading mempool file %s: %w", path, err)
+	}
+
+	accepted := 0
+
+	//
+	// records were saved parents first; a transaction whose parent was
+	// rejected fails with a missing input and is dropped with it
+	//
+	for _, record := range records {
+		if time.Since(record.Added) > MEMPOOL_EXPIRY {
+			continue
+		}
+
+		tx := record.Tx
+		if _, err := mp.acceptTransaction(&tx, record.Added); err == nil {
+			accepted++
+		}
+	}
+
+	return accepted, nil
+}
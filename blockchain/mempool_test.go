@@ -0,0 +1,277 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+var fakeTxCount uint32
+
+// fakeDesc returns a pool entry for a transaction spending output 0 of each
+// parent, or a made-up output when there is none. Nothing in it is signed,
+// it is only meant for the pool's bookkeeping.
+func fakeDesc(fee, size int, parents ...*TxDesc) *TxDesc {
+	fakeTxCount++
+
+	tx := &Transaction{
+		HashID:  binary.BigEndian.AppendUint32(make([]byte, 28), fakeTxCount),
+		Outputs: []TxOutput{{Value: 1}},
+	}
+
+	for _, parent := range parents {
+		tx.Inputs = append(tx.Inputs, TxInput{ID: parent.Tx.HashID, Out: 0})
+	}
+	if len(parents) == 0 {
+		tx.Inputs = []TxInput{{ID: append([]byte{0xff}, tx.HashID[1:]...), Out: 0}}
+	}
+
+	return &TxDesc{Tx: tx, Fee: fee, Size: size, Added: time.Now()}
+}
+
+// quarterPool fills a pool to its size limit with four transactions paying
+// 1, 2, 3 and 4 coins per kilobyte.
+func quarterPool() (*Mempool, []*TxDesc) {
+	mp := NewMempool(nil)
+	size := MAX_MEMPOOL_SIZE / 4
+
+	var descs []*TxDesc
+	for rate := 1; rate <= 4; rate++ {
+		desc := fakeDesc(rate*size/1000, size)
+		mp.add(desc)
+		descs = append(descs, desc)
+	}
+
+	return mp, descs
+}
+
+func TestMempoolTrimEvictsLowestFeeRate(t *testing.T) {
+
+	mp, descs := quarterPool()
+	child := fakeDesc(100*1000, 1000, descs[0])
+	mp.add(child)
+
+	size := MAX_MEMPOOL_SIZE / 4
+	mp.add(fakeDesc(5*size/1000, size))
+	mp.trim()
+
+	//
+	// the cheapest transaction goes, along with its child that pays well
+	//
+	if mp.Has(descs[0].Tx.HashID) || mp.Has(child.Tx.HashID) {
+		t.Fatal("the lowest fee rate transaction and its descendants should be evicted")
+	}
+
+	for _, desc := range descs[1:] {
+		if !mp.Has(desc.Tx.HashID) {
+			t.Fatalf("transaction paying %d coins/kB was evicted", desc.FeeRate())
+		}
+	}
+
+	if mp.Size() > MAX_MEMPOOL_SIZE || mp.Count() != 4 {
+		t.Fatalf("pool holds %d transactions, %d bytes", mp.Count(), mp.Size())
+	}
+}
+
+func TestMempoolHasRoom(t *testing.T) {
+
+	size := MAX_MEMPOOL_SIZE / 4
+
+	tests := []struct {
+		name      string
+		desc      func(descs []*TxDesc) *TxDesc
+		conflicts func(descs []*TxDesc) []*TxDesc
+		room      bool
+	}{
+		{
+			name: "pays more than the cheapest",
+			desc: func(descs []*TxDesc) *TxDesc { return fakeDesc(2*size/1000, size) },
+			room: true,
+		},
+		{
+			name: "pays less than everything in the pool",
+			desc: func(descs []*TxDesc) *TxDesc { return fakeDesc(0, size) },
+		},
+		{
+			name: "spends the transaction that would be evicted for it",
+			desc: func(descs []*TxDesc) *TxDesc { return fakeDesc(5*size/1000, size, descs[0]) },
+		},
+		{
+			name:      "takes the place of its conflict",
+			desc:      func(descs []*TxDesc) *TxDesc { return fakeDesc(0, size) },
+			conflicts: func(descs []*TxDesc) []*TxDesc { return descs[:1] },
+			room:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp, descs := quarterPool()
+
+			var conflicts []*TxDesc
+			if test.conflicts != nil {
+				conflicts = test.conflicts(descs)
+			}
+
+			if room := mp.hasRoom(test.desc(descs), conflicts); room != test.room {
+				t.Fatalf("hasRoom = %v, want %v", room, test.room)
+			}
+
+			if mp.Count() != len(descs) {
+				t.Fatal("hasRoom changed the pool")
+			}
+		})
+	}
+}
+
+func TestMempoolExpire(t *testing.T) {
+
+	mp := NewMempool(nil)
+
+	old := fakeDesc(1000, 1000)
+	old.Added = time.Now().Add(-MEMPOOL_EXPIRY - time.Minute)
+	child := fakeDesc(1000, 1000, old)
+	fresh := fakeDesc(1000, 1000)
+
+	mp.add(old)
+	mp.add(child)
+	mp.add(fresh)
+
+	mp.Expire()
+
+	if mp.Has(old.Tx.HashID) || mp.Has(child.Tx.HashID) {
+		t.Fatal("the expired transaction and its descendants should be removed")
+	}
+	if !mp.Has(fresh.Tx.HashID) {
+		t.Fatal("a fresh transaction was removed")
+	}
+}
+
+func TestCheckReplacement(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		build  func(mp *Mempool, conflict *TxDesc) *TxDesc
+		valid  bool
+		reason RejectReason
+	}{
+		{
+			name: "higher fee rate and fee",
+			build: func(mp *Mempool, conflict *TxDesc) *TxDesc {
+				return fakeDesc(2000, 1000)
+			},
+			valid: true,
+		},
+		{
+			name: "same fee rate",
+			build: func(mp *Mempool, conflict *TxDesc) *TxDesc {
+				return fakeDesc(1000, 1000)
+			},
+			reason: RejectInsufficientFee,
+		},
+		{
+			name: "higher fee rate but less than the descendants pay",
+			build: func(mp *Mempool, conflict *TxDesc) *TxDesc {
+				mp.add(fakeDesc(5000, 1000, conflict))
+				return fakeDesc(2000, 1000)
+			},
+			reason: RejectInsufficientFee,
+		},
+		{
+			name: "spends a transaction it evicts",
+			build: func(mp *Mempool, conflict *TxDesc) *TxDesc {
+				child := fakeDesc(10, 1000, conflict)
+				mp.add(child)
+				return fakeDesc(5000, 1000, child)
+			},
+			reason: RejectDoubleSpend,
+		},
+		{
+			name: "evicts too many transactions",
+			build: func(mp *Mempool, conflict *TxDesc) *TxDesc {
+				parent := conflict
+				for i := 0; i < MAX_REPLACEMENT_EVICTIONS; i++ {
+					parent = fakeDesc(0, 1000, parent)
+					mp.add(parent)
+				}
+				return fakeDesc(100000, 1000)
+			},
+			reason: RejectTooManyReplacements,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := NewMempool(nil)
+
+			conflict := fakeDesc(1000, 1000)
+			mp.add(conflict)
+
+			err := mp.checkReplacement(test.build(mp, conflict), []*TxDesc{conflict})
+
+			if test.valid && err != nil {
+				t.Fatalf("expected the replacement to be allowed, got %v", err)
+			}
+			if !test.valid && !IsRejectReason(err, test.reason) {
+				t.Fatalf("expected %s, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+func TestMempoolReplaceByFee(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9106, alice)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+	mp := NewMempool(chain)
+
+	from, to := string(alice.Address()), string(bob.Address())
+
+	pay, err := NewTransactionWithFeeRate(from, to, 5, 2, true, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransactionWithFeeRate: %v", err)
+	}
+
+	if _, err := mp.MaybeAcceptTransaction(pay); err != nil {
+		t.Fatalf("accepting the payment: %v", err)
+	}
+
+	if _, err := BumpFee(pay, from, 2+INCREMENTAL_RELAY_FEE, &UTXO, w); err == nil {
+		t.Fatal("BumpFee should refuse a rate that does not exceed the old one by more than the increment")
+	}
+
+	bumped, err := BumpFee(pay, from, 10, &UTXO, w)
+	if err != nil {
+		t.Fatalf("BumpFee: %v", err)
+	}
+
+	if _, err := mp.MaybeAcceptTransaction(bumped); err != nil {
+		t.Fatalf("accepting the replacement: %v", err)
+	}
+
+	if mp.Has(pay.HashID) || !mp.Has(bumped.HashID) || mp.Count() != 1 {
+		t.Fatal("the replacement should take the place of the payment")
+	}
+
+	//
+	// a transaction that does not signal cannot be replaced
+	//
+	final, err := NewTransactionWithFeeRate(from, to, 5, 2, false, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransactionWithFeeRate: %v", err)
+	}
+	mp = NewMempool(chain)
+
+	if _, err := mp.MaybeAcceptTransaction(final); err != nil {
+		t.Fatalf("accepting the final payment: %v", err)
+	}
+
+	if _, err := mp.MaybeAcceptTransaction(bumped); !IsRejectReason(err, RejectDoubleSpend) {
+		t.Fatalf("expected %s, got %v", RejectDoubleSpend, err)
+	}
+}
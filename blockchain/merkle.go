@@ -1,6 +1,10 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
 
 // Used to obtain transaction hashes
 // Saved inside a block's header
@@ -47,10 +51,15 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for len(nodes) > 1 {
 
 		var level []MerkleNode
 
+		// An odd level pairs its last node with itself
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		for j := 0; j < len(nodes); j += 2 {
 			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
 			level = append(level, *node)
@@ -61,3 +70,76 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 
 	return &MerkleTree{&nodes[0]}
 }
+
+// MerkleProof shows that a leaf is part of a tree: the hashes of its
+// siblings from the bottom level up, and its index among the leaves, whose
+// bits tell on which side each sibling goes.
+type MerkleProof struct {
+	Index  int
+	Branch [][]byte
+}
+
+// NewMerkleProof returns the proof for leaf index of the tree NewMerkleTree
+// builds from data.
+func NewMerkleProof(data [][]byte, index int) (*MerkleProof, error) {
+
+	if index < 0 || index >= len(data) {
+		return nil, fmt.Errorf("leaf %d is out of range, the tree has %d", index, len(data))
+	}
+
+	var level [][]byte
+
+	for _, dat := range data {
+		level = append(level, NewMerkleNode(nil, nil, dat).Data)
+	}
+
+	proof := &MerkleProof{Index: index}
+
+	for pos := index; len(level) > 1; pos /= 2 {
+
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		proof.Branch = append(proof.Branch, level[pos^1])
+
+		var next [][]byte
+		for j := 0; j < len(level); j += 2 {
+			next = append(next, hashPair(level[j], level[j+1]))
+		}
+
+		level = next
+	}
+
+	//
+	// a single leaf is paired with itself, as in NewMerkleTree
+	//
+	if len(data) == 1 {
+		proof.Branch = append(proof.Branch, level[0])
+	}
+
+	return proof, nil
+}
+
+// Verify reports whether the proof leads from the leaf data to root.
+func (p *MerkleProof) Verify(data, root []byte) bool {
+
+	hash := NewMerkleNode(nil, nil, data).Data
+	pos := p.Index
+
+	for _, sibling := range p.Branch {
+		if pos%2 == 0 {
+			hash = hashPair(hash, sibling)
+		} else {
+			hash = hashPair(sibling, hash)
+		}
+		pos /= 2
+	}
+
+	return pos == 0 && bytes.Equal(hash, root)
+}
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
@@ -0,0 +1,190 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNonceSpaceExhausted = errors.New("nonce space exhausted without meeting the target")
+
+// DefaultMiner uses one worker per CPU and backs CreateBlock.
+var DefaultMiner = NewMiner(runtime.NumCPU())
+
+// Miner searches for proof of work with several goroutines, each scanning
+// its own slice of the 32 bit nonce space.
+type Miner struct {
+	Workers int
+
+	mu       sync.Mutex
+	hashRate float64
+}
+
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Miner{Workers: workers}
+}
+
+// HashRate returns the hashes per second achieved by the most recent search.
+func (m *Miner) HashRate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hashRate
+}
+
+func (m *Miner) recordHashRate(hashes uint64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elapsed > 0 {
+		m.hashRate = float64(hashes) / elapsed.Seconds()
+	}
+}
+
+// CreateBlock assembles a block on top of prevHash and mines it. The first
+// transaction is expected to be the coinbase, whose extranonce is rolled
+// whenever the nonce space runs out. Cancelling ctx stops the search and
+// returns ctx.Err().
+func (m *Miner) CreateBlock(ctx context.Context, txs []*Transaction, prevHash []byte, height int, bits uint32) (*Block, error) {
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   BLOCK_VERSION,
+			PrevHash:  prevHash,
+			Timestamp: time.Now().UnixNano(),
+			Bits:      bits,
+			Nonce:     0,
+			Height:    height,
+		},
+		Hash:         []byte{},
+		Transactions: txs,
+	}
+
+	var coinbase *Transaction
+	var coinbaseData []byte
+
+	if len(txs) > 0 && txs[0].IsCoinbase() {
+		coinbase = txs[0]
+		coinbaseData = append([]byte{}, coinbase.Inputs[0].Script...)
+	}
+
+	for extraNonce := uint64(0); ; extraNonce++ {
+
+		if extraNonce > 0 {
+			if coinbase == nil {
+				return nil, ErrNonceSpaceExhausted
+			}
+			coinbase.setExtraNonce(coinbaseData, extraNonce)
+		}
+
+		block.MerkleRoot = block.HashTransactions()
+
+		nonce, hash, err := m.Solve(ctx, &block.BlockHeader)
+		if errors.Is(err, ErrNonceSpaceExhausted) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		block.Nonce = nonce
+		block.Hash = hash
+
+		return block, nil
+	}
+}
+
+// Solve looks for a nonce that brings the header hash below its target. It
+// returns ErrNonceSpaceExhausted when every nonce has been tried, and
+// ctx.Err() when the search is cancelled first.
+func (m *Miner) Solve(ctx context.Context, header *BlockHeader) (uint32, []byte, error) {
+
+	type solution struct {
+		nonce uint32
+		hash  []byte
+	}
+
+	search, stop := context.WithCancel(ctx)
+	defer stop()
+
+	pow := NewHeaderProof(header)
+	found := make(chan solution, m.Workers)
+	span := (uint64(math.MaxUint32) + 1) / uint64(m.Workers)
+
+	var hashes atomic.Uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < m.Workers; i++ {
+
+		first := uint64(i) * span
+		last := first + span - 1
+		if i == m.Workers-1 {
+			last = math.MaxUint32
+		}
+
+		wg.Add(1)
+		go func(first, last uint64) {
+			defer wg.Done()
+
+			var intHash big.Int
+			var counted uint64
+
+			data := pow.InitData(uint32(first))
+
+			for nonce := first; nonce <= last; nonce++ {
+
+				if (nonce-first)&0x3ff == 0 {
+					hashes.Add(nonce - first - counted)
+					counted = nonce - first
+
+					select {
+					case <-search.Done():
+						return
+					default:
+					}
+				}
+
+				binary.BigEndian.PutUint32(data[HEADER_NONCE_OFFSET:], uint32(nonce))
+				hash := sha256.Sum256(data)
+
+				intHash.SetBytes(hash[:])
+
+				if intHash.Cmp(pow.Target) == -1 {
+					hashes.Add(nonce - first + 1 - counted)
+					found <- solution{uint32(nonce), hash[:]}
+					stop()
+					return
+				}
+			}
+
+			hashes.Add(last - first + 1 - counted)
+		}(first, last)
+	}
+
+	wg.Wait()
+	m.recordHashRate(hashes.Load(), time.Since(start))
+
+	select {
+	case s := <-found:
+		return s.nonce, s.hash, nil
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, ErrNonceSpaceExhausted
+}
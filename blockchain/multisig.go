@@ -0,0 +1,255 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/i101dev/blockchain-Tensor/util"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// NewMultiSigAddress returns the pay-to-script-hash address of an M-of-N
+// multisig script over pubKeys, and what a wallet needs to spend from it.
+func NewMultiSigAddress(m int, pubKeys [][]byte) (string, *wallet.MultiSig, error) {
+
+	for _, pubKey := range pubKeys {
+		if _, err := parsePubKey(pubKey); err != nil {
+			return "", nil, err
+		}
+	}
+
+	redeemScript, err := MultiSigScript(m, pubKeys)
+	if err != nil {
+		return "", nil, err
+	}
+
+	address := wallet.ScriptHashToAddr(wallet.Hash160(redeemScript))
+
+	return address, &wallet.MultiSig{M: m, PubKeys: pubKeys, RedeemScript: redeemScript}, nil
+}
+
+// PartialTx is a transaction spending from a multisig address that is still
+// collecting signatures. They are kept per input, keyed by the hex public
+// key that made them, and only go into the unlocking scripts once every
+// input has enough of them.
+type PartialTx struct {
+	Tx           Transaction
+	RedeemScript []byte
+	Signatures   []map[string][]byte
+}
+
+// NewMultiSigTransaction pays amount from the multisig address from to the
+// given address, with the change going back to from. The transaction is
+// returned unsigned, for the participants to sign in turn.
+func NewMultiSigTransaction(from, to string, amount, fee int, UTXO *UTXOSet, w *wallet.Wallet) (*PartialTx, error) {
+
+	multiSig, ok := w.MultiSigs[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a multisig address of this wallet", from)
+	}
+
+	lockingScript := PayToScriptHashScript(wallet.Hash160(multiSig.RedeemScript))
+
+	required := amount + fee
+	acc, validOutputs := UTXO.FindSpendableOutputs(lockingScript, required)
+	if acc < required {
+		return nil, fmt.Errorf("not enough funds: %s has %d, %d needed", from, acc, required)
+	}
+
+	var inputs []TxInput
+	for txHash, outs := range validOutputs {
+		txHashID, err := hex.DecodeString(txHash)
+		util.HandleError(err, "NewMultiSigTransaction")
+
+		for _, outIndex := range outs {
+			inputs = append(inputs, TxInput{Out: outIndex, ID: txHashID, Sequence: SEQUENCE_FINAL})
+		}
+	}
+
+	outputs := []TxOutput{*NewTXOutput(amount, to)}
+	if acc > required {
+		outputs = append(outputs, *NewTXOutput(acc-required, from))
+	}
+
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.HashID = tx.ID()
+
+	partial := &PartialTx{
+		Tx:           tx,
+		RedeemScript: multiSig.RedeemScript,
+		Signatures:   make([]map[string][]byte, len(inputs)),
+	}
+	for i := range partial.Signatures {
+		partial.Signatures[i] = make(map[string][]byte)
+	}
+
+	return partial, nil
+}
+
+// Required is how many signatures each input needs.
+func (p *PartialTx) Required() int {
+	m, _, _ := ExtractMultiSig(p.RedeemScript)
+	return m
+}
+
+// Collected is how many signatures the input with the fewest has.
+func (p *PartialTx) Collected() int {
+	collected := -1
+	for _, signatures := range p.Signatures {
+		if collected == -1 || len(signatures) < collected {
+			collected = len(signatures)
+		}
+	}
+	return max(collected, 0)
+}
+
+func (p *PartialTx) IsComplete() bool {
+	return p.Collected() >= p.Required()
+}
+
+// Sign adds privKey's signature to every input, committing to the parts of
+// the transaction hashType picks. The key has to be one of the
+// participants.
+func (p *PartialTx) Sign(privKey ecdsa.PrivateKey, hashType SigHashType) error {
+
+	pubKey := wallet.EncodePublicKey(&privKey.PublicKey)
+	if !p.isParticipant(pubKey) {
+		return fmt.Errorf("key %x is not a participant", pubKey)
+	}
+
+	for i := range p.Tx.Inputs {
+		signature, err := p.Tx.SignInput(i, privKey, p.RedeemScript, hashType)
+		if err != nil {
+			return err
+		}
+		p.Signatures[i][hex.EncodeToString(pubKey)] = signature
+	}
+
+	return nil
+}
+
+// Merge adds the signatures collected in other, a copy of the same
+// transaction that went to other participants. Every signature is checked
+// before it is taken.
+func (p *PartialTx) Merge(other *PartialTx) error {
+
+	if !bytes.Equal(p.Tx.HashID, other.Tx.HashID) || !bytes.Equal(p.RedeemScript, other.RedeemScript) {
+		return fmt.Errorf("transaction %x is not a copy of %x", other.Tx.HashID, p.Tx.HashID)
+	}
+
+	if len(other.Signatures) != len(p.Tx.Inputs) {
+		return fmt.Errorf("transaction %x has signatures for %d inputs, not %d", other.Tx.HashID, len(other.Signatures), len(p.Tx.Inputs))
+	}
+
+	for i, signatures := range other.Signatures {
+		for keyHex, signature := range signatures {
+			pubKey, err := hex.DecodeString(keyHex)
+			if err != nil || !p.isParticipant(pubKey) {
+				return fmt.Errorf("input %d is signed by %s, which is not a participant", i, keyHex)
+			}
+
+			if !checkTxSignature(&p.Tx, i, p.RedeemScript, pubKey, signature) {
+				return fmt.Errorf("input %d has an invalid signature by %s", i, keyHex)
+			}
+
+			p.Signatures[i][keyHex] = signature
+		}
+	}
+
+	return nil
+}
+
+func (p *PartialTx) isParticipant(pubKey []byte) bool {
+	_, pubKeys, _ := ExtractMultiSig(p.RedeemScript)
+	for _, participant := range pubKeys {
+		if bytes.Equal(participant, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finalize builds the unlocking scripts from the collected signatures,
+// taking the first Required of them in the order of the keys, and returns
+// the signed transaction.
+func (p *PartialTx) Finalize() (*Transaction, error) {
+
+	if !p.IsComplete() {
+		return nil, fmt.Errorf("transaction %x has %d of the %d signatures it needs", p.Tx.HashID, p.Collected(), p.Required())
+	}
+
+	m, pubKeys, _ := ExtractMultiSig(p.RedeemScript)
+
+	tx := p.Tx
+	tx.Inputs = append([]TxInput{}, p.Tx.Inputs...)
+
+	for i := range tx.Inputs {
+		var signatures [][]byte
+		for _, pubKey := range pubKeys {
+			if signature, ok := p.Signatures[i][hex.EncodeToString(pubKey)]; ok && len(signatures) < m {
+				signatures = append(signatures, signature)
+			}
+		}
+
+		tx.Inputs[i].Script = MultiSigUnlockingScript(signatures, p.RedeemScript)
+	}
+
+	return &tx, nil
+}
+
+func (p *PartialTx) Serialize() []byte {
+
+	var encoded bytes.Buffer
+
+	encoder := gob.NewEncoder(&encoded)
+
+	if err := encoder.Encode(p); err != nil {
+		util.HandleError(err, "Serialize PartialTx")
+	}
+
+	return encoded.Bytes()
+}
+
+func DeserializePartialTx(data []byte) (*PartialTx, error) {
+
+	var partial PartialTx
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+
+	if err := decoder.Decode(&partial); err != nil {
+		return nil, fmt.Errorf("failed to decode and deserialize bytes in to PartialTx")
+	}
+
+	if len(partial.Signatures) != len(partial.Tx.Inputs) {
+		return nil, fmt.Errorf("partial transaction has signatures for %d inputs, not %d", len(partial.Signatures), len(partial.Tx.Inputs))
+	}
+
+	for i := range partial.Signatures {
+		if partial.Signatures[i] == nil {
+			partial.Signatures[i] = make(map[string][]byte)
+		}
+	}
+
+	return &partial, nil
+}
+
+func (p *PartialTx) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID      string       `json:"txid"`
+		Required  int          `json:"required"`
+		Collected int          `json:"collected"`
+		Complete  bool         `json:"complete"`
+		Tx        *Transaction `json:"tx"`
+		Data      string       `json:"data"`
+	}{
+		TxID:      hex.EncodeToString(p.Tx.HashID),
+		Required:  p.Required(),
+		Collected: p.Collected(),
+		Complete:  p.IsComplete(),
+		Tx:        &p.Tx,
+		Data:      hex.EncodeToString(p.Serialize()),
+	})
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestPartialTx(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9114, alice)
+
+	keys := []*wallet.Account{wallet.MakeAccount(), wallet.MakeAccount(), wallet.MakeAccount()}
+	var pubKeys [][]byte
+	for _, key := range keys {
+		pubKeys = append(pubKeys, key.PublicKey)
+	}
+
+	address, multiSig, err := NewMultiSigAddress(2, pubKeys)
+	if err != nil {
+		t.Fatalf("NewMultiSigAddress: %v", err)
+	}
+
+	w := &wallet.Wallet{
+		Accounts:  map[string]*wallet.Account{string(alice.Address()): alice},
+		MultiSigs: map[string]*wallet.MultiSig{address: multiSig},
+	}
+	UTXO := UTXOSet{chain}
+
+	fund, err := NewTransaction(string(alice.Address()), address, 10, 1, false, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	funded := mineOn(t, chain, tipBlock(t, chain), alice, fund)
+
+	partial, err := NewMultiSigTransaction(address, string(bob.Address()), 4, 1, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewMultiSigTransaction: %v", err)
+	}
+
+	if err := partial.Sign(bob.PrivateKey, SIGHASH_ALL); err == nil {
+		t.Fatal("a key outside the multisig should not sign")
+	}
+
+	//
+	// two participants sign their own copies, which are merged
+	//
+	copied, err := DeserializePartialTx(partial.Serialize())
+	if err != nil {
+		t.Fatalf("DeserializePartialTx: %v", err)
+	}
+
+	if err := partial.Sign(keys[2].PrivateKey, SIGHASH_ALL); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := copied.Sign(keys[0].PrivateKey, SIGHASH_ALL); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	if _, err := partial.Finalize(); err == nil {
+		t.Fatal("Finalize should fail with one signature of two")
+	}
+
+	//
+	// keys[2]'s signature passed off as keys[0]'s
+	//
+	forged, _ := DeserializePartialTx(copied.Serialize())
+	forged.Signatures[0][hex.EncodeToString(keys[0].PublicKey)] = partial.Signatures[0][hex.EncodeToString(keys[2].PublicKey)]
+
+	if err := partial.Merge(forged); err == nil {
+		t.Fatal("Merge should refuse a signature that does not check")
+	}
+
+	if err := partial.Merge(copied); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	if !partial.IsComplete() || partial.Collected() != 2 || partial.Required() != 2 {
+		t.Fatalf("%d of %d signatures collected after merging", partial.Collected(), partial.Required())
+	}
+
+	tx, err := partial.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+
+	mineOn(t, chain, funded, alice, tx)
+}
@@ -0,0 +1,217 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// A document is notarized by putting its hash in the data output of a
+// transaction. Once the transaction is mined, the merkle branch from it to
+// the root in the block header proves the hash existed when the block was
+// made, without trusting the node that hands out the proof.
+
+// NewDataTransaction builds a transaction from the wallet address from that
+// carries data in an OP_RETURN output. Its inputs only have to cover the
+// fee, which has to be at least one coin so there is an input to sign.
+func NewDataTransaction(from string, data []byte, fee int, UTXO *UTXOSet, w *wallet.Wallet) (*Transaction, error) {
+
+	account, ok := w.Accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an address of this wallet", from)
+	}
+
+	if fee < 1 {
+		return nil, fmt.Errorf("fee of %d is too low, the transaction needs at least one input", fee)
+	}
+
+	dataScript, err := NullDataScript(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyHash := wallet.PublicKeyHash(account.PublicKey)
+
+	acc, validOutputs := UTXO.FindSpendableOutputs(PayToPubKeyHashScript(pubKeyHash), fee)
+	if acc < fee {
+		return nil, fmt.Errorf("not enough funds: %s has %d, %d needed", from, acc, fee)
+	}
+
+	var inputs []TxInput
+
+	for txHash, outs := range validOutputs {
+		txHashID, err := hex.DecodeString(txHash)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, outIndex := range outs {
+			inputs = append(inputs, TxInput{Out: outIndex, ID: txHashID, Sequence: SEQUENCE_FINAL})
+		}
+	}
+
+	outputs := []TxOutput{{Value: 0, Script: dataScript}}
+
+	if acc > fee {
+		outputs = append(outputs, *NewTXOutput(acc-fee, from))
+	}
+
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.HashID = tx.ID()
+	UTXO.Blockchain.SignTransaction(&tx, account.PrivateKey)
+
+	return &tx, nil
+}
+
+// InclusionProof shows that a transaction is in a block of the main chain.
+// Hashing Tx gives the leaf the merkle branch starts from, and the branch
+// ends at MerkleRoot, which the header commits to.
+type InclusionProof struct {
+	TxID          string   `json:"txid"`
+	Data          string   `json:"data,omitempty"`
+	BlockHash     string   `json:"block_hash"`
+	Height        int      `json:"height"`
+	Timestamp     int64    `json:"timestamp"`
+	Confirmations int      `json:"confirmations"`
+	MerkleRoot    string   `json:"merkle_root"`
+	Index         int      `json:"index"`
+	Branch        []string `json:"branch"`
+	Header        string   `json:"header"`
+	Tx            string   `json:"tx"`
+}
+
+// ProveTransaction returns the proof that transaction txID is in the main
+// chain.
+func (chain *Blockchain) ProveTransaction(txID []byte) (*InclusionProof, error) {
+
+	block, index, err := chain.findTransactionBlock(func(tx *Transaction) bool {
+		return bytes.Equal(tx.HashID, txID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction %x is not in the main chain", txID)
+	}
+
+	return chain.newInclusionProof(block, index)
+}
+
+// ProveData returns the proof for the earliest transaction in the main chain
+// with a data output carrying data.
+func (chain *Blockchain) ProveData(data []byte) (*InclusionProof, error) {
+
+	block, index, err := chain.findTransactionBlock(func(tx *Transaction) bool {
+		for _, out := range tx.Outputs {
+			if carried := ExtractNullData(out.Script); carried != nil && bytes.Equal(carried, data) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no transaction in the main chain carries %x", data)
+	}
+
+	return chain.newInclusionProof(block, index)
+}
+
+// findTransactionBlock walks the main chain from genesis and returns the
+// first block with a transaction that match accepts, and its index there.
+func (chain *Blockchain) findTransactionBlock(match func(tx *Transaction) bool) (*Block, int, error) {
+
+	hashes := chain.GetBlockHashes()
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := chain.GetBlock(hashes[i])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for index, tx := range block.Transactions {
+			if match(tx) {
+				return block, index, nil
+			}
+		}
+	}
+
+	return nil, 0, fmt.Errorf("no matching transaction")
+}
+
+func (chain *Blockchain) newInclusionProof(block *Block, index int) (*InclusionProof, error) {
+
+	merkleProof, err := block.TransactionProof(index)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := block.Transactions[index]
+
+	proof := &InclusionProof{
+		TxID:          hex.EncodeToString(tx.HashID),
+		BlockHash:     hex.EncodeToString(block.Hash),
+		Height:        block.Height,
+		Timestamp:     block.Timestamp,
+		Confirmations: chain.GetBestHeight() - block.Height + 1,
+		MerkleRoot:    hex.EncodeToString(block.MerkleRoot),
+		Index:         merkleProof.Index,
+		Header:        hex.EncodeToString(block.BlockHeader.Bytes()),
+		Tx:            hex.EncodeToString(tx.Serialize()),
+	}
+
+	for _, hash := range merkleProof.Branch {
+		proof.Branch = append(proof.Branch, hex.EncodeToString(hash))
+	}
+
+	for _, out := range tx.Outputs {
+		if data := ExtractNullData(out.Script); data != nil {
+			proof.Data = hex.EncodeToString(data)
+			break
+		}
+	}
+
+	return proof, nil
+}
+
+// Verify checks that the proof's merkle branch leads from its transaction to
+// its merkle root, and that its header commits to that root and hashes to
+// its block hash.
+func (p *InclusionProof) Verify() bool {
+
+	tx, err := hex.DecodeString(p.Tx)
+	if err != nil {
+		return false
+	}
+	root, err := hex.DecodeString(p.MerkleRoot)
+	if err != nil {
+		return false
+	}
+	header, err := hex.DecodeString(p.Header)
+	if err != nil {
+		return false
+	}
+	blockHash, err := hex.DecodeString(p.BlockHash)
+	if err != nil {
+		return false
+	}
+
+	merkleProof := MerkleProof{Index: p.Index}
+	for _, h := range p.Branch {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return false
+		}
+		merkleProof.Branch = append(merkleProof.Branch, hash)
+	}
+
+	//
+	// the merkle root sits after the version and the previous hash
+	//
+	if len(header) < 68 || !bytes.Equal(header[36:68], root) {
+		return false
+	}
+
+	headerHash := sha256.Sum256(header)
+
+	return merkleProof.Verify(tx, root) && bytes.Equal(headerHash[:], blockHash)
+}
@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// flipHex returns the hex string s with every bit of its last byte flipped.
+func flipHex(s string) string {
+	data, _ := hex.DecodeString(s)
+	data[len(data)-1] ^= 0xff
+	return hex.EncodeToString(data)
+}
+
+func TestInclusionProof(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9118, alice)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	genesis := tipBlock(t, chain)
+	first := mineOn(t, chain, genesis, alice)
+	second := mineOn(t, chain, first, alice)
+
+	document := sha256.Sum256([]byte("the document"))
+
+	if _, err := NewDataTransaction(string(alice.Address()), document[:], 0, &UTXO, w); err == nil {
+		t.Fatal("NewDataTransaction should refuse a fee of zero")
+	}
+
+	notarized, err := NewDataTransaction(string(alice.Address()), document[:], 1, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewDataTransaction: %v", err)
+	}
+
+	//
+	// the coinbases the notarized transaction leaves alone fill the block
+	// to four transactions, so no leaf of the merkle tree is doubled
+	//
+	var txs []*Transaction
+	for _, block := range []*Block{genesis, first, second} {
+		if tx := block.Transactions[0]; !spendsAny(notarized, tx) {
+			txs = append(txs, spendOutput(tx, 0, 1, alice, alice))
+		}
+	}
+	if len(txs) != 2 {
+		t.Fatalf("the notarized transaction spends %d coinbases, want one", 3-len(txs))
+	}
+	txs = append(txs, notarized)
+
+	block := mineOn(t, chain, second, alice, txs...)
+
+	proof, err := chain.ProveData(document[:])
+	if err != nil {
+		t.Fatalf("ProveData: %v", err)
+	}
+
+	if !proof.Verify() {
+		t.Fatal("the proof does not verify")
+	}
+	if proof.TxID != hex.EncodeToString(notarized.HashID) || proof.Data != hex.EncodeToString(document[:]) {
+		t.Fatalf("proof is for %s carrying %s", proof.TxID, proof.Data)
+	}
+	if proof.BlockHash != hex.EncodeToString(block.Hash) || proof.Confirmations != 1 || len(proof.Branch) != 2 {
+		t.Fatalf("proof in block %s with %d confirmations and a branch of %d", proof.BlockHash, proof.Confirmations, len(proof.Branch))
+	}
+
+	byID, err := chain.ProveTransaction(notarized.HashID)
+	if err != nil || byID.Index != proof.Index {
+		t.Fatalf("ProveTransaction: %v", err)
+	}
+
+	if _, err := chain.ProveData([]byte("never notarized")); err == nil {
+		t.Fatal("ProveData should fail for data that is not in the chain")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(p *InclusionProof)
+	}{
+		{"transaction", func(p *InclusionProof) { p.Tx = flipHex(p.Tx) }},
+		{"branch", func(p *InclusionProof) { p.Branch[0] = flipHex(p.Branch[0]) }},
+		{"index", func(p *InclusionProof) { p.Index ^= 1 }},
+		{"merkle root", func(p *InclusionProof) { p.MerkleRoot = flipHex(p.MerkleRoot) }},
+		{"header", func(p *InclusionProof) { p.Header = flipHex(p.Header) }},
+		{"block hash", func(p *InclusionProof) { p.BlockHash = flipHex(p.BlockHash) }},
+	}
+
+	for _, test := range tests {
+		tampered := *proof
+		tampered.Branch = append([]string{}, proof.Branch...)
+		test.tamper(&tampered)
+
+		if tampered.Verify() {
+			t.Errorf("a proof with a tampered %s verifies", test.name)
+		}
+	}
+}
+
+// spendsAny reports whether tx spends an output of prev.
+func spendsAny(tx, prev *Transaction) bool {
+	for _, in := range tx.Inputs {
+		if string(in.ID) == string(prev.HashID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_ORPHAN_BLOCKS = 100
+	ORPHAN_EXPIRY     = time.Hour
+)
+
+type orphanBlock struct {
+	block      *Block
+	expiration time.Time
+}
+
+// OrphanPool holds blocks whose parent has not arrived yet. It is bounded in
+// size and age; when full, the oldest orphan makes room for the new one.
+type OrphanPool struct {
+	mu       sync.Mutex
+	orphans  map[string]*orphanBlock
+	byParent map[string][]*orphanBlock
+	oldest   []string
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans:  make(map[string]*orphanBlock),
+		byParent: make(map[string][]*orphanBlock),
+	}
+}
+
+func (pool *OrphanPool) Add(block *Block) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := pool.orphans[hash]; ok {
+		return
+	}
+
+	pool.expire()
+
+	for len(pool.orphans) >= MAX_ORPHAN_BLOCKS && len(pool.oldest) > 0 {
+		pool.remove(pool.oldest[0])
+	}
+
+	orphan := &orphanBlock{
+		block:      block,
+		expiration: time.Now().Add(ORPHAN_EXPIRY),
+	}
+
+	parent := hex.EncodeToString(block.PrevHash)
+
+	pool.orphans[hash] = orphan
+	pool.byParent[parent] = append(pool.byParent[parent], orphan)
+	pool.oldest = append(pool.oldest, hash)
+}
+
+func (pool *OrphanPool) Has(hash []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.orphans[hex.EncodeToString(hash)]
+	return ok
+}
+
+func (pool *OrphanPool) Count() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.orphans)
+}
+
+// OrphanRoot follows the orphans' parents as far as the pool goes and returns
+// the hash of the first block that is missing.
+func (pool *OrphanPool) OrphanRoot(hash []byte) []byte {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	root := hash
+	for {
+		orphan, ok := pool.orphans[hex.EncodeToString(root)]
+		if !ok {
+			return root
+		}
+		root = orphan.block.PrevHash
+	}
+}
+
+// RemoveChildren takes every orphan that builds directly on the given block
+// out of the pool, in the order they arrived.
+func (pool *OrphanPool) RemoveChildren(parentHash []byte) []*Block {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var children []*Block
+
+	for _, orphan := range pool.byParent[hex.EncodeToString(parentHash)] {
+		children = append(children, orphan.block)
+	}
+
+	for _, child := range children {
+		pool.remove(hex.EncodeToString(child.Hash))
+	}
+
+	return children
+}
+
+func (pool *OrphanPool) expire() {
+	now := time.Now()
+
+	for hash, orphan := range pool.orphans {
+		if now.After(orphan.expiration) {
+			pool.remove(hash)
+		}
+	}
+}
+
+func (pool *OrphanPool) remove(hash string) {
+
+	orphan, ok := pool.orphans[hash]
+	if !ok {
+		return
+	}
+
+	delete(pool.orphans, hash)
+
+	parent := hex.EncodeToString(orphan.block.PrevHash)
+	siblings := pool.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(pool.byParent, parent)
+	} else {
+		pool.byParent[parent] = siblings
+	}
+
+	for i, h := range pool.oldest {
+		if h == hash {
+			pool.oldest = append(pool.oldest[:i], pool.oldest[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package blockchain
+
+import (
+	"math/big"
+	"time"
+)
+
+// ChainParams holds the consensus rules every node on a network must agree on.
+type ChainParams struct {
+	// PowLimit is the easiest target a block may use. The genesis block and
+	// the first difficulty window are mined against it.
+	PowLimit     *big.Int
+	PowLimitBits uint32
+
+	// RetargetInterval is the number of blocks between difficulty
+	// adjustments, TargetBlockTime the interval the adjustment aims for.
+	RetargetInterval int
+	TargetBlockTime  time.Duration
+
+	// InitialSubsidy is the coinbase reward of the first era. It halves every
+	// HalvingInterval blocks and no more than MaxSupply coins are ever issued.
+	InitialSubsidy  int
+	HalvingInterval int
+	MaxSupply       int
+
+	// CoinbaseMaturity is how many blocks must be built on top of a coinbase
+	// before its outputs can be spent.
+	CoinbaseMaturity int
+}
+
+var devNetPowLimit = new(big.Int).Lsh(big.NewInt(1), 256-12)
+
+var DevNetParams = ChainParams{
+	PowLimit:         devNetPowLimit,
+	PowLimitBits:     TargetToCompact(devNetPowLimit),
+	RetargetInterval: 10,
+	TargetBlockTime:  10 * time.Second,
+	InitialSubsidy:   20,
+	HalvingInterval:  1000,
+	MaxSupply:        38000,
+	CoinbaseMaturity: 100,
+}
+
+// Params are the consensus rules used by this node. Override them before the
+// chain is loaded to run a network with different settings.
+var Params = DevNetParams
@@ -5,14 +5,11 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"math/big"
 )
 
-const Difficulty = 12
-
 type ProofOfWork struct {
-	Block  *Block
+	Header *BlockHeader
 	Target *big.Int
 }
 
@@ -28,79 +25,44 @@ func ToHex(num int64) ([]byte, error) {
 }
 
 func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	pow := &ProofOfWork{b, target}
-	return pow
+	return NewHeaderProof(&b.BlockHeader)
 }
 
-func (pow *ProofOfWork) InitData(nonce int) ([]byte, error) {
-
-	non, err := ToHex(int64(nonce))
-	if err != nil {
-		return nil, fmt.Errorf("failed to write [nonce] ToHex")
-	}
+func NewHeaderProof(h *BlockHeader) *ProofOfWork {
+	target := CompactToTarget(h.Bits)
+	pow := &ProofOfWork{h, target}
+	return pow
+}
 
-	diff, err := ToHex(int64(Difficulty))
-	if err != nil {
-		return nil, fmt.Errorf("failed to write [difficulty] ToHex")
-	}
+// Work returns the expected number of hashes needed to find a block that
+// satisfies the target, computed as 2^256 / (target + 1).
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, denominator)
+}
 
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			non,
-			diff,
-			// ToHex(int64(nonce)),
-			// ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-
-	return data, nil
+// InitData returns the serialized header with the given nonce in place.
+func (pow *ProofOfWork) InitData(nonce uint32) []byte {
+	header := *pow.Header
+	header.Nonce = nonce
+	return header.Bytes()
 }
 
+// Validate checks the header hash against the target encoded in the header's
+// bits. Whether those bits are the ones the chain expected at this height is
+// checked by the caller with Blockchain.CalcNextBits.
 func (pow *ProofOfWork) Validate() (bool, error) {
 
 	var intHash big.Int
 
-	data, err := pow.InitData(pow.Block.Nonce)
-	if err != nil {
-		return false, err
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(Params.PowLimit) > 0 {
+		return false, fmt.Errorf("target %064x is outside the allowed range", pow.Target)
 	}
 
-	hash := sha256.Sum256(data)
+	hash := sha256.Sum256(pow.InitData(pow.Header.Nonce))
 
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1, nil
 }
-
-func (pow *ProofOfWork) Run() (int, []byte, error) {
-
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-
-	for nonce < math.MaxInt64 {
-
-		data, err := pow.InitData(nonce)
-		if err != nil {
-			return -1, nil, err
-		}
-
-		hash = sha256.Sum256(data)
-
-		intHash.SetBytes(hash[:])
-
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
-	}
-
-	return nonce, hash[:], nil
-}
@@ -0,0 +1,600 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// Outputs are locked by a script and inputs unlock them with one of their
+// own. An input is valid when running its unlocking script and then the
+// locking script of the output it spends leaves a single true value on the
+// stack. Opcode values follow Bitcoin's, though only the subset below is
+// defined; any other opcode fails the script.
+const (
+	OP_0         = 0x00
+	OP_FALSE     = OP_0
+	OP_DATA_1    = 0x01
+	OP_DATA_20   = 0x14
+	OP_DATA_75   = 0x4b
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE   = 0x4f
+	OP_RESERVED  = 0x50
+	OP_1         = 0x51
+	OP_TRUE      = OP_1
+	OP_16        = 0x60
+
+	OP_NOP    = 0x61
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_OVER = 0x78
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+
+	OP_1ADD        = 0x8b
+	OP_1SUB        = 0x8c
+	OP_NOT         = 0x91
+	OP_ADD         = 0x93
+	OP_SUB         = 0x94
+	OP_BOOLAND     = 0x9a
+	OP_BOOLOR      = 0x9b
+	OP_NUMEQUAL    = 0x9c
+	OP_LESSTHAN    = 0x9f
+	OP_GREATERTHAN = 0xa0
+
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+)
+
+const (
+	// MAX_SCRIPT_SIZE is the largest script, locking or unlocking, in bytes.
+	MAX_SCRIPT_SIZE = 10000
+	// MAX_SCRIPT_ELEMENT_SIZE is the largest value that may be pushed.
+	MAX_SCRIPT_ELEMENT_SIZE = 520
+	// MAX_OPS_PER_SCRIPT limits how many opcodes other than pushes a
+	// script may run.
+	MAX_OPS_PER_SCRIPT = 201
+	// MAX_STACK_SIZE limits how many values the stack may hold.
+	MAX_STACK_SIZE = 1000
+	// MAX_PUBKEYS_PER_MULTISIG is the largest N of an M-of-N multisig. Each
+	// key counts towards MAX_OPS_PER_SCRIPT.
+	MAX_PUBKEYS_PER_MULTISIG = 15
+	// MAX_DATA_CARRIER_SIZE is the most bytes a standard data output may
+	// carry.
+	MAX_DATA_CARRIER_SIZE = 80
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:              "OP_0",
+	OP_RESERVED:       "OP_RESERVED",
+	OP_PUSHDATA1:      "OP_PUSHDATA1",
+	OP_PUSHDATA2:      "OP_PUSHDATA2",
+	OP_1NEGATE:        "OP_1NEGATE",
+	OP_NOP:            "OP_NOP",
+	OP_IF:             "OP_IF",
+	OP_NOTIF:          "OP_NOTIF",
+	OP_ELSE:           "OP_ELSE",
+	OP_ENDIF:          "OP_ENDIF",
+	OP_VERIFY:         "OP_VERIFY",
+	OP_RETURN:         "OP_RETURN",
+	OP_DROP:           "OP_DROP",
+	OP_DUP:            "OP_DUP",
+	OP_OVER:           "OP_OVER",
+	OP_SWAP:           "OP_SWAP",
+	OP_SIZE:           "OP_SIZE",
+	OP_EQUAL:          "OP_EQUAL",
+	OP_EQUALVERIFY:    "OP_EQUALVERIFY",
+	OP_1ADD:           "OP_1ADD",
+	OP_1SUB:           "OP_1SUB",
+	OP_NOT:            "OP_NOT",
+	OP_ADD:            "OP_ADD",
+	OP_SUB:            "OP_SUB",
+	OP_BOOLAND:        "OP_BOOLAND",
+	OP_BOOLOR:         "OP_BOOLOR",
+	OP_NUMEQUAL:       "OP_NUMEQUAL",
+	OP_LESSTHAN:       "OP_LESSTHAN",
+	OP_GREATERTHAN:    "OP_GREATERTHAN",
+	OP_SHA256:         "OP_SHA256",
+	OP_HASH160:        "OP_HASH160",
+	OP_CHECKSIG:       "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+func opcodeName(op byte) string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	if op >= OP_1 && op <= OP_16 {
+		return fmt.Sprintf("OP_%d", op-OP_1+1)
+	}
+	return fmt.Sprintf("OP_UNKNOWN%d", op)
+}
+
+// ---------------------------------------------------------------------
+
+// scriptOp is one parsed instruction: an opcode, and for pushes the data
+// it pushes.
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.opcode <= OP_16 && op.opcode != OP_RESERVED
+}
+
+var errTruncatedScript = errors.New("script ends in the middle of a push")
+
+func parseScript(script []byte) ([]scriptOp, error) {
+
+	var ops []scriptOp
+
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		var size int
+
+		switch {
+		case op >= OP_DATA_1 && op <= OP_DATA_75:
+			size = int(op)
+
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errTruncatedScript
+			}
+			size = int(script[i])
+			i++
+
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errTruncatedScript
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+
+		default:
+			ops = append(ops, scriptOp{opcode: op})
+			continue
+		}
+
+		if i+size > len(script) {
+			return nil, errTruncatedScript
+		}
+
+		ops = append(ops, scriptOp{opcode: op, data: script[i : i+size]})
+		i += size
+	}
+
+	return ops, nil
+}
+
+// IsPushOnly reports whether the script does nothing but push data.
+func IsPushOnly(script []byte) bool {
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+// DisassembleScript renders a script as its opcodes and pushed data in hex.
+func DisassembleScript(script []byte) string {
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return "[error: " + err.Error() + "]"
+	}
+
+	parts := make([]string, len(ops))
+	for i, op := range ops {
+		if op.opcode >= OP_DATA_1 && op.opcode <= OP_PUSHDATA2 {
+			parts[i] = hex.EncodeToString(op.data)
+		} else {
+			parts[i] = opcodeName(op.opcode)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ---------------------------------------------------------------------
+
+// ScriptBuilder assembles a script, using the smallest push for each value.
+type ScriptBuilder struct {
+	script []byte
+	err    error
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+
+	size := len(data)
+
+	switch {
+	case size == 0:
+		b.script = append(b.script, OP_0)
+		return b
+	case size <= OP_DATA_75:
+		b.script = append(b.script, byte(size))
+	case size <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(size))
+	case size <= MAX_SCRIPT_ELEMENT_SIZE:
+		b.script = append(b.script, OP_PUSHDATA2, byte(size), byte(size>>8))
+	default:
+		b.err = fmt.Errorf("cannot push %d bytes, the limit is %d", size, MAX_SCRIPT_ELEMENT_SIZE)
+		return b
+	}
+
+	b.script = append(b.script, data...)
+	return b
+}
+
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 + n - 1))
+	default:
+		return b.AddData(scriptNum(n).Bytes())
+	}
+}
+
+func (b *ScriptBuilder) Script() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.script) > MAX_SCRIPT_SIZE {
+		return nil, fmt.Errorf("script is %d bytes, the limit is %d", len(b.script), MAX_SCRIPT_SIZE)
+	}
+	return b.script, nil
+}
+
+// ---------------------------------------------------------------------
+//
+// Standard templates
+//
+
+// PayToPubKeyHashScript locks an output to the key whose Hash160 is
+// pubKeyHash: OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG. It is
+// unlocked with <signature> <pubkey>.
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	script, _ := NewScriptBuilder().
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+	return script
+}
+
+// PayToScriptHashScript locks an output to the script whose Hash160 is
+// scriptHash: OP_HASH160 <hash> OP_EQUAL. It is unlocked with the inputs
+// that script needs followed by the script itself, the redeem script.
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	script, _ := NewScriptBuilder().
+		AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).
+		Script()
+	return script
+}
+
+// PayToAddrScript returns the locking script that pays to address.
+func PayToAddrScript(address string) ([]byte, error) {
+
+	hash, isScript, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if isScript {
+		return PayToScriptHashScript(hash), nil
+	}
+	return PayToPubKeyHashScript(hash), nil
+}
+
+func isPayToPubKeyHash(script []byte) bool {
+	return len(script) == 25 &&
+		script[0] == OP_DUP &&
+		script[1] == OP_HASH160 &&
+		script[2] == OP_DATA_20 &&
+		script[23] == OP_EQUALVERIFY &&
+		script[24] == OP_CHECKSIG
+}
+
+// IsPayToScriptHash reports whether script has the exact form of
+// PayToScriptHashScript, which is what makes the interpreter go on to run
+// the redeem script.
+func IsPayToScriptHash(script []byte) bool {
+	return len(script) == 23 &&
+		script[0] == OP_HASH160 &&
+		script[1] == OP_DATA_20 &&
+		script[22] == OP_EQUAL
+}
+
+// ExtractPubKeyHash returns the key hash a pay-to-pubkey-hash script locks
+// to, or nil for any other script.
+func ExtractPubKeyHash(script []byte) []byte {
+	if !isPayToPubKeyHash(script) {
+		return nil
+	}
+	return script[3:23]
+}
+
+// ScriptAddress returns the address a standard locking script pays to, or
+// "" when it is not one of the standard templates.
+func ScriptAddress(script []byte) string {
+	switch {
+	case isPayToPubKeyHash(script):
+		return wallet.PubKeyHashToAddr(script[3:23])
+	case IsPayToScriptHash(script):
+		return wallet.ScriptHashToAddr(script[2:22])
+	default:
+		return ""
+	}
+}
+
+// IsStandardScript reports whether a locking script follows one of the
+// standard templates. Nonstandard outputs are valid in blocks but are not
+// relayed.
+func IsStandardScript(script []byte) bool {
+	return isPayToPubKeyHash(script) || IsPayToScriptHash(script) || isNullData(script)
+}
+
+// NullDataScript carries data in an output that can never be spent:
+// OP_RETURN <data>.
+func NullDataScript(data []byte) ([]byte, error) {
+	if len(data) > MAX_DATA_CARRIER_SIZE {
+		return nil, fmt.Errorf("data is %d bytes, the limit is %d", len(data), MAX_DATA_CARRIER_SIZE)
+	}
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+func isNullData(script []byte) bool {
+	return ExtractNullData(script) != nil
+}
+
+// ExtractNullData returns the data a script built by NullDataScript
+// carries, or nil for any other script. A bare OP_RETURN carries no data.
+func ExtractNullData(script []byte) []byte {
+
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil
+	}
+
+	ops, err := parseScript(script[1:])
+	if err != nil || len(ops) > 1 {
+		return nil
+	}
+
+	if len(ops) == 0 || ops[0].data == nil && ops[0].opcode == OP_0 {
+		return []byte{}
+	}
+	if ops[0].opcode > OP_PUSHDATA2 || len(ops[0].data) > MAX_DATA_CARRIER_SIZE {
+		return nil
+	}
+	return ops[0].data
+}
+
+// IsUnspendable reports whether no unlocking script can satisfy script,
+// which holds for any script starting with OP_RETURN. Such outputs are
+// never added to the UTXO set.
+func IsUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == OP_RETURN) || len(script) > MAX_SCRIPT_SIZE
+}
+
+// MultiSigScript requires signatures from m of pubKeys: OP_m <pubkey>...
+// OP_n OP_CHECKMULTISIG. It is meant to be used as a redeem script, so it
+// has to fit in a single push. It is unlocked with the signatures in the
+// same order as their keys.
+func MultiSigScript(m int, pubKeys [][]byte) ([]byte, error) {
+
+	n := len(pubKeys)
+	if n > MAX_PUBKEYS_PER_MULTISIG {
+		return nil, fmt.Errorf("%d keys given, at most %d are allowed", n, MAX_PUBKEYS_PER_MULTISIG)
+	}
+	if m < 1 || m > n {
+		return nil, fmt.Errorf("cannot require %d of %d keys", m, n)
+	}
+
+	b := NewScriptBuilder().AddInt64(int64(m))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+
+	script, err := b.AddInt64(int64(n)).AddOp(OP_CHECKMULTISIG).Script()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(script) > MAX_SCRIPT_ELEMENT_SIZE {
+		return nil, fmt.Errorf("multisig script is %d bytes, too large to push as a redeem script", len(script))
+	}
+
+	return script, nil
+}
+
+// ExtractMultiSig returns the threshold and keys of a script built by
+// MultiSigScript.
+func ExtractMultiSig(script []byte) (int, [][]byte, bool) {
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	isSmallInt := func(op byte) bool { return op >= OP_1 && op <= OP_16 }
+
+	first, last := ops[0].opcode, ops[len(ops)-2].opcode
+	if !isSmallInt(first) || !isSmallInt(last) {
+		return 0, nil, false
+	}
+
+	m := int(first - OP_1 + 1)
+	n := int(last - OP_1 + 1)
+
+	keys := ops[1 : len(ops)-2]
+	if len(keys) != n || m > n {
+		return 0, nil, false
+	}
+
+	pubKeys := make([][]byte, n)
+	for i, op := range keys {
+		if op.opcode < OP_DATA_1 || op.opcode > OP_PUSHDATA2 {
+			return 0, nil, false
+		}
+		pubKeys[i] = op.data
+	}
+
+	return m, pubKeys, true
+}
+
+// MultiSigUnlockingScript spends a pay-to-script-hash output whose redeem
+// script is a multisig script. signatures have to be in the order of the
+// keys that made them.
+func MultiSigUnlockingScript(signatures [][]byte, redeemScript []byte) []byte {
+	b := NewScriptBuilder()
+	for _, signature := range signatures {
+		b.AddData(signature)
+	}
+	script, _ := b.AddData(redeemScript).Script()
+	return script
+}
+
+// P2PKHUnlockingScript spends a pay-to-pubkey-hash output.
+func P2PKHUnlockingScript(signature, pubKey []byte) []byte {
+	script, _ := NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+	return script
+}
+
+// HTLC is a hash time-locked contract. Until LockTime it pays to the key
+// whose hash is RecipientHash, given the secret whose SHA-256 is
+// SecretHash; from then on the key whose hash is RefundHash may also take
+// it back.
+type HTLC struct {
+	SecretHash    []byte
+	RecipientHash []byte
+	RefundHash    []byte
+	LockTime      uint32
+}
+
+// Script returns the contract as a redeem script:
+//
+//	OP_IF
+//	    OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <secret hash> OP_EQUALVERIFY
+//	    OP_DUP OP_HASH160 <recipient hash>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP
+//	    OP_DUP OP_HASH160 <refund hash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+//
+// The secret has to be 32 bytes, so that a contract on another chain with
+// a different limit on pushes cannot be redeemed with a secret this one
+// refuses.
+func (c *HTLC) Script() ([]byte, error) {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt64(SECRET_SIZE).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(c.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.RecipientHash).
+		AddOp(OP_ELSE).
+		AddInt64(int64(c.LockTime)).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.RefundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// ExtractHTLC returns the contract a script built by HTLC.Script carries.
+func ExtractHTLC(script []byte) (*HTLC, bool) {
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return nil, false
+	}
+
+	lockTime, err := makeScriptNum(ops[11].data, 5)
+	if ops[11].opcode >= OP_1 && ops[11].opcode <= OP_16 {
+		lockTime, err = scriptNum(ops[11].opcode-OP_1+1), nil
+	}
+	if err != nil || lockTime < 0 || lockTime > SEQUENCE_FINAL {
+		return nil, false
+	}
+
+	c := &HTLC{
+		SecretHash:    ops[5].data,
+		RecipientHash: ops[9].data,
+		RefundHash:    ops[16].data,
+		LockTime:      uint32(lockTime),
+	}
+
+	//
+	// anything that does not come out the same when built again is not a
+	// contract
+	//
+	if rebuilt, err := c.Script(); err != nil || !bytes.Equal(rebuilt, script) {
+		return nil, false
+	}
+
+	return c, true
+}
+
+// HTLCRedeemScript spends a contract output with the secret, signed by the
+// recipient's key.
+func HTLCRedeemScript(signature, pubKey, secret, contract []byte) []byte {
+	script, _ := NewScriptBuilder().
+		AddData(signature).AddData(pubKey).AddData(secret).AddOp(OP_TRUE).AddData(contract).
+		Script()
+	return script
+}
+
+// HTLCRefundScript spends a contract output after its lock time, signed by
+// the refund key.
+func HTLCRefundScript(signature, pubKey, contract []byte) []byte {
+	script, _ := NewScriptBuilder().
+		AddData(signature).AddData(pubKey).AddOp(OP_FALSE).AddData(contract).
+		Script()
+	return script
+}
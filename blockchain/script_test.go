@@ -0,0 +1,195 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// spendingTx returns a transaction whose only input spends output 0 of a
+// made-up transaction, and pays to an unrelated key.
+func spendingTx() *Transaction {
+	prevID := bytes.Repeat([]byte{0x11}, 32)
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: prevID, Out: 0, Sequence: SEQUENCE_FINAL}},
+		Outputs: []TxOutput{{Value: 5, Script: PayToPubKeyHashScript(make([]byte, 20))}},
+	}
+	tx.HashID = tx.ID()
+
+	return tx
+}
+
+func signInput(t *testing.T, tx *Transaction, inIdx int, account *wallet.Account, subScript []byte, hashType SigHashType) []byte {
+	t.Helper()
+
+	signature, err := tx.SignInput(inIdx, account.PrivateKey, subScript, hashType)
+	if err != nil {
+		t.Fatalf("SignInput: %v", err)
+	}
+	return signature
+}
+
+func TestVerifyScriptPayToPubKeyHash(t *testing.T) {
+
+	owner := wallet.MakeAccount()
+	other := wallet.MakeAccount()
+
+	locking := PayToPubKeyHashScript(wallet.PublicKeyHash(owner.PublicKey))
+
+	tests := []struct {
+		name      string
+		unlocking func(tx *Transaction) []byte
+		valid     bool
+	}{
+		{
+			name: "owner signature",
+			unlocking: func(tx *Transaction) []byte {
+				return P2PKHUnlockingScript(signInput(t, tx, 0, owner, locking, SIGHASH_ALL), owner.PublicKey)
+			},
+			valid: true,
+		},
+		{
+			name: "other key",
+			unlocking: func(tx *Transaction) []byte {
+				return P2PKHUnlockingScript(signInput(t, tx, 0, other, locking, SIGHASH_ALL), other.PublicKey)
+			},
+		},
+		{
+			name: "other key's signature with the owner key",
+			unlocking: func(tx *Transaction) []byte {
+				return P2PKHUnlockingScript(signInput(t, tx, 0, other, locking, SIGHASH_ALL), owner.PublicKey)
+			},
+		},
+		{
+			name: "signature over another script",
+			unlocking: func(tx *Transaction) []byte {
+				return P2PKHUnlockingScript(signInput(t, tx, 0, owner, []byte{OP_TRUE}, SIGHASH_ALL), owner.PublicKey)
+			},
+		},
+		{
+			name: "empty signature",
+			unlocking: func(tx *Transaction) []byte {
+				return P2PKHUnlockingScript([]byte{}, owner.PublicKey)
+			},
+		},
+		{
+			name: "extra value left on the stack",
+			unlocking: func(tx *Transaction) []byte {
+				signature := signInput(t, tx, 0, owner, locking, SIGHASH_ALL)
+				script, _ := NewScriptBuilder().AddOp(OP_1).AddData(signature).AddData(owner.PublicKey).Script()
+				return script
+			},
+		},
+		{
+			name: "unlocking script that is not push only",
+			unlocking: func(tx *Transaction) []byte {
+				signature := signInput(t, tx, 0, owner, locking, SIGHASH_ALL)
+				script, _ := NewScriptBuilder().AddData(signature).AddData(owner.PublicKey).AddOp(OP_NOP).Script()
+				return script
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := spendingTx()
+			tx.Inputs[0].Script = test.unlocking(tx)
+
+			err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid spend, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the spend to fail")
+			}
+		})
+	}
+}
+
+func TestVerifyScriptPayToScriptHash(t *testing.T) {
+
+	alwaysTrue := []byte{OP_TRUE}
+	alwaysFalse := []byte{OP_FALSE}
+
+	tests := []struct {
+		name   string
+		redeem []byte
+		paidTo []byte
+		valid  bool
+	}{
+		{name: "matching redeem script", redeem: alwaysTrue, paidTo: alwaysTrue, valid: true},
+		{name: "redeem script of another hash", redeem: alwaysTrue, paidTo: []byte{OP_16}},
+		{name: "redeem script that ends false", redeem: alwaysFalse, paidTo: alwaysFalse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := spendingTx()
+			tx.Inputs[0].Script, _ = NewScriptBuilder().AddData(test.redeem).Script()
+
+			locking := PayToScriptHashScript(wallet.Hash160(test.paidTo))
+
+			err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid spend, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the spend to fail")
+			}
+		})
+	}
+}
+
+func TestVerifyScriptMultiSig(t *testing.T) {
+
+	keys := []*wallet.Account{wallet.MakeAccount(), wallet.MakeAccount(), wallet.MakeAccount()}
+	outsider := wallet.MakeAccount()
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		pubKeys = append(pubKeys, key.PublicKey)
+	}
+
+	redeem, err := MultiSigScript(2, pubKeys)
+	if err != nil {
+		t.Fatalf("MultiSigScript: %v", err)
+	}
+
+	locking := PayToScriptHashScript(wallet.Hash160(redeem))
+
+	tests := []struct {
+		name    string
+		signers []*wallet.Account
+		valid   bool
+	}{
+		{name: "first and second key", signers: []*wallet.Account{keys[0], keys[1]}, valid: true},
+		{name: "first and third key", signers: []*wallet.Account{keys[0], keys[2]}, valid: true},
+		{name: "second and third key", signers: []*wallet.Account{keys[1], keys[2]}, valid: true},
+		{name: "keys out of order", signers: []*wallet.Account{keys[1], keys[0]}},
+		{name: "same key twice", signers: []*wallet.Account{keys[0], keys[0]}},
+		{name: "outsider key", signers: []*wallet.Account{keys[0], outsider}},
+		{name: "one signature short", signers: []*wallet.Account{keys[0]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := spendingTx()
+
+			var signatures [][]byte
+			for _, signer := range test.signers {
+				signatures = append(signatures, signInput(t, tx, 0, signer, redeem, SIGHASH_ALL))
+			}
+			tx.Inputs[0].Script = MultiSigUnlockingScript(signatures, redeem)
+
+			err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid spend, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the spend to fail")
+			}
+		})
+	}
+}
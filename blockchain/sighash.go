@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// SigHashType says which parts of a transaction a signature commits to. It
+// is carried as the last byte of the signature.
+type SigHashType byte
+
+const (
+	// SIGHASH_ALL signs every input and every output. SIGHASH_NONE signs
+	// no outputs, leaving them to whoever completes the transaction, and
+	// SIGHASH_SINGLE only the output at the index of the signed input. Both
+	// leave the sequence of the other inputs open to change.
+	SIGHASH_ALL    SigHashType = 0x01
+	SIGHASH_NONE   SigHashType = 0x02
+	SIGHASH_SINGLE SigHashType = 0x03
+	// SIGHASH_ANYONECANPAY is combined with one of the above to sign only
+	// the signed input, so others can add inputs of their own.
+	SIGHASH_ANYONECANPAY SigHashType = 0x80
+
+	SIGHASH_BASE_MASK = 0x1f
+)
+
+var sigHashNames = map[SigHashType]string{
+	SIGHASH_ALL:    "ALL",
+	SIGHASH_NONE:   "NONE",
+	SIGHASH_SINGLE: "SINGLE",
+}
+
+func (t SigHashType) base() SigHashType {
+	return t & SIGHASH_BASE_MASK
+}
+
+func (t SigHashType) AnyoneCanPay() bool {
+	return t&SIGHASH_ANYONECANPAY != 0
+}
+
+// IsValid reports whether t is one of the three base types, with no other
+// bits set than SIGHASH_ANYONECANPAY.
+func (t SigHashType) IsValid() bool {
+	_, ok := sigHashNames[t.base()]
+	return ok && t&^(SIGHASH_BASE_MASK|SIGHASH_ANYONECANPAY) == 0
+}
+
+func (t SigHashType) String() string {
+	name, ok := sigHashNames[t.base()]
+	if !ok {
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+	if t.AnyoneCanPay() {
+		name += "|ANYONECANPAY"
+	}
+	return name
+}
+
+// ParseSigHashType reads a hash type written as by String, such as
+// "SINGLE|ANYONECANPAY". An empty string is SIGHASH_ALL.
+func ParseSigHashType(s string) (SigHashType, error) {
+
+	if s == "" {
+		return SIGHASH_ALL, nil
+	}
+
+	base, modifier, found := strings.Cut(strings.ToUpper(s), "|")
+	if found && modifier != "ANYONECANPAY" {
+		return 0, fmt.Errorf("unknown sighash modifier %q", modifier)
+	}
+
+	for t, name := range sigHashNames {
+		if name == base {
+			if found {
+				t |= SIGHASH_ANYONECANPAY
+			}
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown sighash type %q", base)
+}
+
+// SignatureHash is the hash a signature for input inIdx commits to. The
+// unlocking scripts are emptied, except that of inIdx, which is replaced by
+// subScript, the script doing the signature check. The inputs and outputs
+// that hashType leaves out are then dropped, and hashType itself is hashed
+// in, so a signature cannot be passed off as one of another type.
+func (t *Transaction) SignatureHash(inIdx int, subScript []byte, hashType SigHashType) ([]byte, error) {
+
+	if !hashType.IsValid() {
+		return nil, fmt.Errorf("sighash type %s is not defined", hashType)
+	}
+	if inIdx < 0 || inIdx >= len(t.Inputs) {
+		return nil, fmt.Errorf("input %d is out of range, the transaction has %d", inIdx, len(t.Inputs))
+	}
+
+	txCopy := t.TrimmedCopy()
+	txCopy.Inputs[inIdx].Script = subScript
+
+	switch hashType.base() {
+	case SIGHASH_NONE:
+		txCopy.Outputs = nil
+		clearOtherSequences(&txCopy, inIdx)
+
+	case SIGHASH_SINGLE:
+		if inIdx >= len(txCopy.Outputs) {
+			return nil, fmt.Errorf("input %d signs SINGLE but there is no output %d", inIdx, inIdx)
+		}
+
+		//
+		// outputs before the signed one only hold their place
+		//
+		txCopy.Outputs = txCopy.Outputs[:inIdx+1]
+		for i := 0; i < inIdx; i++ {
+			txCopy.Outputs[i] = TxOutput{Value: -1}
+		}
+		clearOtherSequences(&txCopy, inIdx)
+	}
+
+	if hashType.AnyoneCanPay() {
+		txCopy.Inputs = txCopy.Inputs[inIdx : inIdx+1]
+	}
+
+	txCopy.HashID = []byte{}
+	hash := sha256.Sum256(append(txCopy.Serialize(), byte(hashType)))
+
+	return hash[:], nil
+}
+
+func clearOtherSequences(tx *Transaction, inIdx int) {
+	for i := range tx.Inputs {
+		if i != inIdx {
+			tx.Inputs[i].Sequence = 0
+		}
+	}
+}
+
+// checkTxSignature verifies signature, with its hash type as the last byte,
+// as pubKey's signature of input inIdx of tx where subScript does the check.
+func checkTxSignature(tx *Transaction, inIdx int, subScript, pubKey, signature []byte) bool {
+
+	if len(signature) < 2 {
+		return false
+	}
+
+	hashType := SigHashType(signature[len(signature)-1])
+
+	hash, err := tx.SignatureHash(inIdx, subScript, hashType)
+	if err != nil {
+		return false
+	}
+
+	return checkSignature(pubKey, signature[:len(signature)-1], hash)
+}
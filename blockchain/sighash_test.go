@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// twoByTwoTx returns a transaction with two inputs and two outputs, input 0
+// spending an output locked to account.
+func twoByTwoTx(account *wallet.Account) *Transaction {
+	tx := &Transaction{
+		Inputs: []TxInput{
+			{ID: bytes.Repeat([]byte{0x11}, 32), Out: 0, Sequence: MAX_RBF_SEQUENCE},
+			{ID: bytes.Repeat([]byte{0x22}, 32), Out: 1, Sequence: MAX_RBF_SEQUENCE},
+		},
+		Outputs: []TxOutput{
+			*NewTXOutput(5, string(account.Address())),
+			*NewTXOutput(7, string(account.Address())),
+		},
+	}
+	tx.HashID = tx.ID()
+
+	return tx
+}
+
+func TestSignatureHashTypes(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	locking := PayToPubKeyHashScript(wallet.PublicKeyHash(account.PublicKey))
+
+	//
+	// each change is made to a transaction after input 0 was signed
+	//
+	changes := []struct {
+		name   string
+		change func(tx *Transaction)
+	}{
+		{"output 0 value", func(tx *Transaction) { tx.Outputs[0].Value++ }},
+		{"output 1 value", func(tx *Transaction) { tx.Outputs[1].Value++ }},
+		{"added output", func(tx *Transaction) { tx.Outputs = append(tx.Outputs, TxOutput{Value: 1, Script: locking}) }},
+		{"input 1 sequence", func(tx *Transaction) { tx.Inputs[1].Sequence++ }},
+		{"input 1 outpoint", func(tx *Transaction) { tx.Inputs[1].Out++ }},
+		{"added input", func(tx *Transaction) {
+			tx.Inputs = append(tx.Inputs, TxInput{ID: bytes.Repeat([]byte{0x33}, 32), Out: 0, Sequence: SEQUENCE_FINAL})
+		}},
+		{"input 0 sequence", func(tx *Transaction) { tx.Inputs[0].Sequence++ }},
+		{"lock time", func(tx *Transaction) { tx.LockTime++ }},
+	}
+
+	//
+	// the changes each hash type still accepts, by name
+	//
+	tests := []struct {
+		hashType SigHashType
+		allowed  []string
+	}{
+		{SIGHASH_ALL, nil},
+		{SIGHASH_NONE, []string{"output 0 value", "output 1 value", "added output", "input 1 sequence"}},
+		{SIGHASH_SINGLE, []string{"output 1 value", "added output", "input 1 sequence"}},
+		{SIGHASH_ALL | SIGHASH_ANYONECANPAY, []string{"input 1 sequence", "input 1 outpoint", "added input"}},
+		{SIGHASH_NONE | SIGHASH_ANYONECANPAY, []string{"output 0 value", "output 1 value", "added output", "input 1 sequence", "input 1 outpoint", "added input"}},
+		{SIGHASH_SINGLE | SIGHASH_ANYONECANPAY, []string{"output 1 value", "added output", "input 1 sequence", "input 1 outpoint", "added input"}},
+	}
+
+	for _, test := range tests {
+		allowed := make(map[string]bool)
+		for _, name := range test.allowed {
+			allowed[name] = true
+		}
+
+		for _, change := range changes {
+			t.Run(test.hashType.String()+"/"+change.name, func(t *testing.T) {
+				tx := twoByTwoTx(account)
+				signature := signInput(t, tx, 0, account, locking, test.hashType)
+				tx.Inputs[0].Script = P2PKHUnlockingScript(signature, account.PublicKey)
+
+				if err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0); err != nil {
+					t.Fatalf("signature does not verify before the change: %v", err)
+				}
+
+				change.change(tx)
+
+				err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0)
+				if allowed[change.name] && err != nil {
+					t.Fatalf("expected the signature to survive the change, got %v", err)
+				}
+				if !allowed[change.name] && err == nil {
+					t.Fatal("expected the change to break the signature")
+				}
+			})
+		}
+	}
+}
+
+// The hash type is signed along with the transaction, so relabelling a
+// signature as a looser type breaks it.
+func TestSignatureHashTypeIsCommitted(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	locking := PayToPubKeyHashScript(wallet.PublicKeyHash(account.PublicKey))
+
+	tx := twoByTwoTx(account)
+	signature := signInput(t, tx, 0, account, locking, SIGHASH_ALL)
+	signature[len(signature)-1] = byte(SIGHASH_NONE | SIGHASH_ANYONECANPAY)
+
+	tx.Inputs[0].Script = P2PKHUnlockingScript(signature, account.PublicKey)
+
+	if err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0); err == nil {
+		t.Fatal("expected the relabelled signature to fail")
+	}
+}
+
+func TestSignatureHashErrors(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	tx := twoByTwoTx(account)
+	tx.Outputs = tx.Outputs[:1]
+
+	tests := []struct {
+		name     string
+		inIdx    int
+		hashType SigHashType
+	}{
+		{name: "single without a matching output", inIdx: 1, hashType: SIGHASH_SINGLE},
+		{name: "single anyonecanpay without a matching output", inIdx: 1, hashType: SIGHASH_SINGLE | SIGHASH_ANYONECANPAY},
+		{name: "undefined base type", inIdx: 0, hashType: 0x04},
+		{name: "undefined flag", inIdx: 0, hashType: SIGHASH_ALL | 0x40},
+		{name: "input out of range", inIdx: 2, hashType: SIGHASH_ALL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := tx.SignatureHash(test.inIdx, nil, test.hashType); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseSigHashType(t *testing.T) {
+
+	for _, hashType := range []SigHashType{
+		SIGHASH_ALL, SIGHASH_NONE, SIGHASH_SINGLE,
+		SIGHASH_ALL | SIGHASH_ANYONECANPAY, SIGHASH_NONE | SIGHASH_ANYONECANPAY, SIGHASH_SINGLE | SIGHASH_ANYONECANPAY,
+	} {
+		parsed, err := ParseSigHashType(hashType.String())
+		if err != nil || parsed != hashType {
+			t.Errorf("ParseSigHashType(%q) = %s, %v", hashType.String(), parsed, err)
+		}
+	}
+
+	for _, s := range []string{"ANY", "ALL|NONE", "ANYONECANPAY"} {
+		if _, err := ParseSigHashType(s); err == nil {
+			t.Errorf("ParseSigHashType(%q) did not fail", s)
+		}
+	}
+}
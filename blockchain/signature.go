@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/i101dev/blockchain-Tensor/util"
+)
+
+const (
+	// SIGNATURE_SIZE is the length of a signature without its hash type: r
+	// followed by s, each zero padded to 32 bytes.
+	SIGNATURE_SIZE = 64
+	// PUBKEY_SIZE is the length of a compressed SEC1 public key: 0x02 or
+	// 0x03 for the parity of Y, followed by X.
+	PUBKEY_SIZE = 33
+)
+
+// halfOrder is half the order of the curve. Of the two values s and N-s
+// that make a valid signature with the same r, only the one at or below it
+// is accepted, so a signature cannot be altered into another valid one.
+var halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// signHash signs hash with privKey, encoding the signature as r followed by
+// s with s in its low form.
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	util.HandleError(err, "Sign Transaction")
+
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(privKey.Curve.Params().N, s)
+	}
+
+	signature := make([]byte, SIGNATURE_SIZE)
+	r.FillBytes(signature[:SIGNATURE_SIZE/2])
+	s.FillBytes(signature[SIGNATURE_SIZE/2:])
+
+	return signature
+}
+
+// parsePubKey decodes a compressed SEC1 public key, and makes sure it is a
+// point on the curve.
+func parsePubKey(pubKey []byte) (*ecdsa.PublicKey, error) {
+
+	if len(pubKey) != PUBKEY_SIZE || (pubKey[0] != 0x02 && pubKey[0] != 0x03) {
+		return nil, fmt.Errorf("public key %x is not a compressed public key", pubKey)
+	}
+
+	curve := elliptic.P256()
+
+	x, y := elliptic.UnmarshalCompressed(curve, pubKey)
+	if x == nil {
+		return nil, fmt.Errorf("public key %x is not on the curve", pubKey)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// parseSignature splits a signature made by signHash into r and s. Both have
+// to be in range and s has to be in its low form.
+func parseSignature(signature []byte) (*big.Int, *big.Int, error) {
+
+	if len(signature) != SIGNATURE_SIZE {
+		return nil, nil, fmt.Errorf("signature is %d bytes, not %d", len(signature), SIGNATURE_SIZE)
+	}
+
+	r := new(big.Int).SetBytes(signature[:SIGNATURE_SIZE/2])
+	s := new(big.Int).SetBytes(signature[SIGNATURE_SIZE/2:])
+
+	n := elliptic.P256().Params().N
+
+	switch {
+	case r.Sign() == 0 || r.Cmp(n) >= 0:
+		return nil, nil, errors.New("signature r is out of range")
+	case s.Sign() == 0:
+		return nil, nil, errors.New("signature s is zero")
+	case s.Cmp(halfOrder) > 0:
+		return nil, nil, errors.New("signature s is not in its low form")
+	}
+
+	return r, s, nil
+}
+
+// checkSignatureEncoding fails unless signature, with its hash type as the
+// last byte, is canonical. An empty signature passes; it never verifies, so
+// scripts can use it to skip a key.
+func checkSignatureEncoding(signature []byte) error {
+
+	if len(signature) == 0 {
+		return nil
+	}
+
+	if hashType := SigHashType(signature[len(signature)-1]); !hashType.IsValid() {
+		return fmt.Errorf("sighash type %s is not defined", hashType)
+	}
+
+	_, _, err := parseSignature(signature[:len(signature)-1])
+	return err
+}
+
+// checkSignature verifies a signature made by signHash against pubKey.
+func checkSignature(pubKey, signature, hash []byte) bool {
+
+	rawPubKey, err := parsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	r, s, err := parseSignature(signature)
+	if err != nil {
+		return false
+	}
+
+	return ecdsa.Verify(rawPubKey, hash, r, s)
+}
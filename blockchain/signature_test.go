@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"math/big"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// highS returns signature, made by signHash and followed by its hash type,
+// with s replaced by N-s. It verifies the same but is not canonical.
+func highS(signature []byte) []byte {
+	s := new(big.Int).SetBytes(signature[SIGNATURE_SIZE/2 : SIGNATURE_SIZE])
+	s.Sub(elliptic.P256().Params().N, s)
+
+	altered := append([]byte{}, signature...)
+	s.FillBytes(altered[SIGNATURE_SIZE/2 : SIGNATURE_SIZE])
+
+	return altered
+}
+
+func TestCheckSignatureEncoding(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	tx := spendingTx()
+	signature := signInput(t, tx, 0, account, []byte{OP_TRUE}, SIGHASH_ALL)
+
+	zeroR := append([]byte{}, signature...)
+	copy(zeroR[:SIGNATURE_SIZE/2], make([]byte, SIGNATURE_SIZE/2))
+
+	tests := []struct {
+		name      string
+		signature []byte
+		valid     bool
+	}{
+		{name: "low s", signature: signature, valid: true},
+		{name: "empty", signature: []byte{}, valid: true},
+		{name: "high s", signature: highS(signature)},
+		{name: "r of zero", signature: zeroR},
+		{name: "short", signature: append(append([]byte{}, signature[1:SIGNATURE_SIZE]...), byte(SIGHASH_ALL))},
+		{name: "undefined hash type", signature: append(append([]byte{}, signature[:SIGNATURE_SIZE]...), 0x04)},
+		{name: "no hash type", signature: signature[:SIGNATURE_SIZE]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSignatureEncoding(test.signature)
+			if test.valid && err != nil {
+				t.Fatalf("expected a canonical signature, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the signature to be rejected")
+			}
+		})
+	}
+}
+
+func TestParsePubKey(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	pub := account.PrivateKey.PublicKey
+
+	uncompressed := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+
+	wrongPrefix := append([]byte{}, account.PublicKey...)
+	wrongPrefix[0] = 0x04
+
+	offCurve := append([]byte{0x02}, bytes.Repeat([]byte{0xff}, PUBKEY_SIZE-1)...)
+
+	tests := []struct {
+		name   string
+		pubKey []byte
+		valid  bool
+	}{
+		{name: "compressed", pubKey: account.PublicKey, valid: true},
+		{name: "uncompressed", pubKey: uncompressed},
+		{name: "compressed length with uncompressed prefix", pubKey: wrongPrefix},
+		{name: "x beyond the field", pubKey: offCurve},
+		{name: "truncated", pubKey: account.PublicKey[:PUBKEY_SIZE-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePubKey(test.pubKey)
+			if test.valid && err != nil {
+				t.Fatalf("expected the key to parse, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the key to be rejected")
+			}
+		})
+	}
+}
+
+// Scripts have to fail on a non-canonical signature or key, not just check
+// false, so that a spend cannot be made valid by altering its encoding.
+func TestCheckSigRejectsNonCanonicalEncodings(t *testing.T) {
+
+	account := wallet.MakeAccount()
+	pub := account.PrivateKey.PublicKey
+	uncompressed := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+
+	tests := []struct {
+		name   string
+		pubKey []byte
+		sign   func(tx *Transaction, locking []byte) []byte
+	}{
+		{
+			name:   "high s signature",
+			pubKey: account.PublicKey,
+			sign: func(tx *Transaction, locking []byte) []byte {
+				return highS(signInput(t, tx, 0, account, locking, SIGHASH_ALL))
+			},
+		},
+		{
+			name:   "uncompressed key",
+			pubKey: uncompressed,
+			sign: func(tx *Transaction, locking []byte) []byte {
+				return signInput(t, tx, 0, account, locking, SIGHASH_ALL)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locking := PayToPubKeyHashScript(wallet.PublicKeyHash(test.pubKey))
+
+			tx := spendingTx()
+			tx.Inputs[0].Script = P2PKHUnlockingScript(test.sign(tx, locking), test.pubKey)
+
+			if err := VerifyScript(tx.Inputs[0].Script, locking, tx, 0); err == nil {
+				t.Fatal("expected the spend to fail")
+			}
+
+			//
+			// wrapped in OP_NOT, a signature that merely fails to
+			// verify would pass
+			//
+			notLocking := append(locking[:len(locking)-1:len(locking)-1], OP_CHECKSIG, OP_NOT)
+			if err := VerifyScript(tx.Inputs[0].Script, notLocking, tx, 0); err == nil {
+				t.Fatal("expected OP_CHECKSIG to fail the script, not just check false")
+			}
+		})
+	}
+}
+
+func TestLegacyFunds(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9119, alice)
+
+	pub := alice.PrivateKey.PublicKey
+	alice.LegacyPublicKey = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	if funds := UTXO.LegacyFunds(w); len(funds) != 0 {
+		t.Fatalf("legacy funds %v before anything was paid to the legacy key", funds)
+	}
+
+	pay, err := NewTransaction(string(alice.Address()), alice.LegacyAddress(), 5, 1, false, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	mineOn(t, chain, tipBlock(t, chain), wallet.MakeAccount(), pay)
+
+	funds := UTXO.LegacyFunds(w)
+	if len(funds) != 1 || funds[alice.LegacyAddress()] != 5 {
+		t.Fatalf("legacy funds %v, want 5 at %s", funds, alice.LegacyAddress())
+	}
+}
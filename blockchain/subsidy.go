@@ -0,0 +1,65 @@
+package blockchain
+
+// CalcBlockSubsidy returns the number of new coins the coinbase of a block at
+// the given height may create. The reward starts at InitialSubsidy, halves
+// every HalvingInterval blocks, and stops once MaxSupply has been issued.
+func CalcBlockSubsidy(height int) int {
+
+	subsidy := halvedSubsidy(height)
+	remaining := Params.MaxSupply - SupplyAtHeight(height)
+
+	if remaining <= 0 {
+		return 0
+	}
+
+	if subsidy > remaining {
+		return remaining
+	}
+
+	return subsidy
+}
+
+// SupplyAtHeight returns how many coins the blocks below the given height
+// have created in total.
+func SupplyAtHeight(height int) int {
+
+	supply := 0
+	interval := Params.HalvingInterval
+
+	for start := 0; start < height; start += interval {
+
+		blocks := interval
+		if start+blocks > height {
+			blocks = height - start
+		}
+
+		subsidy := halvedSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		supply += blocks * subsidy
+
+		if supply >= Params.MaxSupply {
+			return Params.MaxSupply
+		}
+	}
+
+	return supply
+}
+
+func halvedSubsidy(height int) int {
+
+	halvings := height / Params.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return Params.InitialSubsidy >> uint(halvings)
+}
+
+// MoneyRange reports whether value is an amount that can exist: not
+// negative and no more than MaxSupply.
+func MoneyRange(value int) bool {
+	return value >= 0 && value <= Params.MaxSupply
+}
@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestCalcBlockSubsidy(t *testing.T) {
+
+	tests := []struct {
+		height  int
+		subsidy int
+		supply  int
+	}{
+		{0, 20, 0},
+		{999, 20, 19980},
+		{1000, 10, 20000},
+		{2000, 5, 30000},
+		{3000, 2, 35000},
+		{4000, 1, 37000},
+		{4999, 1, 37999},
+		{5000, 0, 38000},
+		{100000, 0, 38000},
+	}
+
+	for _, test := range tests {
+		if got := SupplyAtHeight(test.height); got != test.supply {
+			t.Errorf("SupplyAtHeight(%d) = %d, want %d", test.height, got, test.supply)
+		}
+		if got := CalcBlockSubsidy(test.height); got != test.subsidy {
+			t.Errorf("CalcBlockSubsidy(%d) = %d, want %d", test.height, got, test.subsidy)
+		}
+	}
+}
+
+func TestCalcBlockSubsidyStopsAtMaxSupply(t *testing.T) {
+
+	params := Params
+	t.Cleanup(func() { Params = params })
+
+	//
+	// the second era would issue 100 coins, but only 45 are left
+	//
+	Params.InitialSubsidy = 20
+	Params.HalvingInterval = 10
+	Params.MaxSupply = 245
+
+	tests := []struct {
+		height  int
+		subsidy int
+	}{
+		{9, 20},
+		{10, 10},
+		{13, 10},
+		{14, 5},
+		{15, 0},
+	}
+
+	for _, test := range tests {
+		if got := CalcBlockSubsidy(test.height); got != test.subsidy {
+			t.Errorf("CalcBlockSubsidy(%d) = %d, want %d", test.height, got, test.subsidy)
+		}
+	}
+
+	if supply := SupplyAtHeight(100); supply != Params.MaxSupply {
+		t.Errorf("SupplyAtHeight(100) = %d, want %d", supply, Params.MaxSupply)
+	}
+}
+
+func TestMoneyRange(t *testing.T) {
+
+	tests := []struct {
+		value int
+		valid bool
+	}{
+		{-1, false},
+		{0, true},
+		{Params.MaxSupply, true},
+		{Params.MaxSupply + 1, false},
+	}
+
+	for _, test := range tests {
+		if got := MoneyRange(test.value); got != test.valid {
+			t.Errorf("MoneyRange(%d) = %v, want %v", test.value, got, test.valid)
+		}
+	}
+}
+
+func TestCoinbaseAboveSubsidyIsRejected(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9110, alice)
+
+	tip := tipBlock(t, chain)
+	bits, err := chain.CalcNextBits(tip)
+	if err != nil {
+		t.Fatalf("CalcNextBits: %v", err)
+	}
+
+	coinbase := CoinbaseTX(string(alice.Address()), "", CalcBlockSubsidy(tip.Height+1)+1)
+
+	block, err := CreateBlock([]*Transaction{coinbase}, tip.Hash, tip.Height+1, bits)
+	if err != nil {
+		t.Fatalf("CreateBlock: %v", err)
+	}
+
+	if err := chain.AddBlock(block); !IsRejectReason(err, RejectBadCoinbaseValue) {
+		t.Fatalf("expected %s, got %v", RejectBadCoinbaseValue, err)
+	}
+
+	mineOn(t, chain, tip, alice)
+}
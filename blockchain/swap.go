@@ -0,0 +1,270 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+const (
+	// SECRET_SIZE is the length in bytes of an atomic swap secret.
+	SECRET_SIZE = 32
+	// INITIATOR_LOCKTIME and PARTICIPANT_LOCKTIME are how long the two
+	// contracts of a swap lock their coins by default. The participant's
+	// expires first, so the initiator cannot redeem it at the last moment
+	// and leave the participant no time to redeem in turn.
+	INITIATOR_LOCKTIME   = 48 * time.Hour
+	PARTICIPANT_LOCKTIME = 24 * time.Hour
+)
+
+// An atomic swap trades coins on two chains without either side trusting
+// the other. The initiator locks coins in a contract the participant can
+// redeem with a secret only the initiator knows. The participant audits it
+// and locks coins in a contract on the other chain with the same secret
+// hash and an earlier lock time. Redeeming that one reveals the secret,
+// which lets the participant redeem the first. If either side walks away,
+// both take their coins back once the lock times pass.
+
+// InitiateSwap pays amount from the wallet address from into a contract
+// that recipient can redeem until lockTime, and from can refund after. With
+// a nil secretHash a new secret is made and kept in the wallet; a
+// participant passes the initiator's secret hash instead. It returns the
+// contract transaction and the contract.
+func InitiateSwap(from, recipient string, amount, fee int, secretHash []byte, lockTime uint32, UTXO *UTXOSet, w *wallet.Wallet) (*Transaction, []byte, error) {
+
+	account, ok := w.Accounts[from]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not an address of this wallet", from)
+	}
+
+	recipientHash, isScript, err := wallet.DecodeAddress(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isScript {
+		return nil, nil, fmt.Errorf("%s pays to a script, the recipient has to be a key", recipient)
+	}
+
+	refundHash := wallet.PublicKeyHash(account.PublicKey)
+
+	if balance, _ := UTXO.GetBalance(PayToPubKeyHashScript(refundHash)); balance < amount+fee {
+		return nil, nil, fmt.Errorf("not enough funds: %s has %d, %d needed", from, balance, amount+fee)
+	}
+
+	if secretHash == nil {
+		secret := make([]byte, SECRET_SIZE)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, nil, err
+		}
+
+		hash := sha256.Sum256(secret)
+		secretHash = hash[:]
+		w.Secrets[hex.EncodeToString(secretHash)] = secret
+	}
+
+	if len(secretHash) != sha256.Size {
+		return nil, nil, fmt.Errorf("secret hash is %d bytes, not %d", len(secretHash), sha256.Size)
+	}
+
+	contract, err := (&HTLC{secretHash, recipientHash, refundHash, lockTime}).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contractAddr := wallet.ScriptHashToAddr(wallet.Hash160(contract))
+
+	tx, err := NewTransaction(from, contractAddr, amount, fee, false, 0, UTXO, w)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tx, contract, nil
+}
+
+// RedeemSwap spends the output of contract in transaction txID with the
+// secret, paying it less fee to the recipient. The recipient's key has to
+// be in the wallet. A nil secret is looked up in the wallet.
+func RedeemSwap(contract, txID, secret []byte, fee int, UTXO *UTXOSet, w *wallet.Wallet) (*Transaction, error) {
+
+	c, ok := ExtractHTLC(contract)
+	if !ok {
+		return nil, fmt.Errorf("script is not a swap contract")
+	}
+
+	if secret == nil {
+		secret = w.Secrets[hex.EncodeToString(c.SecretHash)]
+	}
+
+	if hash := sha256.Sum256(secret); !bytes.Equal(hash[:], c.SecretHash) {
+		return nil, fmt.Errorf("secret does not match the contract's secret hash %x", c.SecretHash)
+	}
+
+	return spendContract(contract, txID, c.RecipientHash, fee, 0, SEQUENCE_FINAL, UTXO, w, func(signature, pubKey []byte) []byte {
+		return HTLCRedeemScript(signature, pubKey, secret, contract)
+	})
+}
+
+// RefundSwap spends the output of contract in transaction txID back to the
+// refund key, which has to be in the wallet. The refund carries the
+// contract's lock time, so it cannot be mined before then.
+func RefundSwap(contract, txID []byte, fee int, UTXO *UTXOSet, w *wallet.Wallet) (*Transaction, error) {
+
+	c, ok := ExtractHTLC(contract)
+	if !ok {
+		return nil, fmt.Errorf("script is not a swap contract")
+	}
+
+	return spendContract(contract, txID, c.RefundHash, fee, c.LockTime, SEQUENCE_FINAL-1, UTXO, w, func(signature, pubKey []byte) []byte {
+		return HTLCRefundScript(signature, pubKey, contract)
+	})
+}
+
+// spendContract pays the contract output of txID to the key whose hash is
+// pubKeyHash, with the unlocking script made by unlock from its signature.
+func spendContract(contract, txID, pubKeyHash []byte, fee int, lockTime, sequence uint32, UTXO *UTXOSet, w *wallet.Wallet, unlock func(signature, pubKey []byte) []byte) (*Transaction, error) {
+
+	account := w.FindAccount(pubKeyHash)
+	if account == nil {
+		return nil, fmt.Errorf("key %x of the contract is not in the wallet", pubKeyHash)
+	}
+
+	entry, err := findContractOutput(contract, txID, UTXO)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Output.Value <= fee {
+		return nil, fmt.Errorf("contract output of %d does not cover a fee of %d", entry.Output.Value, fee)
+	}
+
+	tx := Transaction{
+		Inputs:   []TxInput{{ID: entry.TxID, Out: entry.Index, Sequence: sequence}},
+		Outputs:  []TxOutput{*NewTXOutput(entry.Output.Value-fee, wallet.PubKeyHashToAddr(pubKeyHash))},
+		LockTime: lockTime,
+	}
+	tx.HashID = tx.ID()
+
+	signature, err := tx.SignInput(0, account.PrivateKey, contract, SIGHASH_ALL)
+	if err != nil {
+		return nil, err
+	}
+	tx.Inputs[0].Script = unlock(signature, account.PublicKey)
+
+	if !tx.Verify(map[string]TxOutput{OutpointKey(entry.TxID, entry.Index): entry.Output}) {
+		return nil, fmt.Errorf("transaction %x does not unlock the contract", tx.HashID)
+	}
+
+	return &tx, nil
+}
+
+// findContractOutput looks up the unspent output of txID that pays to the
+// hash of contract.
+func findContractOutput(contract, txID []byte, UTXO *UTXOSet) (UTXOEntry, error) {
+
+	for _, entry := range UTXO.FindUTXOs(PayToScriptHashScript(wallet.Hash160(contract))) {
+		if bytes.Equal(entry.TxID, txID) {
+			return entry, nil
+		}
+	}
+
+	return UTXOEntry{}, fmt.Errorf("transaction %x has no unspent output paying to the contract", txID)
+}
+
+// SwapAudit is what a swap contract output holds, for the counterparty to
+// check before going on with the swap.
+type SwapAudit struct {
+	Address       string `json:"address"`
+	TxID          string `json:"txid"`
+	Vout          int    `json:"vout"`
+	Value         int    `json:"value"`
+	Recipient     string `json:"recipient"`
+	Refund        string `json:"refund"`
+	SecretHash    string `json:"secret_hash"`
+	LockTime      uint32 `json:"locktime"`
+	Confirmations int    `json:"confirmations"`
+	Spent         bool   `json:"spent"`
+	Secret        string `json:"secret,omitempty"`
+}
+
+// AuditSwap describes the output of contract in the confirmed transaction
+// txID. Once the output has been redeemed, the secret is read from the
+// transaction that spent it.
+func AuditSwap(contract, txID []byte, UTXO *UTXOSet) (*SwapAudit, error) {
+
+	c, ok := ExtractHTLC(contract)
+	if !ok {
+		return nil, fmt.Errorf("script is not a swap contract")
+	}
+
+	chain := UTXO.Blockchain
+
+	tx, err := chain.FindTransaction(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	lockingScript := PayToScriptHashScript(wallet.Hash160(contract))
+
+	vout := -1
+	for i, out := range tx.Outputs {
+		if bytes.Equal(out.Script, lockingScript) {
+			vout = i
+			break
+		}
+	}
+	if vout == -1 {
+		return nil, fmt.Errorf("transaction %x does not pay to the contract", txID)
+	}
+
+	audit := &SwapAudit{
+		Address:    ScriptAddress(lockingScript),
+		TxID:       hex.EncodeToString(txID),
+		Vout:       vout,
+		Value:      tx.Outputs[vout].Value,
+		Recipient:  wallet.PubKeyHashToAddr(c.RecipientHash),
+		Refund:     wallet.PubKeyHashToAddr(c.RefundHash),
+		SecretHash: hex.EncodeToString(c.SecretHash),
+		LockTime:   c.LockTime,
+	}
+
+	if entry, found := UTXO.GetUTXO(txID, vout); found {
+		audit.Confirmations = chain.GetBestHeight() - entry.Height + 1
+		return audit, nil
+	}
+
+	audit.Spent = true
+
+	if spender, err := chain.FindSpender(txID, vout); err == nil {
+		if secret := ExtractSecret(spender, c.SecretHash); secret != nil {
+			audit.Secret = hex.EncodeToString(secret)
+		}
+	}
+
+	return audit, nil
+}
+
+// ExtractSecret returns the value pushed by one of tx's unlocking scripts
+// whose SHA-256 is secretHash, or nil when there is none, as when a contract
+// was refunded rather than redeemed.
+func ExtractSecret(tx *Transaction, secretHash []byte) []byte {
+
+	for _, in := range tx.Inputs {
+		ops, err := parseScript(in.Script)
+		if err != nil {
+			continue
+		}
+
+		for _, op := range ops {
+			if hash := sha256.Sum256(op.data); op.data != nil && bytes.Equal(hash[:], secretHash) {
+				return op.data
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func swapWallet(account *wallet.Account) *wallet.Wallet {
+	return &wallet.Wallet{
+		Accounts: map[string]*wallet.Account{string(account.Address()): account},
+		Secrets:  make(map[string][]byte),
+	}
+}
+
+// initiateSwap has alice, whose wallet is w, lock 10 coins in a contract bob
+// can redeem and she can refund from height lockTime+1 on, and mines it.
+func initiateSwap(t *testing.T, chain *Blockchain, w *wallet.Wallet, alice, bob *wallet.Account, lockTime uint32) (*Block, *Transaction, []byte) {
+	t.Helper()
+
+	UTXO := UTXOSet{chain}
+
+	tx, contract, err := InitiateSwap(string(alice.Address()), string(bob.Address()), 10, 1, nil, lockTime, &UTXO, w)
+	if err != nil {
+		t.Fatalf("InitiateSwap: %v", err)
+	}
+
+	return mineOn(t, chain, tipBlock(t, chain), alice, tx), tx, contract
+}
+
+func TestSwapRedeem(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9116, alice)
+	UTXO := UTXOSet{chain}
+
+	aliceWallet := swapWallet(alice)
+	block, tx, contract := initiateSwap(t, chain, aliceWallet, alice, bob, 100)
+
+	c, ok := ExtractHTLC(contract)
+	if !ok {
+		t.Fatal("ExtractHTLC does not recognize the contract")
+	}
+	secret := aliceWallet.Secrets[hex.EncodeToString(c.SecretHash)]
+
+	audit, err := AuditSwap(contract, tx.HashID, &UTXO)
+	if err != nil {
+		t.Fatalf("AuditSwap: %v", err)
+	}
+	if audit.Value != 10 || audit.Recipient != string(bob.Address()) || audit.Confirmations != 1 || audit.Spent {
+		t.Fatalf("audit before the redeem: %+v", audit)
+	}
+
+	if _, err := RedeemSwap(contract, tx.HashID, make([]byte, SECRET_SIZE), 1, &UTXO, swapWallet(bob)); err == nil {
+		t.Fatal("RedeemSwap should refuse the wrong secret")
+	}
+	if _, err := RedeemSwap(contract, tx.HashID, secret, 1, &UTXO, aliceWallet); err == nil {
+		t.Fatal("RedeemSwap should need the recipient's key")
+	}
+
+	redeem, err := RedeemSwap(contract, tx.HashID, secret, 1, &UTXO, swapWallet(bob))
+	if err != nil {
+		t.Fatalf("RedeemSwap: %v", err)
+	}
+	mineOn(t, chain, block, alice, redeem)
+
+	audit, err = AuditSwap(contract, tx.HashID, &UTXO)
+	if err != nil {
+		t.Fatalf("AuditSwap: %v", err)
+	}
+	if !audit.Spent || audit.Secret != hex.EncodeToString(secret) {
+		t.Fatalf("audit after the redeem: %+v", audit)
+	}
+}
+
+func TestSwapRefund(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9117, alice)
+	UTXO := UTXOSet{chain}
+
+	block, tx, contract := initiateSwap(t, chain, swapWallet(alice), alice, bob, 2)
+
+	if _, err := RefundSwap(contract, tx.HashID, 1, &UTXO, swapWallet(bob)); err == nil {
+		t.Fatal("RefundSwap should need the refund key")
+	}
+
+	refund, err := RefundSwap(contract, tx.HashID, 1, &UTXO, swapWallet(alice))
+	if err != nil {
+		t.Fatalf("RefundSwap: %v", err)
+	}
+
+	if err := chain.AddBlock(createOn(t, chain, block, alice, refund)); !IsRejectReason(err, RejectNonFinal) {
+		t.Fatalf("refund before the lock time: expected %s, got %v", RejectNonFinal, err)
+	}
+
+	//
+	// a refund that claims an earlier lock time fails the contract
+	//
+	early := *refund
+	early.Inputs = append([]TxInput{}, refund.Inputs...)
+	early.LockTime = 1
+	early.HashID = early.ID()
+
+	signature := signInput(t, &early, 0, alice, contract, SIGHASH_ALL)
+	early.Inputs[0].Script = HTLCRefundScript(signature, alice.PublicKey, contract)
+
+	if _, err := chain.CheckTransactionInputs(&early, nil, 2); !IsRejectReason(err, RejectScriptFailed) {
+		t.Fatalf("refund with an earlier lock time: expected %s, got %v", RejectScriptFailed, err)
+	}
+
+	next := mineOn(t, chain, block, alice)
+	mineOn(t, chain, next, alice, refund)
+
+	audit, err := AuditSwap(contract, tx.HashID, &UTXO)
+	if err != nil {
+		t.Fatalf("AuditSwap: %v", err)
+	}
+	if !audit.Spent || audit.Secret != "" {
+		t.Fatalf("audit after the refund: %+v", audit)
+	}
+}
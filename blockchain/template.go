@@ -0,0 +1,235 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	MAX_BLOCK_SIZE         = 1 << 20
+	MAX_BLOCK_TXS          = 4000
+	COINBASE_RESERVED_SIZE = 1000
+)
+
+// BlockTemplate is the work for the next block on top of the current tip:
+// the transactions to include, in order, and what the coinbase may claim.
+// The block's timestamp has to be at least MinTime.
+type BlockTemplate struct {
+	Version       int32
+	PrevHash      []byte
+	Height        int
+	Bits          uint32
+	CurTime       int64
+	MinTime       int64
+	Transactions  []*Transaction
+	TxFees        []int
+	Fees          int
+	CoinbaseValue int
+	Size          int
+}
+
+func (t *BlockTemplate) MarshalJSON() ([]byte, error) {
+
+	type templateTx struct {
+		TxID string `json:"txid"`
+		Data string `json:"data"`
+		Fee  int    `json:"fee"`
+		Size int    `json:"size"`
+	}
+
+	txs := make([]templateTx, len(t.Transactions))
+	for i, tx := range t.Transactions {
+		data := tx.Serialize()
+		txs[i] = templateTx{
+			TxID: hex.EncodeToString(tx.HashID),
+			Data: hex.EncodeToString(data),
+			Fee:  t.TxFees[i],
+			Size: len(data),
+		}
+	}
+
+	return json.Marshal(struct {
+		Version       int32        `json:"version"`
+		PrevHash      string       `json:"prev_hash"`
+		Height        int          `json:"height"`
+		Bits          string       `json:"bits"`
+		Target        string       `json:"target"`
+		CurTime       int64        `json:"cur_time"`
+		MinTime       int64        `json:"min_time"`
+		CoinbaseValue int          `json:"coinbase_value"`
+		Fees          int          `json:"fees"`
+		SizeLimit     int          `json:"size_limit"`
+		Transactions  []templateTx `json:"transactions"`
+	}{
+		Version:       t.Version,
+		PrevHash:      hex.EncodeToString(t.PrevHash),
+		Height:        t.Height,
+		Bits:          fmt.Sprintf("%08x", t.Bits),
+		Target:        fmt.Sprintf("%064x", CompactToTarget(t.Bits)),
+		CurTime:       t.CurTime,
+		MinTime:       t.MinTime,
+		CoinbaseValue: t.CoinbaseValue,
+		Fees:          t.Fees,
+		SizeLimit:     MAX_BLOCK_SIZE,
+		Transactions:  txs,
+	})
+}
+
+// txPackage is a mempool transaction together with its ancestors that are
+// not in the template yet, which have to go in first.
+type txPackage struct {
+	desc      *TxDesc
+	order     int
+	ancestors map[string]bool
+	fee       int
+	size      int
+}
+
+// paysLessThan compares the packages' fee rates.
+func (pkg *txPackage) paysLessThan(other *txPackage) bool {
+	return pkg.fee*other.size < other.fee*pkg.size
+}
+
+// NewBlockTemplate picks transactions for the next block from descs, which
+// have to be ordered so that parents come before their children, as
+// Mempool.Descs returns them. Transactions are chosen by the fee rate of
+// their package, the transaction with all of its unconfirmed ancestors, so
+// a child paying a high fee pulls in a parent paying a low one. Packages are
+// added until the block reaches MAX_BLOCK_SIZE bytes or MAX_BLOCK_TXS
+// transactions.
+func (chain *Blockchain) NewBlockTemplate(descs []*TxDesc) (*BlockTemplate, error) {
+
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	bits, err := chain.CalcNextBits(tip)
+	if err != nil {
+		return nil, err
+	}
+
+	medianTime, err := chain.CalcPastMedianTime(tip)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &BlockTemplate{
+		Version:  BLOCK_VERSION,
+		PrevHash: tip.Hash,
+		Height:   tip.Height + 1,
+		Bits:     bits,
+		CurTime:  time.Now().UnixNano(),
+		MinTime:  medianTime + 1,
+		Size:     COINBASE_RESERVED_SIZE,
+	}
+
+	packages := make(map[string]*txPackage)
+	descendants := make(map[string][]string)
+
+	for i, desc := range descs {
+		txID := hex.EncodeToString(desc.Tx.HashID)
+		pkg := &txPackage{
+			desc:      desc,
+			order:     i,
+			ancestors: make(map[string]bool),
+			fee:       desc.Fee,
+			size:      desc.Size,
+		}
+
+		for _, in := range desc.Tx.Inputs {
+			parentID := hex.EncodeToString(in.ID)
+			parent, ok := packages[parentID]
+			if !ok {
+				continue
+			}
+
+			for ancestorID := range parent.ancestors {
+				pkg.ancestors[ancestorID] = true
+			}
+			pkg.ancestors[parentID] = true
+		}
+
+		for ancestorID := range pkg.ancestors {
+			pkg.fee += packages[ancestorID].desc.Fee
+			pkg.size += packages[ancestorID].desc.Size
+			descendants[ancestorID] = append(descendants[ancestorID], txID)
+		}
+
+		packages[txID] = pkg
+	}
+
+	pending := make(map[string]Transaction)
+
+	// drop takes a transaction that cannot go in, and everything that
+	// depends on it, out of consideration
+	var drop func(txID string)
+	drop = func(txID string) {
+		if _, ok := packages[txID]; !ok {
+			return
+		}
+
+		delete(packages, txID)
+		for _, childID := range descendants[txID] {
+			drop(childID)
+		}
+	}
+
+	for len(packages) > 0 {
+
+		var best *txPackage
+		for _, pkg := range packages {
+			if best == nil || best.paysLessThan(pkg) || (!pkg.paysLessThan(best) && pkg.order < best.order) {
+				best = pkg
+			}
+		}
+
+		bestID := hex.EncodeToString(best.desc.Tx.HashID)
+
+		if template.Size+best.size > MAX_BLOCK_SIZE || len(template.Transactions)+len(best.ancestors)+1 > MAX_BLOCK_TXS {
+			drop(bestID)
+			continue
+		}
+
+		members := []*txPackage{best}
+		for ancestorID := range best.ancestors {
+			members = append(members, packages[ancestorID])
+		}
+
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].order < members[j].order
+		})
+
+		for _, member := range members {
+			memberID := hex.EncodeToString(member.desc.Tx.HashID)
+
+			fee, err := chain.CheckTransactionInputs(member.desc.Tx, pending, template.Height)
+			if err != nil {
+				drop(memberID)
+				break
+			}
+
+			template.Transactions = append(template.Transactions, member.desc.Tx)
+			template.TxFees = append(template.TxFees, fee)
+			template.Fees += fee
+			template.Size += member.desc.Size
+			pending[memberID] = *member.desc.Tx
+
+			delete(packages, memberID)
+			for _, childID := range descendants[memberID] {
+				if child, ok := packages[childID]; ok {
+					delete(child.ancestors, memberID)
+					child.fee -= member.desc.Fee
+					child.size -= member.desc.Size
+				}
+			}
+		}
+	}
+
+	template.CoinbaseValue = CalcBlockSubsidy(template.Height) + template.Fees
+
+	return template, nil
+}
@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// spendOutput returns a transaction paying output out of prev, which pays
+// account, to to, less fee.
+func spendOutput(prev *Transaction, out, fee int, account, to *wallet.Account) *Transaction {
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: prev.HashID, Out: out, Sequence: SEQUENCE_FINAL}},
+		Outputs: []TxOutput{*NewTXOutput(prev.Outputs[out].Value-fee, string(to.Address()))},
+	}
+	tx.HashID = tx.ID()
+	tx.Sign(account.PrivateKey, map[string]TxOutput{OutpointKey(prev.HashID, out): prev.Outputs[out]})
+
+	return tx
+}
+
+func TestBlockTemplateSelectsPackages(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9112, alice)
+
+	first := mineOn(t, chain, tipBlock(t, chain), alice)
+	second := mineOn(t, chain, first, alice)
+
+	//
+	// the child pays enough to pull its cheap parent in ahead of other
+	//
+	parent := spendOutput(first.Transactions[0], 0, 1, alice, alice)
+	child := spendOutput(parent, 0, 10, alice, alice)
+	other := spendOutput(second.Transactions[0], 0, 3, alice, alice)
+
+	mp := NewMempool(chain)
+	for _, tx := range []*Transaction{other, parent, child} {
+		if _, err := mp.MaybeAcceptTransaction(tx); err != nil {
+			t.Fatalf("MaybeAcceptTransaction: %v", err)
+		}
+	}
+
+	template, err := chain.NewBlockTemplate(mp.Descs())
+	if err != nil {
+		t.Fatalf("NewBlockTemplate: %v", err)
+	}
+
+	want := []*Transaction{parent, child, other}
+	if len(template.Transactions) != len(want) {
+		t.Fatalf("template has %d transactions, want %d", len(template.Transactions), len(want))
+	}
+	for i, tx := range want {
+		if string(template.Transactions[i].HashID) != string(tx.HashID) {
+			t.Fatalf("transaction %d is %x, want %x", i, template.Transactions[i].HashID, tx.HashID)
+		}
+	}
+
+	if template.Fees != 14 || template.CoinbaseValue != CalcBlockSubsidy(template.Height)+14 {
+		t.Fatalf("fees %d and coinbase value %d, want 14 on top of the subsidy", template.Fees, template.CoinbaseValue)
+	}
+
+	mineOn(t, chain, second, alice, template.Transactions...)
+}
+
+func TestBlockTemplateDropsInvalidPackages(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9113, alice)
+
+	first := mineOn(t, chain, tipBlock(t, chain), alice)
+	second := mineOn(t, chain, first, alice)
+
+	forged := forgedSpend(t, first, alice, bob)
+	child := spendOutput(forged, 0, 1, bob, bob)
+	valid := spendOutput(second.Transactions[0], 0, 1, alice, alice)
+
+	//
+	// fees as the pool would have seen them; the forged spend pays the
+	// most so it is tried first
+	//
+	descs := []*TxDesc{
+		{Tx: forged, Fee: 50, Size: forged.Size()},
+		{Tx: child, Fee: 50, Size: child.Size()},
+		{Tx: valid, Fee: 1, Size: valid.Size()},
+	}
+
+	template, err := chain.NewBlockTemplate(descs)
+	if err != nil {
+		t.Fatalf("NewBlockTemplate: %v", err)
+	}
+
+	if len(template.Transactions) != 1 || string(template.Transactions[0].HashID) != string(valid.HashID) {
+		t.Fatalf("template has %d transactions, want only the valid one", len(template.Transactions))
+	}
+}
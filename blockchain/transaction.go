@@ -3,30 +3,34 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/i101dev/blockchain-Tensor/util"
 	"github.com/i101dev/blockchain-Tensor/wallet"
 )
 
+// Transaction moves the value of the outputs its Inputs spend to its
+// Outputs. It cannot go into a block before LockTime, a block height or,
+// from LOCKTIME_THRESHOLD on, a unix time, unless it is zero.
 type Transaction struct {
-	HashID  []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	HashID   []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32
 }
 
 func (t *Transaction) Print() {
 	fmt.Println(strings.Repeat("-", 70))
 	fmt.Printf("> ID: %x", t.HashID)
+	fmt.Printf("\n> LockTime: %d", t.LockTime)
 	fmt.Println("\n> Inputs:")
 	for _, input := range t.Inputs {
 		input.Print()
@@ -50,6 +54,11 @@ func (t Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
+// Size is the length of the serialized transaction in bytes.
+func (t Transaction) Size() int {
+	return len(t.Serialize())
+}
+
 func (t *Transaction) Hash() []byte {
 
 	var h [32]byte
@@ -62,83 +71,98 @@ func (t *Transaction) Hash() []byte {
 	return h[:]
 }
 
-func (t *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// ID returns the hash the transaction is identified by. Unlocking scripts
+// are left out, so HashID is fixed when the transaction is built and does
+// not change when it is signed. A coinbase has nothing to sign and keeps
+// its script, which carries the coinbase data.
+func (t *Transaction) ID() []byte {
+
 	if t.IsCoinbase() {
-		return
+		return t.Hash()
+	}
+
+	txCopy := *t
+	txCopy.Inputs = make([]TxInput, len(t.Inputs))
+
+	for i, in := range t.Inputs {
+		txCopy.Inputs[i] = TxInput{Out: in.Out, ID: in.ID, Sequence: in.Sequence}
+	}
+
+	return txCopy.Hash()
+}
+
+// Sign signs the inputs that spend pay-to-pubkey-hash outputs locked to
+// privKey's key, committing to the whole transaction. prevOuts maps the
+// outpoint each input spends, as given by OutpointKey, to the output found
+// there. Inputs locked any other way are left for their own signers.
+func (t *Transaction) Sign(privKey ecdsa.PrivateKey, prevOuts map[string]TxOutput) {
+	err := t.SignWithHashType(privKey, prevOuts, SIGHASH_ALL)
+	util.HandleError(err, "Sign Transaction")
+}
+
+// SignWithHashType is Sign with the signatures committing to the parts of
+// the transaction hashType picks.
+func (t *Transaction) SignWithHashType(privKey ecdsa.PrivateKey, prevOuts map[string]TxOutput, hashType SigHashType) error {
+	if t.IsCoinbase() {
+		return nil
 	}
 
 	for _, in := range t.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].HashID == nil {
+		if _, ok := prevOuts[OutpointKey(in.ID, in.Out)]; !ok {
 			log.Panic("\n *** >>> ERROR: previous transaction is not correct")
 		}
 	}
 
-	txCopy := t.TrimmedCopy()
+	pubKey := wallet.EncodePublicKey(&privKey.PublicKey)
+	pubKeyHash := wallet.PublicKeyHash(pubKey)
 
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range t.Inputs {
 
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.Inputs[inId].Signature = nil
+		prevOut := prevOuts[OutpointKey(in.ID, in.Out)]
+		if !prevOut.IsLockedWithKey(pubKeyHash) {
+			continue
+		}
 
-		txCopy.HashID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+		signature, err := t.SignInput(inId, privKey, prevOut.Script, hashType)
+		if err != nil {
+			return err
+		}
+		t.Inputs[inId].Script = P2PKHUnlockingScript(signature, pubKey)
+	}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.HashID)
-		util.HandleError(err, "Sign Transaction")
+	return nil
+}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+// SignInput returns privKey's signature for input inIdx where subScript
+// does the check: the locking script, or the redeem script of a
+// pay-to-script-hash output. The hash type is appended to it. It is up to
+// the caller to put the signature into the input's unlocking script.
+func (t *Transaction) SignInput(inIdx int, privKey ecdsa.PrivateKey, subScript []byte, hashType SigHashType) ([]byte, error) {
 
-		t.Inputs[inId].Signature = signature
+	hash, err := t.SignatureHash(inIdx, subScript, hashType)
+	if err != nil {
+		return nil, err
 	}
+
+	return append(signHash(privKey, hash), byte(hashType)), nil
 }
 
-func (t *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// Verify runs the scripts of every input against the output it spends,
+// looked up in prevOuts the same way as in Sign.
+func (t *Transaction) Verify(prevOuts map[string]TxOutput) bool {
 	if t.IsCoinbase() {
 		return true
 	}
 
 	// Verify each of the inputs exists
 	for _, in := range t.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].HashID == nil {
+		if _, ok := prevOuts[OutpointKey(in.ID, in.Out)]; !ok {
 			log.Panic("Previous transaction not correct")
 		}
 	}
 
-	txCopy := t.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inId, in := range t.Inputs {
-
-		// Same as what's in the Transaction.Sign() method
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-
-		txCopy.HashID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		// Deconstruct the signature
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		// Deconstruct the public key
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{
-			Curve: curve,
-			X:     &x,
-			Y:     &y,
-		}
-
-		if !ecdsa.Verify(&rawPubKey, txCopy.HashID, &r, &s) {
+		if t.VerifyInput(inId, prevOuts[OutpointKey(in.ID, in.Out)]) != nil {
 			return false
 		}
 	}
@@ -146,32 +170,40 @@ func (t *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	return true
 }
 
+// VerifyInput runs the scripts of input inIdx, which spends prevOut, and
+// says why they failed if they did.
+func (t *Transaction) VerifyInput(inIdx int, prevOut TxOutput) error {
+	return VerifyScript(t.Inputs[inIdx].Script, prevOut.Script, t, inIdx)
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.Out, in.ID, nil, nil})
+		inputs = append(inputs, TxInput{Out: in.Out, ID: in.ID, Sequence: in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{Value: out.Value, Script: out.Script})
 	}
 
-	txCopy := Transaction{tx.HashID, inputs, outputs}
+	txCopy := Transaction{tx.HashID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		ID      string     `json:"id"`
-		Inputs  []TxInput  `json:"inputs"`
-		Outputs []TxOutput `json:"outputs"`
+		ID       string     `json:"id"`
+		Inputs   []TxInput  `json:"inputs"`
+		Outputs  []TxOutput `json:"outputs"`
+		LockTime uint32     `json:"locktime"`
 	}{
-		ID:      hex.EncodeToString(t.HashID),
-		Inputs:  t.Inputs,
-		Outputs: t.Outputs,
+		ID:       hex.EncodeToString(t.HashID),
+		Inputs:   t.Inputs,
+		Outputs:  t.Outputs,
+		LockTime: t.LockTime,
 	})
 }
 
@@ -198,14 +230,39 @@ func (t *Transaction) MarshalJSON() ([]byte, error) {
 // 	return nil
 // }
 
+// OutputValue sums the outputs. CheckTransactionSanity keeps the sum within
+// MoneyRange for any transaction that gets past it.
+func (tx *Transaction) OutputValue() int {
+	total := 0
+	for _, out := range tx.Outputs {
+		total += out.Value
+	}
+	return total
+}
+
+// IsReplaceable reports whether the transaction signals that it may be
+// replaced in the mempool by one paying a higher fee.
+func (tx *Transaction) IsReplaceable() bool {
+	for _, in := range tx.Inputs {
+		if in.Sequence <= MAX_RBF_SEQUENCE {
+			return true
+		}
+	}
+	return false
+}
+
 func (tx *Transaction) IsCoinbase() bool {
-	lenOne := len(tx.Inputs) == 1
-	idZero := len(tx.Inputs[0].ID) == 0
-	outOne := tx.Inputs[0].Out == -1
-	return lenOne && idZero && outOne
+	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
+}
+
+// CoinbaseTX creates the transaction that pays the block reward to the miner.
+func CoinbaseTX(to string, data string, value int) *Transaction {
+	return CoinbaseTXWithOutputs(data, []TxOutput{*NewTXOutput(value, to)})
 }
 
-func CoinbaseTX(to string, data string) *Transaction {
+// CoinbaseTXWithOutputs creates a coinbase that splits the block reward over
+// several outputs, such as a pool paying its miners.
+func CoinbaseTXWithOutputs(data string, outputs []TxOutput) *Transaction {
 
 	if data == "" {
 		randData := make([]byte, 24)
@@ -218,18 +275,16 @@ func CoinbaseTX(to string, data string) *Transaction {
 	}
 
 	txIn := TxInput{
-		ID:        []byte{},
-		Out:       -1,
-		Signature: nil,
-		PubKey:    []byte(data),
+		ID:       []byte{},
+		Out:      -1,
+		Script:   []byte(data),
+		Sequence: SEQUENCE_FINAL,
 	}
 
-	txOut := NewTXOutput(20, to)
-
 	newTX := Transaction{
 		HashID:  nil,
 		Inputs:  []TxInput{txIn},
-		Outputs: []TxOutput{*txOut},
+		Outputs: outputs,
 	}
 
 	newTX.HashID = newTX.Hash()
@@ -237,7 +292,23 @@ func CoinbaseTX(to string, data string) *Transaction {
 	return &newTX
 }
 
-func NewTransaction(from, to string, amount int, UTXO *UTXOSet, senderWallet *wallet.Wallet) *Transaction {
+// setExtraNonce rewrites the coinbase data as base followed by the
+// extranonce, which gives the miner a fresh merkle root to search.
+func (t *Transaction) setExtraNonce(base []byte, extraNonce uint64) {
+
+	data := make([]byte, len(base)+8)
+	copy(data, base)
+	binary.BigEndian.PutUint64(data[len(base):], extraNonce)
+
+	t.Inputs[0].Script = data
+	t.HashID = t.ID()
+}
+
+// NewTransaction pays amount to the given address and fee to the miner. The
+// fee is left implicit: it is whatever the inputs are worth beyond the
+// outputs. A replaceable transaction can later have its fee bumped. A
+// non-zero lockTime keeps the transaction out of blocks until then.
+func NewTransaction(from, to string, amount, fee int, replaceable bool, lockTime uint32, UTXO *UTXOSet, senderWallet *wallet.Wallet) (*Transaction, error) {
 
 	// blockchain.OpenDB(chain)
 	// defer chain.CloseDB()
@@ -245,13 +316,27 @@ func NewTransaction(from, to string, amount int, UTXO *UTXOSet, senderWallet *wa
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	w := senderWallet.GetAccount(from)
+	w, ok := senderWallet.Accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an address of this wallet", from)
+	}
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	required := amount + fee
+	acc, validOutputs := UTXO.FindSpendableOutputs(PayToPubKeyHashScript(pubKeyHash), required)
 
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	if acc < required {
+		return nil, fmt.Errorf("not enough funds: %s has %d, %d are needed", from, acc, required)
+	}
+
+	//
+	// inputs numbered SEQUENCE_FINAL would leave the lock time unenforced
+	//
+	sequence := uint32(SEQUENCE_FINAL)
+	if replaceable {
+		sequence = MAX_RBF_SEQUENCE
+	} else if lockTime > 0 {
+		sequence = SEQUENCE_FINAL - 1
 	}
 
 	for txHash, outs := range validOutputs {
@@ -259,22 +344,163 @@ func NewTransaction(from, to string, amount int, UTXO *UTXOSet, senderWallet *wa
 		util.HandleError(err, "NewTransaction 1")
 
 		for _, outIndex := range outs {
-			input := TxInput{outIndex, txHashID, nil, w.PublicKey}
+			input := TxInput{Out: outIndex, ID: txHashID, Sequence: sequence}
 			inputs = append(inputs, input)
 		}
 	}
 
 	outputs = append(outputs, *NewTXOutput(amount, to))
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > required {
+		outputs = append(outputs, *NewTXOutput(acc-required, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.HashID = tx.Hash()
+	tx := Transaction{nil, inputs, outputs, lockTime}
+	tx.HashID = tx.ID()
 	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
 
-	return &tx
+	return &tx, nil
+}
+
+// NewTransactionWithFeeRate is NewTransaction with the fee derived from a
+// rate in coins per kilobyte of the signed transaction.
+func NewTransactionWithFeeRate(from, to string, amount, feeRate int, replaceable bool, lockTime uint32, UTXO *UTXOSet, senderWallet *wallet.Wallet) (*Transaction, error) {
+
+	fee := 0
+
+	for {
+		tx, err := NewTransaction(from, to, amount, fee, replaceable, lockTime, UTXO, senderWallet)
+		if err != nil {
+			return nil, err
+		}
+
+		required := FeeForSize(feeRate, tx.Size())
+		if required <= fee {
+			return tx, nil
+		}
+
+		fee = required
+	}
+}
+
+// BumpFee rebuilds a replaceable transaction paid from address from so that
+// it pays feeRate coins per kilobyte, and at least one coin more than
+// before. feeRate has to be above the rate of tx by more than
+// INCREMENTAL_RELAY_FEE. The extra fee comes out of the change, with inputs
+// added when the change does not cover it. The result spends the same
+// outputs as tx, so it replaces tx in the mempool.
+func BumpFee(tx *Transaction, from string, feeRate int, UTXO *UTXOSet, senderWallet *wallet.Wallet) (*Transaction, error) {
+
+	if !tx.IsReplaceable() {
+		return nil, fmt.Errorf("transaction %x does not signal replaceability", tx.HashID)
+	}
+
+	w, ok := senderWallet.Accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an address of this wallet", from)
+	}
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	var inputs []TxInput
+	inputValue := 0
+	used := make(map[string]bool)
+
+	for _, in := range tx.Inputs {
+		entry, found := UTXO.GetUTXO(in.ID, in.Out)
+		if !found {
+			return nil, fmt.Errorf("output %x:%d is not in the UTXO set", in.ID, in.Out)
+		}
+
+		if !entry.Output.IsLockedWithKey(pubKeyHash) {
+			return nil, fmt.Errorf("output %x:%d does not belong to %s", in.ID, in.Out, from)
+		}
+
+		inputs = append(inputs, TxInput{Out: in.Out, ID: in.ID, Sequence: in.Sequence})
+		inputValue += entry.Output.Value
+		used[OutpointKey(in.ID, in.Out)] = true
+	}
+
+	var payments []TxOutput
+	paid := 0
+	change := 0
+
+	for _, out := range tx.Outputs {
+		if out.IsLockedWithKey(pubKeyHash) {
+			change += out.Value
+			continue
+		}
+
+		payments = append(payments, out)
+		paid += out.Value
+	}
+
+	fee := inputValue - paid - change
+
+	//
+	// compared without rounding: feeRate > fee*1000/size + INCREMENTAL_RELAY_FEE
+	//
+	if size := tx.Size(); feeRate*size <= fee*1000+INCREMENTAL_RELAY_FEE*size {
+		return nil, fmt.Errorf("fee rate of %d does not exceed the %d coins/kB of %x by more than %d", feeRate, fee*1000/size, tx.HashID, INCREMENTAL_RELAY_FEE)
+	}
+
+	fee++
+
+	for {
+		if inputValue < paid+fee {
+			//
+			// the outputs tx spends are still in the UTXO set and may be
+			// handed back, so they are asked for on top of the shortfall
+			//
+			shortfall := paid + fee - inputValue
+			_, spendable := UTXO.FindSpendableOutputs(PayToPubKeyHashScript(pubKeyHash), shortfall+inputValue)
+
+			for txHash, outs := range spendable {
+				txHashID, err := hex.DecodeString(txHash)
+				util.HandleError(err, "BumpFee")
+
+				for _, outIndex := range outs {
+					if inputValue >= paid+fee || used[OutpointKey(txHashID, outIndex)] {
+						continue
+					}
+
+					entry, found := UTXO.GetUTXO(txHashID, outIndex)
+					if !found {
+						return nil, fmt.Errorf("output %x:%d is not in the UTXO set", txHashID, outIndex)
+					}
+
+					inputs = append(inputs, TxInput{Out: outIndex, ID: txHashID, Sequence: MAX_RBF_SEQUENCE})
+					inputValue += entry.Output.Value
+					used[OutpointKey(txHashID, outIndex)] = true
+				}
+			}
+
+			if inputValue < paid+fee {
+				return nil, fmt.Errorf("not enough funds to pay a fee of %d", fee)
+			}
+		}
+
+		outputs := append([]TxOutput{}, payments...)
+		if inputValue > paid+fee {
+			outputs = append(outputs, *NewTXOutput(inputValue-paid-fee, from))
+		}
+
+		bumped := Transaction{nil, append([]TxInput{}, inputs...), outputs, tx.LockTime}
+		bumped.HashID = bumped.ID()
+		UTXO.Blockchain.SignTransaction(&bumped, w.PrivateKey)
+
+		required := FeeForSize(feeRate, bumped.Size())
+		if required <= fee {
+			return &bumped, nil
+		}
+
+		fee = required
+	}
+}
+
+// FeeForSize returns the fee a transaction of the given size in bytes pays at
+// feeRate coins per kilobyte, rounded up.
+func FeeForSize(feeRate, size int) int {
+	return (feeRate*size + 999) / 1000
 }
 
 func DeserializeTransaction(data []byte) Transaction {
@@ -285,3 +511,17 @@ func DeserializeTransaction(data []byte) Transaction {
 	util.HandleError(err, "DeserializeTransaction")
 	return transaction
 }
+
+// DecodeTransaction is DeserializeTransaction for data from outside, which
+// may not decode.
+func DecodeTransaction(data []byte) (*Transaction, error) {
+
+	var transaction Transaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+
+	if err := decoder.Decode(&transaction); err != nil {
+		return nil, fmt.Errorf("failed to decode and deserialize bytes in to Transaction")
+	}
+
+	return &transaction, nil
+}
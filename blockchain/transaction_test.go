@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestNewTransactionErrors(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9107, alice)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	from, to := string(alice.Address()), string(bob.Address())
+	funds := CalcBlockSubsidy(0)
+
+	if _, err := NewTransaction(to, from, 5, 1, false, 0, &UTXO, w); err == nil {
+		t.Fatal("expected an error for an address outside the wallet")
+	}
+
+	if _, err := NewTransaction(from, to, funds, 1, false, 0, &UTXO, w); err == nil {
+		t.Fatal("expected an error for a payment above the funds")
+	}
+
+	if _, err := NewTransactionWithFeeRate(from, to, funds, 1, false, 0, &UTXO, w); err == nil {
+		t.Fatal("expected an error for a payment that leaves nothing for the fee")
+	}
+
+	if _, err := NewTransaction(from, to, funds-1, 1, false, 0, &UTXO, w); err != nil {
+		t.Fatalf("spending all the funds: %v", err)
+	}
+}
+
+func TestMineBlockRejectsInvalidTransaction(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9108, alice)
+
+	tip := tipBlock(t, chain)
+
+	if _, err := chain.MineBlock(string(alice.Address()), []*Transaction{forgedSpend(t, tip, alice, bob)}); !IsRejectReason(err, RejectScriptFailed) {
+		t.Fatalf("expected %s, got %v", RejectScriptFailed, err)
+	}
+
+	if string(chain.LastHash) != string(tip.Hash) {
+		t.Fatalf("tip moved to %x", chain.LastHash)
+	}
+}
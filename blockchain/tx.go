@@ -2,47 +2,57 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 
 	"github.com/i101dev/blockchain-Tensor/util"
-	"github.com/i101dev/blockchain-Tensor/wallet"
 )
 
 // ---------------------------------------------------------------------
 
-type TxInput struct {
-	Out       int
-	ID        []byte
-	PubKey    []byte
-	Signature []byte
-}
+const (
+	// SEQUENCE_FINAL marks an input as final. A transaction whose inputs
+	// are all numbered above MAX_RBF_SEQUENCE cannot be replaced in the
+	// mempool by one paying a higher fee.
+	SEQUENCE_FINAL   = 0xffffffff
+	MAX_RBF_SEQUENCE = 0xfffffffd
+
+	// MAX_OUTPUT_INDEX is the highest output index an input may refer to,
+	// the range outpoints are keyed by in the UTXO set.
+	MAX_OUTPUT_INDEX = math.MaxUint32
+)
 
-func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
-	return bytes.Equal(lockingHash, pubKeyHash)
+// TxInput spends output Out of transaction ID. Script is the unlocking
+// script that satisfies the output's locking script; in a coinbase it holds
+// arbitrary data instead and is never run.
+type TxInput struct {
+	Out      int
+	ID       []byte
+	Script   []byte
+	Sequence uint32
 }
 
 func (in *TxInput) Print() {
 	fmt.Println("    **")
 	fmt.Printf("    | ID: %x\n", in.ID)
 	fmt.Printf("    | Out: %d\n", in.Out)
-	fmt.Printf("    | Signature: %s\n", in.Signature)
+	fmt.Printf("    | Sequence: %d\n", in.Sequence)
+	fmt.Printf("    | Script: %s\n", DisassembleScript(in.Script))
 }
 
 func (in *TxInput) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		ID        string `json:"id"`
-		Out       int    `json:"out"`
-		Signature string `json:"signature"`
-		PubKey    string `json:"pubkey"`
+		ID       string `json:"id"`
+		Out      int    `json:"out"`
+		Script   string `json:"script"`
+		Sequence uint32 `json:"sequence"`
 	}{
-		ID:        hex.EncodeToString(in.ID),
-		Out:       in.Out,
-		Signature: hex.EncodeToString(in.Signature),
-		PubKey:    hex.EncodeToString(in.PubKey),
+		ID:       hex.EncodeToString(in.ID),
+		Out:      in.Out,
+		Script:   hex.EncodeToString(in.Script),
+		Sequence: in.Sequence,
 	})
 }
 
@@ -82,24 +92,27 @@ func (in *TxInput) MarshalJSON() ([]byte, error) {
 // }
 
 // ---------------------------------------------------------------------
+// TxOutput carries Value coins to whoever can satisfy its locking Script.
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value  int
+	Script []byte
 }
 
 func (out *TxOutput) Print() {
 	fmt.Println("    **")
 	fmt.Printf("    | Value: %d\n", out.Value)
-	fmt.Printf("    | PubKeyHash: %s\n", hex.EncodeToString(out.PubKeyHash))
+	fmt.Printf("    | Script: %s\n", DisassembleScript(out.Script))
 }
 
 func (out *TxOutput) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Value      int    `json:"value"`
-		PubKeyHash string `json:"pubkey_hash"`
+		Value   int    `json:"value"`
+		Script  string `json:"script"`
+		Address string `json:"address,omitempty"`
 	}{
-		Value:      out.Value,
-		PubKeyHash: hex.EncodeToString(out.PubKeyHash),
+		Value:   out.Value,
+		Script:  hex.EncodeToString(out.Script),
+		Address: ScriptAddress(out.Script),
 	})
 }
 
@@ -123,45 +136,30 @@ func (out *TxOutput) MarshalJSON() ([]byte, error) {
 // 	return nil
 // }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := util.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
-}
-
+// IsLockedWithKey reports whether the output pays to the key whose hash is
+// pubKeyHash with a pay-to-pubkey-hash script.
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Equal(out.PubKeyHash, pubKeyHash)
+	lockingHash := ExtractPubKeyHash(out.Script)
+	return lockingHash != nil && bytes.Equal(lockingHash, pubKeyHash)
 }
 
+// NewTXOutput pays value to address with the standard script for its kind.
 func NewTXOutput(value int, address string) *TxOutput {
 
-	txo := &TxOutput{
-		Value:      value,
-		PubKeyHash: nil,
-	}
-
-	txo.Lock([]byte(address))
+	script, err := PayToAddrScript(address)
+	util.HandleError(err, "NewTXOutput")
 
-	return txo
+	return &TxOutput{
+		Value:  value,
+		Script: script,
+	}
 }
 
 // ---------------------------------------------------------------------
-type TxOutputs struct {
-	Outputs []TxOutput
-}
-
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	util.HandleError(err, "Serialize TxOutputs")
-	return buffer.Bytes()
-}
 
-func DeserializeTxOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	util.HandleError(err, "DeserializeTxOutputs")
-	return outputs
+// OutpointKey identifies the output at index of transaction txID. Inputs
+// refer to the output they spend by the same key. The index is taken as a
+// uint32, the same way utxoKey takes it.
+func OutpointKey(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, uint32(index))
 }
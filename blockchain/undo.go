@@ -0,0 +1,38 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/i101dev/blockchain-Tensor/util"
+)
+
+var undoPrefix = []byte("undo-")
+
+// BlockUndo holds what UTXOSet.Disconnect needs to put the UTXO set back
+// exactly as it was before the block was connected: the entries of the
+// outputs the block spent. Outputs created and spent within the block are
+// left out, as are the ones it created, which follow from the block itself.
+type BlockUndo struct {
+	Spent []UTXOEntry
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var buffer bytes.Buffer
+	encode := gob.NewEncoder(&buffer)
+	err := encode.Encode(undo)
+	util.HandleError(err, "Serialize BlockUndo")
+	return buffer.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&undo)
+	util.HandleError(err, "DeserializeBlockUndo")
+	return undo
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
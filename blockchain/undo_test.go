@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestDisconnectRestoresUTXOSet(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9101, alice)
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	first := mineOn(t, chain, tipBlock(t, chain), alice)
+	before := utxoSnapshot(chain)
+
+	//
+	// the second block spends an output and one created in the same block
+	//
+	pay, err := NewTransaction(string(alice.Address()), string(bob.Address()), 5, 1, false, 0, &UTXO, w)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+
+	change := &Transaction{
+		Inputs:  []TxInput{{ID: pay.HashID, Out: 1, Sequence: SEQUENCE_FINAL}},
+		Outputs: []TxOutput{*NewTXOutput(pay.Outputs[1].Value, string(bob.Address()))},
+	}
+	change.HashID = change.ID()
+	change.Sign(alice.PrivateKey, map[string]TxOutput{OutpointKey(pay.HashID, 1): pay.Outputs[1]})
+
+	second := mineOn(t, chain, first, alice, pay, change)
+	after := utxoSnapshot(chain)
+
+	if reflect.DeepEqual(before, after) {
+		t.Fatal("the second block did not change the UTXO set")
+	}
+
+	UTXO.Disconnect(second)
+	if got := utxoSnapshot(chain); !reflect.DeepEqual(got, before) {
+		t.Fatalf("after Disconnect the UTXO set has %d entries, want the %d from before the block", len(got), len(before))
+	}
+
+	if err := UTXO.Update(second); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := utxoSnapshot(chain); !reflect.DeepEqual(got, after) {
+		t.Fatalf("after connecting again the UTXO set has %d entries, want %d", len(got), len(after))
+	}
+}
+
+func TestDuplicateTransactionIsRejected(t *testing.T) {
+
+	alice := wallet.MakeAccount()
+	chain := newTestChain(t, 9105, alice)
+
+	//
+	// coinbases with the same data and value to the same address share
+	// an id, nothing else in them differs
+	//
+	coinbase := func() *Transaction {
+		return CoinbaseTX(string(alice.Address()), "same data", CalcBlockSubsidy(1))
+	}
+
+	parent := tipBlock(t, chain)
+	bits, _ := chain.CalcNextBits(parent)
+
+	first, err := CreateBlock([]*Transaction{coinbase()}, parent.Hash, parent.Height+1, bits)
+	if err != nil {
+		t.Fatalf("CreateBlock: %v", err)
+	}
+	if err := chain.AddBlock(first); err != nil {
+		t.Fatalf("AddBlock: %v", err)
+	}
+
+	bits, _ = chain.CalcNextBits(first)
+
+	second, err := CreateBlock([]*Transaction{coinbase()}, first.Hash, first.Height+1, bits)
+	if err != nil {
+		t.Fatalf("CreateBlock: %v", err)
+	}
+
+	before := utxoSnapshot(chain)
+
+	if err := chain.AddBlock(second); !IsRejectReason(err, RejectDuplicateTx) {
+		t.Fatalf("expected %s, got %v", RejectDuplicateTx, err)
+	}
+
+	UTXO := UTXOSet{chain}
+	if err := UTXO.Update(second); !IsRejectReason(err, RejectDuplicateTx) {
+		t.Fatalf("Update: expected %s, got %v", RejectDuplicateTx, err)
+	}
+
+	if got := utxoSnapshot(chain); !reflect.DeepEqual(got, before) {
+		t.Fatal("the rejected block changed the UTXO set")
+	}
+
+	if entry, found := UTXO.GetUTXO(first.Transactions[0].HashID, 0); !found || entry.Height != first.Height {
+		t.Fatalf("the first coinbase output should still be unspent at height %d", first.Height)
+	}
+}
@@ -2,11 +2,16 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
 
 	"github.com/dgraph-io/badger"
 	"github.com/i101dev/blockchain-Tensor/util"
+	"github.com/i101dev/blockchain-Tensor/wallet"
 )
 
 var (
@@ -18,6 +23,69 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
+// UTXOEntry is an unspent output stored under its outpoint, together with
+// the height of the block that created it.
+type UTXOEntry struct {
+	TxID       []byte
+	Index      int
+	Output     TxOutput
+	Height     int
+	IsCoinbase bool
+}
+
+// IsMature reports whether the output may be spent in a block at the given
+// height. Coinbase outputs have to wait CoinbaseMaturity blocks.
+func (e UTXOEntry) IsMature(spendHeight int) bool {
+	return !e.IsCoinbase || spendHeight-e.Height >= Params.CoinbaseMaturity
+}
+
+func (e UTXOEntry) Serialize() []byte {
+	var buffer bytes.Buffer
+	encode := gob.NewEncoder(&buffer)
+	err := encode.Encode(e)
+	util.HandleError(err, "Serialize UTXOEntry")
+	return buffer.Bytes()
+}
+
+func DeserializeUTXOEntry(data []byte) UTXOEntry {
+	var entry UTXOEntry
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&entry)
+	util.HandleError(err, "DeserializeUTXOEntry")
+	return entry
+}
+
+func (e UTXOEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID       string `json:"txid"`
+		Index      int    `json:"vout"`
+		Value      int    `json:"value"`
+		Script     string `json:"script"`
+		Address    string `json:"address,omitempty"`
+		Height     int    `json:"height"`
+		IsCoinbase bool   `json:"coinbase"`
+	}{
+		TxID:       hex.EncodeToString(e.TxID),
+		Index:      e.Index,
+		Value:      e.Output.Value,
+		Script:     hex.EncodeToString(e.Output.Script),
+		Address:    ScriptAddress(e.Output.Script),
+		Height:     e.Height,
+		IsCoinbase: e.IsCoinbase,
+	})
+}
+
+// utxoKey is the key an output is stored under: the prefix, the id of its
+// transaction and its index as a big-endian uint32, so the outputs of one
+// transaction sit next to each other. Indices above MAX_OUTPUT_INDEX are
+// turned away by CheckTransactionSanity before they get here.
+func utxoKey(txID []byte, index int) []byte {
+	key := make([]byte, 0, prefixLength+len(txID)+4)
+	key = append(key, utxoPrefix...)
+	key = append(key, txID...)
+	return binary.BigEndian.AppendUint32(key, uint32(index))
+}
+
 func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) {
 	//
 	// -------------------------------------------------------------
@@ -76,17 +144,28 @@ func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) {
 	})
 }
 
+// CountTransactions returns the number of transactions with at least one
+// unspent output.
 func (utxo UTXOSet) CountTransactions() int {
 	db := utxo.Blockchain.Database
 	counter := 0
 
 	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
+
+		var lastTxID []byte
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
+			key := it.Item().Key()
+			txID := key[prefixLength : len(key)-4]
+
+			if !bytes.Equal(txID, lastTxID) {
+				counter++
+				lastTxID = append(lastTxID[:0], txID...)
+			}
 		}
 
 		return nil
@@ -97,92 +176,161 @@ func (utxo UTXOSet) CountTransactions() int {
 	return counter
 }
 
-func (utxo *UTXOSet) Update(block *Block) {
+// Update connects a block to the UTXO set: the outputs it spends are removed
+// and the outputs it creates are added under their outpoints. The entries it
+// spends are stored as the block's undo data. A block that would overwrite
+// an unspent output is rejected and leaves the set as it was.
+func (utxo *UTXOSet) Update(block *Block) error {
 	db := utxo.Blockchain.Database
 
-	err := db.Update(func(txn *badger.Txn) error {
+	return db.Update(func(txn *badger.Txn) error {
+		undo := BlockUndo{}
+		created := make(map[string]bool)
+
 		for _, tx := range block.Transactions {
 			if !tx.IsCoinbase() {
 				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
+					key := utxoKey(in.ID, in.Out)
+
+					item, err := txn.Get(key)
 					util.HandleError(err, "Update 1")
 					v, err := item.ValueCopy(nil)
 					util.HandleError(err, "Update 2")
 
-					outs := DeserializeTxOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						//
-						// each input contains a reference to the output it came from
-						//
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
+					//
+					// outputs created earlier in this block are removed
+					// again by Disconnect, they need no undo entry
+					//
+					if !created[hex.EncodeToString(in.ID)] {
+						undo.Spent = append(undo.Spent, DeserializeUTXOEntry(v))
 					}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+					if err := txn.Delete(key); err != nil {
+						log.Panic(err)
 					}
 				}
 			}
 
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
+			for outIdx, out := range tx.Outputs {
+				if IsUnspendable(out.Script) {
+					continue
+				}
 
-			txID := append(utxoPrefix, tx.HashID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+				entry := UTXOEntry{
+					TxID:       tx.HashID,
+					Index:      outIdx,
+					Output:     out,
+					Height:     block.Height,
+					IsCoinbase: tx.IsCoinbase(),
+				}
+
+				key := utxoKey(tx.HashID, outIdx)
+				if _, err := txn.Get(key); err == nil {
+					return ruleError(RejectDuplicateTx, "transaction %x of block %x would overwrite unspent output %d", tx.HashID, block.Hash, outIdx)
+				}
+
+				if err := txn.Set(key, entry.Serialize()); err != nil {
+					log.Panic(err)
+				}
 			}
+
+			created[hex.EncodeToString(tx.HashID)] = true
 		}
 
-		return nil
-	})
+		if err := txn.Set(undoKey(block.Hash), undo.Serialize()); err != nil {
+			return err
+		}
 
-	util.HandleError(err, "Update 3")
+		return txn.Set([]byte(UTXO_TIP_KEY), block.Hash)
+	})
 }
 
-func (utxo UTXOSet) Reindex() {
+// Disconnect reverses Update for a block that is being removed from the tip,
+// using the undo data stored when the block was connected.
+func (utxo *UTXOSet) Disconnect(block *Block) {
 	db := utxo.Blockchain.Database
 
-	utxo.DeleteByPrefix(utxoPrefix)
+	err := db.Update(func(txn *badger.Txn) error {
 
-	UTXO := utxo.Blockchain.FindUTXO()
+		item, err := txn.Get(undoKey(block.Hash))
+		if err != nil {
+			return fmt.Errorf("no undo data for block %x", block.Hash)
+		}
 
-	err := db.Update(func(txn *badger.Txn) error {
+		v, err := item.ValueCopy(nil)
+		util.HandleError(err, "Disconnect 1")
 
-		for txId, outs := range UTXO {
+		undo := DeserializeBlockUndo(v)
 
-			key, err := hex.DecodeString(txId)
+		for _, tx := range block.Transactions {
+			for outIdx := range tx.Outputs {
+				if err := txn.Delete(utxoKey(tx.HashID, outIdx)); err != nil {
+					return err
+				}
+			}
+		}
 
-			if err != nil {
+		for _, entry := range undo.Spent {
+			if err := txn.Set(utxoKey(entry.TxID, entry.Index), entry.Serialize()); err != nil {
 				return err
 			}
+		}
 
-			key = append(utxoPrefix, key...)
+		if err := txn.Delete(undoKey(block.Hash)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(UTXO_TIP_KEY), block.PrevHash)
+	})
 
-			err = txn.Set(key, outs.Serialize())
-			util.HandleError(err, "Reindex 1")
+	util.HandleError(err, "Disconnect 2")
+}
+
+// TipHash returns the hash of the last block connected to the UTXO set, or
+// nil when there is no UTXO set.
+func (utxo UTXOSet) TipHash() []byte {
+	var tip []byte
+
+	err := utxo.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(UTXO_TIP_KEY))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 
-		return nil
+		tip, err = item.ValueCopy(nil)
+		return err
 	})
+	util.HandleError(err, "TipHash")
 
-	util.HandleError(err, "Reindex 2")
+	return tip
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// Reindex rebuilds the UTXO set and the undo data by connecting every block
+// of the main chain again, starting from genesis.
+func (utxo UTXOSet) Reindex() {
+	err := utxo.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(UTXO_TIP_KEY))
+	})
+	util.HandleError(err, "Reindex 1")
+
+	utxo.DeleteByPrefix(utxoPrefix)
+	utxo.DeleteByPrefix(undoPrefix)
+
+	hashes := utxo.Blockchain.GetBlockHashes()
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := utxo.Blockchain.GetBlock(hashes[i])
+		util.HandleError(err, "Reindex 2")
+
+		util.HandleError(utxo.Update(block), "Reindex 3")
+	}
+}
+
+// forEachEntry calls fn for every entry in the UTXO set.
+func (u UTXOSet) forEachEntry(fn func(entry UTXOEntry)) {
 
 	db := u.Blockchain.Database
 
@@ -195,63 +343,142 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			util.HandleError(err, "FindUnspentTransactions 1")
-
-			outs := DeserializeTxOutputs(v)
-
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
 			}
 
+			fn(DeserializeUTXOEntry(v))
 		}
+
 		return nil
 	})
 
-	util.HandleError(err, "FindUnspentTransactions 2")
+	util.HandleError(err, "forEachEntry")
+}
+
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+	var UTXOs []TxOutput
+
+	u.forEachEntry(func(entry UTXOEntry) {
+		if entry.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, entry.Output)
+		}
+	})
 
 	return UTXOs
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// FindUTXOs returns the entries of every output locked by lockingScript.
+func (u UTXOSet) FindUTXOs(lockingScript []byte) []UTXOEntry {
+	var entries []UTXOEntry
+
+	u.forEachEntry(func(entry UTXOEntry) {
+		if bytes.Equal(entry.Output.Script, lockingScript) {
+			entries = append(entries, entry)
+		}
+	})
+
+	return entries
+}
+
+// FindSpendableOutputs collects outputs locked by lockingScript until they
+// are worth at least amount, keyed by transaction id with their output
+// indices. Coinbase outputs that have not matured by the next block are
+// passed over.
+func (u UTXOSet) FindSpendableOutputs(lockingScript []byte, amount int) (int, map[string][]int) {
 
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+
+	u.forEachEntry(func(entry UTXOEntry) {
+		if accumulated >= amount || !bytes.Equal(entry.Output.Script, lockingScript) || !entry.IsMature(spendHeight) {
+			return
+		}
+
+		txID := hex.EncodeToString(entry.TxID)
+		accumulated += entry.Output.Value
+		unspentOuts[txID] = append(unspentOuts[txID], entry.Index)
+	})
+
+	return accumulated, unspentOuts
+}
+
+// GetUTXO returns the entry of the unspent output at index of transaction
+// txID, if there is one.
+func (u UTXOSet) GetUTXO(txID []byte, index int) (UTXOEntry, bool) {
+
+	var entry UTXOEntry
+	found := false
 	db := u.Blockchain.Database
 
 	err := db.View(func(txn *badger.Txn) error {
 
-		opts := badger.DefaultIteratorOptions
+		item, err := txn.Get(utxoKey(txID, index))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		entry = DeserializeUTXOEntry(v)
+		found = true
+
+		return nil
+	})
 
-			item := it.Item()
-			k := item.Key()
-			v, err := item.ValueCopy(nil)
+	util.HandleError(err, "GetUTXO")
 
-			util.HandleError(err, "FindSpendableOutputs 1")
+	return entry, found
+}
 
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeTxOutputs(v)
+// GetBalance sums the outputs locked by lockingScript, split into what can
+// be spent in the next block and coinbase rewards that are still maturing.
+func (u UTXOSet) GetBalance(lockingScript []byte) (int, int) {
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-			}
+	spendable := 0
+	immature := 0
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+
+	u.forEachEntry(func(entry UTXOEntry) {
+		if !bytes.Equal(entry.Output.Script, lockingScript) {
+			return
+		}
+
+		if entry.IsMature(spendHeight) {
+			spendable += entry.Output.Value
+		} else {
+			immature += entry.Output.Value
 		}
-		return nil
 	})
 
-	util.HandleError(err, "FindSpendableOutputs 2")
+	return spendable, immature
+}
+
+// LegacyFunds returns the coins, by address, still paid to the uncompressed
+// keys of the wallet's accounts. Scripts no longer accept those keys, so the
+// coins are stranded.
+func (u UTXOSet) LegacyFunds(w *wallet.Wallet) map[string]int {
 
-	return accumulated, unspentOuts
+	funds := make(map[string]int)
+
+	for _, account := range w.Accounts {
+		if account.LegacyPublicKey == nil {
+			continue
+		}
+
+		spendable, immature := u.GetBalance(PayToPubKeyHashScript(wallet.PublicKeyHash(account.LegacyPublicKey)))
+		if spendable+immature > 0 {
+			funds[account.LegacyAddress()] = spendable + immature
+		}
+	}
+
+	return funds
 }
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestIsMature(t *testing.T) {
+
+	maturity := Params.CoinbaseMaturity
+	Params.CoinbaseMaturity = 3
+	t.Cleanup(func() { Params.CoinbaseMaturity = maturity })
+
+	tests := []struct {
+		name        string
+		entry       UTXOEntry
+		spendHeight int
+		mature      bool
+	}{
+		{name: "coinbase too soon", entry: UTXOEntry{Height: 5, IsCoinbase: true}, spendHeight: 7},
+		{name: "coinbase once mature", entry: UTXOEntry{Height: 5, IsCoinbase: true}, spendHeight: 8, mature: true},
+		{name: "other output right away", entry: UTXOEntry{Height: 5}, spendHeight: 5, mature: true},
+	}
+
+	for _, test := range tests {
+		if got := test.entry.IsMature(test.spendHeight); got != test.mature {
+			t.Errorf("%s: IsMature(%d) = %v, want %v", test.name, test.spendHeight, got, test.mature)
+		}
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+
+	alice, bob := wallet.MakeAccount(), wallet.MakeAccount()
+	chain := newTestChain(t, 9111, alice)
+	Params.CoinbaseMaturity = 2
+
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{string(alice.Address()): alice}}
+	UTXO := UTXOSet{chain}
+
+	genesis := tipBlock(t, chain)
+	spend := spendOutput(genesis.Transactions[0], 0, 0, alice, alice)
+
+	if _, err := NewTransaction(string(alice.Address()), string(bob.Address()), 1, 0, false, 0, &UTXO, w); err == nil {
+		t.Fatal("the wallet should not spend an immature coinbase")
+	}
+
+	if _, err := chain.CheckTransactionInputs(spend, nil, 1); !IsRejectReason(err, RejectImmatureCoinbase) {
+		t.Fatalf("expected %s, got %v", RejectImmatureCoinbase, err)
+	}
+
+	if err := chain.AddBlock(createOn(t, chain, genesis, alice, spend)); !IsRejectReason(err, RejectImmatureCoinbase) {
+		t.Fatalf("block spending the coinbase too soon: expected %s, got %v", RejectImmatureCoinbase, err)
+	}
+
+	first := mineOn(t, chain, genesis, alice)
+	mineOn(t, chain, first, alice, spend)
+
+	//
+	// a coinbase can never be spent in its own block
+	//
+	other := spendOutput(first.Transactions[0], 0, 0, alice, alice)
+	pending := map[string]Transaction{hex.EncodeToString(first.Transactions[0].HashID): *first.Transactions[0]}
+
+	if _, err := chain.CheckTransactionInputs(other, pending, 3); !IsRejectReason(err, RejectImmatureCoinbase) {
+		t.Fatalf("spending a coinbase of the same block: expected %s, got %v", RejectImmatureCoinbase, err)
+	}
+}
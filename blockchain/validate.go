@@ -0,0 +1,484 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// MEDIAN_TIME_BLOCKS is how many blocks the median time past is taken over
+	MEDIAN_TIME_BLOCKS = 11
+	// MAX_FUTURE_BLOCK_TIME is how far ahead of the local clock a block may be
+	MAX_FUTURE_BLOCK_TIME = 2 * time.Hour
+)
+
+// RejectReason identifies which consensus rule a block or transaction broke.
+type RejectReason int
+
+const (
+	RejectMalformed RejectReason = iota
+	RejectBadHash
+	RejectHighHash
+	RejectBadBits
+	RejectBadMerkleRoot
+	RejectNoTransactions
+	RejectFirstTxNotCoinbase
+	RejectMultipleCoinbases
+	RejectDuplicateTx
+	RejectBadTxID
+	RejectOrphan
+	RejectBadGenesis
+	RejectBadHeight
+	RejectTimeTooOld
+	RejectTimeTooNew
+	RejectMissingInput
+	RejectDoubleSpend
+	RejectScriptFailed
+	RejectBadCoinbaseValue
+	RejectOutputsExceedInputs
+	RejectImmatureCoinbase
+	RejectCoinbaseNotInBlock
+	RejectTxTooLarge
+	RejectInsufficientFee
+	RejectMempoolFull
+	RejectTooManyReplacements
+	RejectNonStandard
+	RejectNonFinal
+	RejectSequenceLock
+	RejectBadValue
+	RejectKnownInvalid
+	RejectInvalidAncestor
+)
+
+var rejectReasonStrings = map[RejectReason]string{
+	RejectMalformed:           "malformed",
+	RejectBadHash:             "bad-hash",
+	RejectHighHash:            "high-hash",
+	RejectBadBits:             "bad-bits",
+	RejectBadMerkleRoot:       "bad-merkle-root",
+	RejectNoTransactions:      "no-transactions",
+	RejectFirstTxNotCoinbase:  "first-tx-not-coinbase",
+	RejectMultipleCoinbases:   "multiple-coinbases",
+	RejectDuplicateTx:         "duplicate-tx",
+	RejectBadTxID:             "bad-txid",
+	RejectOrphan:              "orphan",
+	RejectBadGenesis:          "bad-genesis",
+	RejectBadHeight:           "bad-height",
+	RejectTimeTooOld:          "time-too-old",
+	RejectTimeTooNew:          "time-too-new",
+	RejectMissingInput:        "missing-input",
+	RejectDoubleSpend:         "double-spend",
+	RejectScriptFailed:        "script-failed",
+	RejectBadCoinbaseValue:    "bad-cb-amount",
+	RejectOutputsExceedInputs: "in-belowout",
+	RejectImmatureCoinbase:    "premature-spend-of-coinbase",
+	RejectCoinbaseNotInBlock:  "coinbase",
+	RejectTxTooLarge:          "tx-size",
+	RejectInsufficientFee:     "insufficient-fee",
+	RejectMempoolFull:         "mempool-full",
+	RejectTooManyReplacements: "too-many-replacements",
+	RejectNonStandard:         "non-standard",
+	RejectNonFinal:            "non-final",
+	RejectSequenceLock:        "non-final-sequence",
+	RejectBadValue:            "bad-txns-value",
+	RejectKnownInvalid:        "duplicate-invalid",
+	RejectInvalidAncestor:     "bad-prevblk",
+}
+
+func (r RejectReason) String() string {
+	if s, ok := rejectReasonStrings[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
+// RuleError is returned when a block or transaction breaks a consensus rule,
+// as opposed to failing for an internal reason such as a database error.
+type RuleError struct {
+	Reason      RejectReason
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Description)
+}
+
+func ruleError(reason RejectReason, format string, args ...interface{}) RuleError {
+	return RuleError{Reason: reason, Description: fmt.Sprintf(format, args...)}
+}
+
+// IsRejectReason reports whether err is a RuleError with the given reason.
+func IsRejectReason(err error, reason RejectReason) bool {
+	ruleErr, ok := err.(RuleError)
+	return ok && ruleErr.Reason == reason
+}
+
+// ValidateBlock is the single entry point every block goes through before it
+// is stored. It runs the context free checks, the checks against the parent
+// block, and, when the block extends the current tip, the checks of its
+// transactions against the UTXO set. Blocks on a side branch have their
+// transactions checked when a reorganization connects them. A block whose
+// transactions are invalid is marked so, and is turned away from then on.
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+
+	if err := CheckBlockSanity(block); err != nil {
+		return err
+	}
+
+	if len(block.PrevHash) == 0 {
+		return ruleError(RejectBadGenesis, "block %x claims to be a different genesis block", block.Hash)
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return ruleError(RejectOrphan, "parent block %x is not known", block.PrevHash)
+	}
+
+	if err := chain.checkBlockContext(block, parent); err != nil {
+		return err
+	}
+
+	if bytes.Equal(block.PrevHash, chain.LastHash) {
+		err := chain.checkBlockTransactions(block)
+		if _, ok := err.(RuleError); ok {
+			if markErr := chain.markInvalid([]*Block{block}); markErr != nil {
+				return markErr
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// CheckBlockSanity runs the checks that need nothing but the block itself.
+func CheckBlockSanity(block *Block) error {
+
+	if len(block.Transactions) == 0 {
+		return ruleError(RejectNoTransactions, "block %x has no transactions", block.Hash)
+	}
+
+	//
+	// the header pads and cuts hashes to 32 bytes, so any other length
+	// would let two different blocks share a hash
+	//
+	if len(block.PrevHash) != 0 && len(block.PrevHash) != sha256.Size {
+		return ruleError(RejectMalformed, "block %x previous hash is %d bytes, not %d", block.Hash, len(block.PrevHash), sha256.Size)
+	}
+	if len(block.MerkleRoot) != sha256.Size {
+		return ruleError(RejectMalformed, "block %x merkle root is %d bytes, not %d", block.Hash, len(block.MerkleRoot), sha256.Size)
+	}
+
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ruleError(RejectBadHash, "block hash %x does not match its header", block.Hash)
+	}
+
+	pow := NewProof(block)
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(Params.PowLimit) > 0 {
+		return ruleError(RejectBadBits, "block %x has out of range bits %08x", block.Hash, block.Bits)
+	}
+
+	if valid, _ := pow.Validate(); !valid {
+		return ruleError(RejectHighHash, "block %x does not meet its proof of work target", block.Hash)
+	}
+
+	maxTime := time.Now().Add(MAX_FUTURE_BLOCK_TIME).UnixNano()
+	if block.Timestamp > maxTime {
+		return ruleError(RejectTimeTooNew, "block %x timestamp is too far in the future", block.Hash)
+	}
+
+	seenTxs := make(map[string]bool)
+	spent := make(map[string]bool)
+
+	for i, tx := range block.Transactions {
+
+		if err := CheckTransactionSanity(tx); err != nil {
+			return err
+		}
+
+		if i == 0 && !tx.IsCoinbase() {
+			return ruleError(RejectFirstTxNotCoinbase, "first transaction in block %x is not a coinbase", block.Hash)
+		}
+
+		if i > 0 && tx.IsCoinbase() {
+			return ruleError(RejectMultipleCoinbases, "block %x has more than one coinbase", block.Hash)
+		}
+
+		txID := hex.EncodeToString(tx.HashID)
+		if seenTxs[txID] {
+			return ruleError(RejectDuplicateTx, "transaction %s appears twice in block %x", txID, block.Hash)
+		}
+		seenTxs[txID] = true
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			outpoint := OutpointKey(in.ID, in.Out)
+			if spent[outpoint] {
+				return ruleError(RejectDoubleSpend, "output %s is spent twice in block %x", outpoint, block.Hash)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return ruleError(RejectBadMerkleRoot, "block %x merkle root does not match its transactions", block.Hash)
+	}
+
+	return nil
+}
+
+// CheckTransactionSanity runs the checks that need nothing but the
+// transaction itself.
+func CheckTransactionSanity(tx *Transaction) error {
+
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return ruleError(RejectMalformed, "transaction %x has no inputs or no outputs", tx.HashID)
+	}
+
+	if !bytes.Equal(tx.ID(), tx.HashID) {
+		return ruleError(RejectBadTxID, "transaction %x does not match its contents", tx.HashID)
+	}
+
+	//
+	// every output and the running total stay within MaxSupply, so the sum
+	// cannot overflow on its way to a fee
+	//
+	total := 0
+	for i, out := range tx.Outputs {
+		if !MoneyRange(out.Value) {
+			return ruleError(RejectBadValue, "transaction %x output %d has value %d out of range", tx.HashID, i, out.Value)
+		}
+
+		total += out.Value
+		if !MoneyRange(total) {
+			return ruleError(RejectBadValue, "transaction %x outputs total more than %d", tx.HashID, Params.MaxSupply)
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for _, in := range tx.Inputs {
+		if len(in.ID) == 0 || in.Out < 0 {
+			return ruleError(RejectMalformed, "transaction %x has an input with a null outpoint", tx.HashID)
+		}
+		if in.Out > MAX_OUTPUT_INDEX {
+			return ruleError(RejectMalformed, "transaction %x spends output %d, the highest index is %d", tx.HashID, in.Out, MAX_OUTPUT_INDEX)
+		}
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) checkBlockContext(block *Block, parent *Block) error {
+
+	if block.Height != parent.Height+1 {
+		return ruleError(RejectBadHeight, "block %x has height %d, expected %d", block.Hash, block.Height, parent.Height+1)
+	}
+
+	expectedBits, err := chain.CalcNextBits(parent)
+	if err != nil {
+		return err
+	}
+
+	if block.Bits != expectedBits {
+		return ruleError(RejectBadBits, "block %x has bits %08x, expected %08x", block.Hash, block.Bits, expectedBits)
+	}
+
+	medianTime, err := chain.CalcPastMedianTime(parent)
+	if err != nil {
+		return err
+	}
+
+	if block.Timestamp <= medianTime {
+		return ruleError(RejectTimeTooOld, "block %x timestamp is not after the median time past", block.Hash)
+	}
+
+	return nil
+}
+
+// checkBlockTransactions checks every transaction in the block against the
+// UTXO set as it stands on the block's parent. Outputs created earlier in the
+// same block may be spent by later transactions, but no transaction may share
+// its id with one whose outputs are unspent. The coinbase may claim the block
+// subsidy plus the fees of the other transactions, and no more.
+func (chain *Blockchain) checkBlockTransactions(block *Block) error {
+
+	UTXO := UTXOSet{chain}
+	blockTxs := make(map[string]Transaction)
+	fees := 0
+
+	for _, tx := range block.Transactions {
+
+		if !tx.IsCoinbase() {
+			fee, err := chain.CheckTransactionInputs(tx, blockTxs, block.Height)
+			if err != nil {
+				return err
+			}
+			fees += fee
+			if !MoneyRange(fees) {
+				return ruleError(RejectBadValue, "fees in block %x total more than %d", block.Hash, Params.MaxSupply)
+			}
+		}
+
+		//
+		// a transaction repeating the id of one with unspent outputs, such
+		// as a coinbase with the same data, would overwrite them
+		//
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.Script) {
+				continue
+			}
+			if _, found := UTXO.GetUTXO(tx.HashID, outIdx); found {
+				return ruleError(RejectDuplicateTx, "transaction %x of block %x would overwrite unspent output %d", tx.HashID, block.Hash, outIdx)
+			}
+		}
+
+		blockTxs[hex.EncodeToString(tx.HashID)] = *tx
+	}
+
+	maxValue := CalcBlockSubsidy(block.Height) + fees
+	claimed := block.Transactions[0].OutputValue()
+	if !MoneyRange(claimed) {
+		return ruleError(RejectBadValue, "coinbase of block %x claims %d, out of range", block.Hash, claimed)
+	}
+	if claimed > maxValue {
+		return ruleError(RejectBadCoinbaseValue, "coinbase of block %x claims %d, the limit is %d", block.Hash, claimed, maxValue)
+	}
+
+	return nil
+}
+
+// CheckTransactionInputs makes sure the transaction's absolute and relative
+// time locks have passed and that every input spends an existing unspent,
+// mature output and satisfies its locking script, and returns the fee
+// the transaction pays: the value of its inputs minus the value of its
+// outputs. pending holds transactions whose outputs are not in the UTXO set
+// yet but may be spent; height is that of the block the transaction would
+// be included in, on top of the tip.
+func (chain *Blockchain) CheckTransactionInputs(tx *Transaction, pending map[string]Transaction, height int) (int, error) {
+
+	if err := chain.checkFinal(tx, height); err != nil {
+		return 0, err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	prevOuts := make(map[string]TxOutput)
+	coinHeights := make([]int, len(tx.Inputs))
+	inputValue := 0
+
+	for inIdx, in := range tx.Inputs {
+
+		var prevOut TxOutput
+
+		if prevTX, isPending := pending[hex.EncodeToString(in.ID)]; isPending {
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) || IsUnspendable(prevTX.Outputs[in.Out].Script) {
+				return 0, ruleError(RejectMissingInput, "transaction %x spends missing output %x:%d", tx.HashID, in.ID, in.Out)
+			}
+
+			if prevTX.IsCoinbase() && Params.CoinbaseMaturity > 0 {
+				return 0, ruleError(RejectImmatureCoinbase, "transaction %x spends coinbase %x of the same block", tx.HashID, in.ID)
+			}
+
+			prevOut = prevTX.Outputs[in.Out]
+			coinHeights[inIdx] = height
+
+		} else {
+			entry, found := UTXOSet.GetUTXO(in.ID, in.Out)
+			if !found {
+				return 0, ruleError(RejectMissingInput, "transaction %x spends missing or already spent output %x:%d", tx.HashID, in.ID, in.Out)
+			}
+
+			if !entry.IsMature(height) {
+				return 0, ruleError(RejectImmatureCoinbase, "transaction %x spends coinbase %x before it matures", tx.HashID, in.ID)
+			}
+
+			prevOut = entry.Output
+			coinHeights[inIdx] = entry.Height
+		}
+
+		prevOuts[OutpointKey(in.ID, in.Out)] = prevOut
+
+		inputValue += prevOut.Value
+		if !MoneyRange(prevOut.Value) || !MoneyRange(inputValue) {
+			return 0, ruleError(RejectBadValue, "transaction %x inputs total more than %d", tx.HashID, Params.MaxSupply)
+		}
+	}
+
+	if err := chain.checkSequenceLocks(tx, coinHeights, height); err != nil {
+		return 0, err
+	}
+
+	for inIdx, in := range tx.Inputs {
+		if err := tx.VerifyInput(inIdx, prevOuts[OutpointKey(in.ID, in.Out)]); err != nil {
+			return 0, ruleError(RejectScriptFailed, "transaction %x input %d: %s", tx.HashID, inIdx, err)
+		}
+	}
+
+	fee := inputValue - tx.OutputValue()
+	if fee < 0 {
+		return 0, ruleError(RejectOutputsExceedInputs, "transaction %x spends %d but its inputs are only worth %d", tx.HashID, tx.OutputValue(), inputValue)
+	}
+
+	return fee, nil
+}
+
+// CalcFees checks the transactions in order for a block at the given height,
+// letting each spend the outputs of those before it, and returns the total
+// fee they pay.
+func (chain *Blockchain) CalcFees(txs []*Transaction, height int) (int, error) {
+
+	pending := make(map[string]Transaction)
+	fees := 0
+
+	for _, tx := range txs {
+
+		fee, err := chain.CheckTransactionInputs(tx, pending, height)
+		if err != nil {
+			return 0, err
+		}
+
+		fees += fee
+		pending[hex.EncodeToString(tx.HashID)] = *tx
+	}
+
+	return fees, nil
+}
+
+// CalcPastMedianTime returns the median timestamp of the given block and the
+// blocks before it, up to MEDIAN_TIME_BLOCKS in total.
+func (chain *Blockchain) CalcPastMedianTime(block *Block) (int64, error) {
+
+	var timestamps []int64
+
+	current := block
+	for len(timestamps) < MEDIAN_TIME_BLOCKS {
+
+		timestamps = append(timestamps, current.Timestamp)
+
+		if len(current.PrevHash) == 0 {
+			break
+		}
+
+		parent, err := chain.GetBlock(current.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+
+		current = parent
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	return timestamps[len(timestamps)/2], nil
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/i101dev/blockchain-Tensor/blockchain"
 	"github.com/i101dev/blockchain-Tensor/network"
+	"github.com/i101dev/blockchain-Tensor/pool"
 	"github.com/i101dev/blockchain-Tensor/types"
 	"github.com/i101dev/blockchain-Tensor/wallet"
 )
@@ -22,7 +27,9 @@ var (
 )
 
 type BlockchainServer struct {
-	port uint16
+	port     uint16
+	poolPort uint16
+	pool     *pool.Server
 }
 
 func (bcs *BlockchainServer) LoadBlockchain() error {
@@ -112,17 +119,52 @@ func (bcs *BlockchainServer) LoadWallet(w http.ResponseWriter, req *http.Request
 		w.Header().Add("Content-Type", "application/json")
 
 		// ----------------------------------------------------------
-		w, _ := wallet.CreateWallets()
+		walletDat, _ := wallet.CreateWallets()
 
-		w.Print()
+		walletDat.Print()
 		// ----------------------------------------------------------
 		// w.Header().Add("Content-Type", "application/json")
 
+		if err := bcs.checkLegacyFunds(walletDat); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
 	default:
 		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
 	}
 }
 
+// checkLegacyFunds fails when coins are still paid to the uncompressed keys
+// of wallet accounts made before keys were compressed. Scripts no longer
+// accept those keys, so the coins cannot be spent.
+func (bcs *BlockchainServer) checkLegacyFunds(walletDat *wallet.Wallet) error {
+
+	chain, err := bcs.GetBlockchain()
+	if err != nil {
+		return err
+	}
+
+	blockchain.OpenDB(chain)
+	defer chain.CloseDB()
+
+	UTXOset := blockchain.UTXOSet{
+		Blockchain: chain,
+	}
+
+	funds := UTXOset.LegacyFunds(walletDat)
+	if len(funds) == 0 {
+		return nil
+	}
+
+	var stranded []string
+	for address, value := range funds {
+		stranded = append(stranded, fmt.Sprintf("%s holds %d", address, value))
+	}
+
+	return fmt.Errorf("ERROR: coins paid to legacy uncompressed keys cannot be spent: %s", strings.Join(stranded, ", "))
+}
+
 func (bcs *BlockchainServer) GetBlock(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -250,13 +292,43 @@ func (bcs *BlockchainServer) AddTXN(w http.ResponseWriter, req *http.Request) {
 		}
 
 		// ----------------------------------------------------------
-		newTxn := blockchain.NewTransaction(txnPayload.From, txnPayload.To, txnPayload.Amount, &UTXOset, wallet)
+		var newTxn *blockchain.Transaction
+
+		if txnPayload.FeeRate == 0 && txnPayload.ConfTarget > 0 {
+			feeRate, err := network.EstimateFee(txnPayload.ConfTarget)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			txnPayload.FeeRate = feeRate
+		}
+
+		if txnPayload.FeeRate > 0 {
+			newTxn, err = blockchain.NewTransactionWithFeeRate(txnPayload.From, txnPayload.To, txnPayload.Amount, txnPayload.FeeRate, txnPayload.Replaceable, txnPayload.LockTime, &UTXOset, wallet)
+		} else {
+			newTxn, err = blockchain.NewTransaction(txnPayload.From, txnPayload.To, txnPayload.Amount, txnPayload.Fee, txnPayload.Replaceable, txnPayload.LockTime, &UTXOset, wallet)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		if txnPayload.MineNow {
-			cbTx := blockchain.CoinbaseTX(txnPayload.From, "")
-			txs := []*blockchain.Transaction{cbTx, newTxn}
-			block := chain.MineBlock(txs)
-			UTXOset.Update(block)
+		//
+		// a transaction that is still locked would be turned away, so the
+		// wallet holds it until /sendtxn
+		//
+		_, err = chain.CheckTransactionInputs(newTxn, nil, chain.GetBestHeight()+1)
+
+		if blockchain.IsRejectReason(err, blockchain.RejectNonFinal) {
+			wallet.Locked[hex.EncodeToString(newTxn.HashID)] = newTxn.Serialize()
+			wallet.SaveFile()
+			fmt.Println("\nholding txn until its lock time")
+		} else if txnPayload.MineNow {
+			if _, err := chain.MineBlock(txnPayload.From, []*blockchain.Transaction{newTxn}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		} else {
 			network.SendTx(network.NODE_ZERO, newTxn)
 			fmt.Println("\nsending txn")
@@ -277,6 +349,73 @@ func (bcs *BlockchainServer) AddTXN(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// SendTxn broadcasts a time-locked transaction the wallet has been holding,
+// once its lock time has passed.
+func (bcs *BlockchainServer) SendTxn(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var sendPayload types.SendTxnReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&sendPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data, ok := walletDat.Locked[sendPayload.TxID]
+		if !ok {
+			http.Error(w, "ERROR: Unknown locked transaction", http.StatusNotFound)
+			return
+		}
+
+		lockedTxn := blockchain.DeserializeTransaction(data)
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		_, err = chain.CheckTransactionInputs(&lockedTxn, nil, chain.GetBestHeight()+1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		network.SendTx(network.NODE_ZERO, &lockedTxn)
+		fmt.Println("\nsending txn")
+
+		delete(walletDat.Locked, sendPayload.TxID)
+		walletDat.SaveFile()
+
+		// ----------------------------------------------------------
+		m, err := lockedTxn.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) GetUTXOset(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -284,6 +423,10 @@ func (bcs *BlockchainServer) GetUTXOset(w http.ResponseWriter, req *http.Request
 		w.Header().Add("Content-Type", "application/json")
 
 		address := req.URL.Query().Get("address")
+		if !wallet.ValidateAddress(address) {
+			http.Error(w, "ERROR: Invalid address", http.StatusBadRequest)
+			return
+		}
 
 		// -----------------------------------------------------------
 		chain, err := bcs.GetBlockchain()
@@ -292,16 +435,19 @@ func (bcs *BlockchainServer) GetUTXOset(w http.ResponseWriter, req *http.Request
 			return
 		}
 
-		db := blockchain.OpenDB(chain)
+		blockchain.OpenDB(chain)
 		defer chain.CloseDB()
 
 		// -----------------------------------------------------------
-		utxoset, err := chain.GetUnspentOutputs(db, address)
+		lockingScript, err := blockchain.PayToAddrScript(address)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+		utxoset := UTXOSet.FindUTXOs(lockingScript)
+
 		// -----------------------------------------------------------
 		UTXO, err := json.Marshal(utxoset)
 		if err != nil {
@@ -326,6 +472,12 @@ func (bcs *BlockchainServer) GetBalance(w http.ResponseWriter, req *http.Request
 
 		address := req.URL.Query().Get("address")
 
+		lockingScript, err := blockchain.PayToAddrScript(address)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// -----------------------------------------------------------
 		chain, err := bcs.GetBlockchain()
 
@@ -342,18 +494,10 @@ func (bcs *BlockchainServer) GetBalance(w http.ResponseWriter, req *http.Request
 		}
 
 		// -----------------------------------------------------------
-		walletDat, _ := wallet.CreateWallets()
-		account := walletDat.GetAccount(address)
-		pubKeyHash := wallet.PublicKeyHash(account.PublicKey)
-		UTXOs := UTXOset.FindUnspentTransactions(pubKeyHash)
-
-		balance := 0
-		for _, out := range UTXOs {
-			balance += out.Value
-		}
+		balance, immature := UTXOset.GetBalance(lockingScript)
 
 		// -----------------------------------------------------------
-		response := map[string]int{"balance": balance}
+		response := map[string]int{"balance": balance, "immature": immature}
 		jsonResponse, err := json.Marshal(response)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -409,23 +553,1084 @@ func (bcs *BlockchainServer) Reindex(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// ------------------------------------------------------------------
+func (bcs *BlockchainServer) BumpFee(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
-	return &BlockchainServer{
-		port: port,
+		var bumpPayload types.BumpFeeReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&bumpPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		txnID, err := hex.DecodeString(bumpPayload.TxID)
+		if err != nil {
+			http.Error(w, "ERROR: Invalid transaction ID", http.StatusBadRequest)
+			return
+		}
+
+		stuckTxn, ok := network.GetMempoolTx(txnID)
+		if !ok {
+			http.Error(w, "ERROR: Transaction is not in the mempool", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		wallet, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		newTxn, err := blockchain.BumpFee(stuckTxn, bumpPayload.From, bumpPayload.FeeRate, &UTXOset, wallet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		network.SendTx(network.NODE_ZERO, newTxn)
+
+		// ----------------------------------------------------------
+		m, err := newTxn.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
 	}
 }
 
-func (bcs *BlockchainServer) startNetworkServer() {
-	bcs.LoadBlockchain()
-	chain, _ := bcs.GetBlockchain()
-	network.StartServer(chain, bcs.port, MINER_ADDRESS)
+func (bcs *BlockchainServer) EstimateFee(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		blocks, err := strconv.Atoi(req.URL.Query().Get("blocks"))
+		if err != nil {
+			http.Error(w, "ERROR: Invalid number of blocks", http.StatusBadRequest)
+			return
+		}
+
+		// -----------------------------------------------------------
+		feeRate, err := network.EstimateFee(blocks)
+		if errors.Is(err, blockchain.ErrInsufficientFeeData) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// -----------------------------------------------------------
+		response := map[string]int{"feerate": feeRate, "blocks": blocks}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
 }
 
-func (bcs *BlockchainServer) Run() {
-	if err := bcs.LoadBlockchain(); err != nil {
-		log.Fatal(err)
+func (bcs *BlockchainServer) GetBlockTemplate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		// -----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		template, err := network.GetBlockTemplate(chain)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		// -----------------------------------------------------------
+		jsonResponse, err := json.Marshal(template)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SubmitBlock(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var blockPayload types.SubmitBlockReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&blockPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockData, err := hex.DecodeString(blockPayload.Data)
+		if err != nil {
+			http.Error(w, "ERROR: Invalid block data", http.StatusBadRequest)
+			return
+		}
+
+		block, err := blockchain.DeserializeBlock(blockData)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		isOrphan, err := network.SubmitBlock(chain, block)
+		if err != nil {
+			var ruleErr blockchain.RuleError
+			if errors.As(err, &ruleErr) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		// ----------------------------------------------------------
+		response := map[string]interface{}{"hash": hex.EncodeToString(block.Hash), "orphan": isOrphan}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) GetPubKey(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		address := req.URL.Query().Get("address")
+
+		// ----------------------------------------------------------
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		account, ok := walletDat.Accounts[address]
+		if !ok {
+			http.Error(w, "ERROR: Address is not in the wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		response := map[string]string{"address": address, "pubkey": hex.EncodeToString(account.PublicKey)}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) CreateMultiSig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var multiSigPayload types.CreateMultiSigReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&multiSigPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pubKeys := make([][]byte, len(multiSigPayload.PubKeys))
+		for i, pubKeyHex := range multiSigPayload.PubKeys {
+			if pubKeys[i], err = hex.DecodeString(pubKeyHex); err != nil {
+				http.Error(w, "ERROR: Invalid public key", http.StatusBadRequest)
+				return
+			}
+		}
+
+		address, multiSig, err := blockchain.NewMultiSigAddress(multiSigPayload.Required, pubKeys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		walletDat, _ := wallet.CreateWallets()
+
+		walletDat.MultiSigs[address] = multiSig
+
+		walletDat.SaveFile()
+
+		// ----------------------------------------------------------
+		response := map[string]string{"address": address, "redeem_script": hex.EncodeToString(multiSig.RedeemScript)}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SpendMultiSig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var txnPayload types.NewTxnReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&txnPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !wallet.ValidateAddress(txnPayload.To) {
+			http.Error(w, "ERROR: Invalid address", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		partial, err := blockchain.NewMultiSigTransaction(txnPayload.From, txnPayload.To, txnPayload.Amount, txnPayload.Fee, &UTXOset, walletDat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat.Partials[hex.EncodeToString(partial.Tx.HashID)] = partial.Serialize()
+		walletDat.SaveFile()
+
+		// ----------------------------------------------------------
+		m, err := partial.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// SignMultiSig adds signatures to a multisig spend: those in data, a copy
+// passed on by another participant, and that of signer, a local account.
+// Once the threshold is met the transaction is finalized and broadcast.
+func (bcs *BlockchainServer) SignMultiSig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var signPayload types.SignMultiSigReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&signPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		var partial *blockchain.PartialTx
+
+		if stored, ok := walletDat.Partials[signPayload.TxID]; ok {
+			partial, err = blockchain.DeserializePartialTx(stored)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if signPayload.Data != "" {
+			data, err := hex.DecodeString(signPayload.Data)
+			if err != nil {
+				http.Error(w, "ERROR: Invalid partial transaction data", http.StatusBadRequest)
+				return
+			}
+
+			received, err := blockchain.DeserializePartialTx(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if partial == nil {
+				partial, err = blockchain.DeserializePartialTx(data)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				for i := range partial.Signatures {
+					partial.Signatures[i] = make(map[string][]byte)
+				}
+			}
+
+			if err := partial.Merge(received); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if partial == nil {
+			http.Error(w, "ERROR: Unknown partial transaction", http.StatusNotFound)
+			return
+		}
+
+		if signPayload.Signer != "" {
+			account, ok := walletDat.Accounts[signPayload.Signer]
+			if !ok {
+				http.Error(w, "ERROR: Signer is not in the wallet", http.StatusNotFound)
+				return
+			}
+
+			if err := partial.Sign(account.PrivateKey, blockchain.SIGHASH_ALL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		txnID := hex.EncodeToString(partial.Tx.HashID)
+
+		// ----------------------------------------------------------
+		if partial.IsComplete() {
+			signedTxn, err := partial.Finalize()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			network.SendTx(network.NODE_ZERO, signedTxn)
+			fmt.Println("\nsending txn")
+
+			partial.Tx = *signedTxn
+			delete(walletDat.Partials, txnID)
+		} else {
+			walletDat.Partials[txnID] = partial.Serialize()
+		}
+
+		walletDat.SaveFile()
+
+		// ----------------------------------------------------------
+		m, err := partial.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// InitiateSwap locks coins in an atomic swap contract. Without a secret
+// hash it starts a new swap; with the initiator's it takes part in one.
+func (bcs *BlockchainServer) InitiateSwap(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var swapPayload types.InitiateSwapReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&swapPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var secretHash []byte
+		if swapPayload.SecretHash != "" {
+			if secretHash, err = hex.DecodeString(swapPayload.SecretHash); err != nil {
+				http.Error(w, "ERROR: Invalid secret hash", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if swapPayload.LockTime == 0 {
+			lockTime := blockchain.INITIATOR_LOCKTIME
+			if secretHash != nil {
+				lockTime = blockchain.PARTICIPANT_LOCKTIME
+			}
+			swapPayload.LockTime = uint32(time.Now().Add(lockTime).Unix())
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		contractTxn, contract, err := blockchain.InitiateSwap(swapPayload.From, swapPayload.To, swapPayload.Amount, swapPayload.Fee, secretHash, swapPayload.LockTime, &UTXOset, walletDat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat.SaveFile()
+
+		network.SendTx(network.NODE_ZERO, contractTxn)
+		fmt.Println("\nsending txn")
+
+		// ----------------------------------------------------------
+		htlc, _ := blockchain.ExtractHTLC(contract)
+		secretHashHex := hex.EncodeToString(htlc.SecretHash)
+
+		response := struct {
+			Contract   string                  `json:"contract"`
+			Address    string                  `json:"address"`
+			TxID       string                  `json:"txid"`
+			SecretHash string                  `json:"secret_hash"`
+			Secret     string                  `json:"secret,omitempty"`
+			LockTime   uint32                  `json:"locktime"`
+			Tx         *blockchain.Transaction `json:"tx"`
+		}{
+			Contract:   hex.EncodeToString(contract),
+			Address:    wallet.ScriptHashToAddr(wallet.Hash160(contract)),
+			TxID:       hex.EncodeToString(contractTxn.HashID),
+			SecretHash: secretHashHex,
+			LockTime:   htlc.LockTime,
+			Tx:         contractTxn,
+		}
+		if secretHash == nil {
+			response.Secret = hex.EncodeToString(walletDat.Secrets[secretHashHex])
+		}
+
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) RedeemSwap(w http.ResponseWriter, req *http.Request) {
+	bcs.spendSwap(w, req, false)
+}
+
+func (bcs *BlockchainServer) RefundSwap(w http.ResponseWriter, req *http.Request) {
+	bcs.spendSwap(w, req, true)
+}
+
+// spendSwap claims the output of a swap contract: with the secret, or back
+// to the refund key once the lock time has passed. A refund made early is
+// held by the wallet until /sendtxn.
+func (bcs *BlockchainServer) spendSwap(w http.ResponseWriter, req *http.Request, refund bool) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var swapPayload types.SpendSwapReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&swapPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		contract, err := hex.DecodeString(swapPayload.Contract)
+		if err != nil {
+			http.Error(w, "ERROR: Invalid contract", http.StatusBadRequest)
+			return
+		}
+
+		txnID, err := hex.DecodeString(swapPayload.TxID)
+		if err != nil {
+			http.Error(w, "ERROR: Invalid transaction id", http.StatusBadRequest)
+			return
+		}
+
+		var secret []byte
+		if swapPayload.Secret != "" {
+			if secret, err = hex.DecodeString(swapPayload.Secret); err != nil {
+				http.Error(w, "ERROR: Invalid secret", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		var spendTxn *blockchain.Transaction
+
+		if refund {
+			spendTxn, err = blockchain.RefundSwap(contract, txnID, swapPayload.Fee, &UTXOset, walletDat)
+		} else {
+			spendTxn, err = blockchain.RedeemSwap(contract, txnID, secret, swapPayload.Fee, &UTXOset, walletDat)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = chain.CheckTransactionInputs(spendTxn, nil, chain.GetBestHeight()+1)
+
+		if blockchain.IsRejectReason(err, blockchain.RejectNonFinal) {
+			walletDat.Locked[hex.EncodeToString(spendTxn.HashID)] = spendTxn.Serialize()
+			walletDat.SaveFile()
+			fmt.Println("\nholding txn until its lock time")
+		} else {
+			network.SendTx(network.NODE_ZERO, spendTxn)
+			fmt.Println("\nsending txn")
+		}
+
+		// ----------------------------------------------------------
+		m, err := spendTxn.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// AuditSwap describes a swap contract output. The secret found in a
+// redemption of it is kept in the wallet, for redeeming the other side.
+func (bcs *BlockchainServer) AuditSwap(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		contract, err := hex.DecodeString(req.URL.Query().Get("contract"))
+		if err != nil {
+			http.Error(w, "ERROR: Invalid contract", http.StatusBadRequest)
+			return
+		}
+
+		txnID, err := hex.DecodeString(req.URL.Query().Get("txid"))
+		if err != nil {
+			http.Error(w, "ERROR: Invalid transaction id", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		audit, err := blockchain.AuditSwap(contract, txnID, &UTXOset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		if audit.Secret != "" {
+			secret, err := hex.DecodeString(audit.Secret)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			walletDat, err := wallet.CreateWallets()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			walletDat.Secrets[audit.SecretHash] = secret
+			walletDat.SaveFile()
+		}
+
+		jsonResponse, err := json.Marshal(audit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// Notarize broadcasts a transaction that carries a document hash in a data
+// output.
+func (bcs *BlockchainServer) Notarize(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var notarizePayload types.NotarizeReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&notarizePayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		hash, err := hex.DecodeString(notarizePayload.Hash)
+		if err != nil || len(hash) == 0 {
+			http.Error(w, "ERROR: Invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		if notarizePayload.Fee == 0 {
+			notarizePayload.Fee = 1
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		dataTxn, err := blockchain.NewDataTransaction(notarizePayload.From, hash, notarizePayload.Fee, &UTXOset, walletDat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		network.SendTx(network.NODE_ZERO, dataTxn)
+		fmt.Println("\nsending txn")
+
+		jsonResponse, err := json.Marshal(dataTxn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// Prove returns the merkle proof that a transaction, given by its id or by
+// the hash it notarized, was mined on the main chain, with its block and
+// how deeply it is buried.
+func (bcs *BlockchainServer) Prove(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		query := req.URL.Query()
+
+		txnID, err := hex.DecodeString(query.Get("txid"))
+		if err != nil {
+			http.Error(w, "ERROR: Invalid transaction id", http.StatusBadRequest)
+			return
+		}
+
+		hash, err := hex.DecodeString(query.Get("hash"))
+		if err != nil {
+			http.Error(w, "ERROR: Invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		if len(txnID) == 0 && len(hash) == 0 {
+			http.Error(w, "ERROR: Give a txid or a hash", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		var proof *blockchain.InclusionProof
+		if len(txnID) > 0 {
+			proof, err = chain.ProveTransaction(txnID)
+		} else {
+			proof, err = chain.ProveData(hash)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		jsonResponse, err := json.Marshal(proof)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// Pledge signs coins towards a crowdfunding campaign. The pledge is not
+// broadcast; its data is handed to whoever collects the pledges.
+func (bcs *BlockchainServer) Pledge(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var pledgePayload types.PledgeReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&pledgePayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// ----------------------------------------------------------
+		pledgeTxn, err := blockchain.NewPledge(pledgePayload.From, pledgePayload.To, pledgePayload.Goal, pledgePayload.Amount, &UTXOset, walletDat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pledged := 0
+		for _, in := range pledgeTxn.Inputs {
+			entry, _ := UTXOset.GetUTXO(in.ID, in.Out)
+			pledged += entry.Output.Value
+		}
+
+		response := struct {
+			Pledged int                     `json:"pledged"`
+			Tx      *blockchain.Transaction `json:"tx"`
+			Data    string                  `json:"data"`
+		}{
+			Pledged: pledged,
+			Tx:      pledgeTxn,
+			Data:    hex.EncodeToString(pledgeTxn.Serialize()),
+		}
+
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// CombinePledges merges the pledges to a campaign and broadcasts the result
+// once they cover its goal.
+func (bcs *BlockchainServer) CombinePledges(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var combinePayload types.CombinePledgesReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&combinePayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var pledges []*blockchain.Transaction
+		for _, pledgeHex := range combinePayload.Pledges {
+			data, err := hex.DecodeString(pledgeHex)
+			if err != nil {
+				http.Error(w, "ERROR: Invalid pledge data", http.StatusBadRequest)
+				return
+			}
+
+			pledge, err := blockchain.DecodeTransaction(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pledges = append(pledges, pledge)
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		campaignTxn, err := blockchain.CombinePledges(pledges, &UTXOset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		network.SendTx(network.NODE_ZERO, campaignTxn)
+		fmt.Println("\nsending txn")
+
+		// ----------------------------------------------------------
+		m, err := campaignTxn.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) PoolStats(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		if bcs.pool == nil {
+			http.Error(w, "ERROR: Pool mode is not enabled", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		jsonResponse, err := json.Marshal(bcs.pool.Shares.Stats())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// ------------------------------------------------------------------
+
+func NewBlockchainServer(port uint16, poolPort uint16) *BlockchainServer {
+	return &BlockchainServer{
+		port:     port,
+		poolPort: poolPort,
+	}
+}
+
+func (bcs *BlockchainServer) startNetworkServer() {
+	bcs.LoadBlockchain()
+	chain, _ := bcs.GetBlockchain()
+
+	if bcs.poolPort != 0 {
+		bcs.pool = pool.NewServer(chain, MINER_ADDRESS)
+		go bcs.startPoolServer()
+	}
+
+	network.StartServer(chain, bcs.port, MINER_ADDRESS)
+}
+
+func (bcs *BlockchainServer) startPoolServer() {
+	poolURL := fmt.Sprintf("0.0.0.0:%d", bcs.poolPort)
+	log.Fatal(bcs.pool.ListenAndServe(poolURL))
+}
+
+func (bcs *BlockchainServer) Run() {
+	if err := bcs.LoadBlockchain(); err != nil {
+		log.Fatal(err)
+	}
+
+	if walletDat, err := wallet.CreateWallets(); err == nil {
+		if err := bcs.checkLegacyFunds(walletDat); err != nil {
+			log.Printf("\n *** >>> WARNING: %s\n", err)
+		}
 	}
 
 	http.HandleFunc("/printchain", bcs.PrintChain)
@@ -437,6 +1642,24 @@ func (bcs *BlockchainServer) Run() {
 	http.HandleFunc("/reindex", bcs.Reindex)
 	http.HandleFunc("/gettxn", bcs.GetTXN)
 	http.HandleFunc("/addtxn", bcs.AddTXN)
+	http.HandleFunc("/sendtxn", bcs.SendTxn)
+	http.HandleFunc("/estimatefee", bcs.EstimateFee)
+	http.HandleFunc("/bumpfee", bcs.BumpFee)
+	http.HandleFunc("/getblocktemplate", bcs.GetBlockTemplate)
+	http.HandleFunc("/submitblock", bcs.SubmitBlock)
+	http.HandleFunc("/poolstats", bcs.PoolStats)
+	http.HandleFunc("/getpubkey", bcs.GetPubKey)
+	http.HandleFunc("/createmultisig", bcs.CreateMultiSig)
+	http.HandleFunc("/spendmultisig", bcs.SpendMultiSig)
+	http.HandleFunc("/signmultisig", bcs.SignMultiSig)
+	http.HandleFunc("/initiateswap", bcs.InitiateSwap)
+	http.HandleFunc("/redeemswap", bcs.RedeemSwap)
+	http.HandleFunc("/refundswap", bcs.RefundSwap)
+	http.HandleFunc("/auditswap", bcs.AuditSwap)
+	http.HandleFunc("/notarize", bcs.Notarize)
+	http.HandleFunc("/prove", bcs.Prove)
+	http.HandleFunc("/pledge", bcs.Pledge)
+	http.HandleFunc("/combinepledges", bcs.CombinePledges)
 
 	go bcs.startNetworkServer()
 
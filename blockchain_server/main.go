@@ -15,9 +15,10 @@ func main() {
 	defer os.Exit(0)
 
 	port := flag.Uint("port", 5000, "TCP Port Number for API Server")
+	poolPort := flag.Uint("poolport", 0, "TCP Port Number for the mining pool (0 disables pool mode)")
 	flag.Parse()
 
-	app := NewBlockchainServer(uint16(*port))
+	app := NewBlockchainServer(uint16(*port), uint16(*poolPort))
 
 	app.Run()
 }
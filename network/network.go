@@ -2,17 +2,21 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/util"
 	"github.com/vrecan/death"
 )
 
@@ -30,6 +34,8 @@ const (
 	VERSION    = "version"
 
 	NODE_ZERO = "localhost:5001"
+
+	MEMPOOL_SAVE_INTERVAL = 10 * time.Minute
 )
 
 var (
@@ -37,7 +43,14 @@ var (
 	mineAddress     string
 	KnownNodes      = []string{NODE_ZERO}
 	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
+	memPool         *blockchain.Mempool
+	mempoolPath     string
+	feeEstimator    *blockchain.FeeEstimator
+
+	miner        = blockchain.NewMiner(runtime.NumCPU())
+	miningMu     sync.Mutex
+	mining       bool
+	cancelMining context.CancelFunc
 )
 
 // -------------------------------------------------------------
@@ -214,10 +227,19 @@ func HandleTx(request []byte, chain *blockchain.Blockchain) {
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.HashID)] = tx
+	tx, err := blockchain.DecodeTransaction(txData)
+	if err != nil {
+		fmt.Printf("Dropped transaction from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+
+	desc, err := memPool.MaybeAcceptTransaction(tx)
+	if err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.HashID, err)
+		return
+	}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	feeEstimator.ObserveTransaction(desc)
 
 	if nodeAddress == NODE_ZERO {
 		for _, node := range KnownNodes {
@@ -226,7 +248,7 @@ func HandleTx(request []byte, chain *blockchain.Blockchain) {
 			}
 		}
 	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
+		if memPool.Count() >= 2 && len(mineAddress) > 0 {
 			MineTx(chain)
 		}
 	}
@@ -263,7 +285,7 @@ func HandleInv(request []byte, chain *blockchain.Blockchain) {
 	if payload.Type == TX {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].HashID == nil {
+		if !memPool.Has(txID) {
 			SendGetData(payload.AddrFrom, TX, txID)
 		}
 	}
@@ -297,28 +319,37 @@ func HandleBlock(request []byte, chain *blockchain.Blockchain) {
 	}
 
 	blockData := payload.Block
-	block, _ := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	blockchain.OpenDB(chain)
 	defer chain.CloseDB()
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+	lastHash := chain.LastHash
+	isOrphan, err := chain.ProcessBlock(block)
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	if !bytes.Equal(lastHash, chain.LastHash) {
+		tipChanged(chain)
+	}
+
+	if err != nil {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+	} else if isOrphan {
+		missing := chain.Orphans.OrphanRoot(block.Hash)
+		fmt.Printf("Holding orphan block %x, requesting parent %x\n", block.Hash, missing)
+		SendGetData(payload.AddrFrom, BLOCK, missing)
+	} else {
+		fmt.Printf("Added block %x\n", block.Hash)
+	}
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddrFrom, BLOCK, blockHash)
 		blocksInTransit = blocksInTransit[1:]
-
-	} else {
-
-		UTXOSet := blockchain.UTXOSet{
-			Blockchain: chain,
-		}
-
-		UTXOSet.Reindex()
 	}
 }
 
@@ -348,10 +379,12 @@ func HandleGetData(request []byte, chain *blockchain.Blockchain) {
 	}
 
 	if payload.Type == TX {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := memPool.Get(payload.ID)
+		if !ok {
+			return
+		}
 
-		SendTx(payload.AddrFrom, &tx)
+		SendTx(payload.AddrFrom, tx)
 	}
 }
 
@@ -401,57 +434,232 @@ func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
 	defer chain.CloseDB()
 	// ------------------------
 	//
+	// Announce oldest first so that every block arrives after its parent
 	blocks := chain.GetBlockHashes()
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+
 	SendInv(payload.AddrFrom, BLOCK, blocks)
 }
 
 // -------------------------------------------------------------
 
+// MineTx mines a block template built from the mempool into a new block.
+// The database is only held open while the template is built and while the
+// result is stored, so blocks from peers can arrive during the search. When
+// one of them moves the tip, the search is cancelled and the template
+// rebuilt on the new tip. Only one search runs at a time: a call made while
+// another is mining returns at once, and the running one picks up the new
+// transactions with the next block.
 func MineTx(chain *blockchain.Blockchain) {
-	var txs []*blockchain.Transaction
+
+	if !startMining() {
+		return
+	}
+	defer stopMining()
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		setMiningCancel(cancel)
+
+		//
+		// ------------------------
+		blockchain.OpenDB(chain)
+		// ------------------------
+		//
+		template, err := chain.NewBlockTemplate(memPool.Descs())
+		util.HandleError(err, "MineTx 1")
+
+		chain.CloseDB()
+
+		if len(template.Transactions) == 0 {
+			cancel()
+			fmt.Println("All Transactions are invalid")
+			return
+		}
+
+		for _, tx := range template.Transactions {
+			fmt.Printf("tx: %x\n", tx.HashID)
+		}
+
+		cbTx := blockchain.CoinbaseTX(mineAddress, "", template.CoinbaseValue)
+		txs := append([]*blockchain.Transaction{cbTx}, template.Transactions...)
+
+		newBlock, err := miner.CreateBlock(ctx, txs, template.PrevHash, template.Height, template.Bits)
+		cancel()
+
+		if errors.Is(err, context.Canceled) {
+			fmt.Println("Chain tip changed, rebuilding block")
+			continue
+		}
+		util.HandleError(err, "MineTx 2")
+
+		//
+		// ------------------------
+		blockchain.OpenDB(chain)
+		// ------------------------
+		//
+		if err := chain.AddBlock(newBlock); err != nil {
+			chain.CloseDB()
+			fmt.Printf("Mined block rejected: %s\n", err)
+			return
+		}
+
+		memPool.RemoveForBlock(newBlock)
+		tipChanged(chain)
+		chain.CloseDB()
+
+		fmt.Printf("New Block mined at %.0f H/s\n", miner.HashRate())
+
+		for _, node := range KnownNodes {
+			if node != nodeAddress {
+				SendInv(node, BLOCK, [][]byte{newBlock.Hash})
+			}
+		}
+
+		if memPool.Count() == 0 {
+			return
+		}
+	}
+}
+
+// tipChanged brings the node up to date with a new chain tip: the block
+// being mined is dropped and the mempool and fee estimates are updated. The
+// database must be open.
+func tipChanged(chain *blockchain.Blockchain) {
+	abortMining()
+	updateFeeEstimates(chain)
+	memPool.Revalidate()
+}
+
+// GetBlockTemplate builds the work for the next block from the mempool, for
+// miners outside the node.
+func GetBlockTemplate(chain *blockchain.Blockchain) (*blockchain.BlockTemplate, error) {
+	if memPool == nil {
+		return nil, errors.New("the network server is not running")
+	}
+	//
+	// ------------------------
+	blockchain.OpenDB(chain)
+	defer chain.CloseDB()
+	// ------------------------
+	//
+	return chain.NewBlockTemplate(memPool.Descs())
+}
+
+// SubmitBlock validates a block solved outside the node and, once it is
+// accepted, announces it to the other nodes. It reports whether the block
+// was held as an orphan.
+func SubmitBlock(chain *blockchain.Blockchain, block *blockchain.Block) (bool, error) {
+	if memPool == nil {
+		return false, errors.New("the network server is not running")
+	}
 	//
 	// ------------------------
 	blockchain.OpenDB(chain)
 	defer chain.CloseDB()
 	// ------------------------
 	//
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].HashID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+	lastHash := chain.LastHash
+
+	isOrphan, err := chain.ProcessBlock(block)
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(lastHash, chain.LastHash) {
+		tipChanged(chain)
+	}
+
+	if !isOrphan {
+		for _, node := range KnownNodes {
+			if node != nodeAddress {
+				SendInv(node, BLOCK, [][]byte{block.Hash})
+			}
 		}
 	}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
+	return isOrphan, nil
+}
+
+// updateFeeEstimates hands the blocks connected since the fee estimator last
+// looked at the chain to it, oldest first. The database must be open.
+func updateFeeEstimates(chain *blockchain.Blockchain) {
+
+	var connected []*blockchain.Block
+
+	hash := chain.LastHash
+	for {
+		block, err := chain.GetBlock(hash)
+		if err != nil || block.Height <= feeEstimator.BestHeight() {
+			break
+		}
+
+		connected = append(connected, block)
+		hash = block.PrevHash
 	}
 
-	cbTx := blockchain.CoinbaseTX(mineAddress, "")
-	txs = append(txs, cbTx)
+	for i := len(connected) - 1; i >= 0; i-- {
+		feeEstimator.ProcessBlock(connected[i])
+	}
+}
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{
-		Blockchain: chain,
+// EstimateFee returns the fee rate, in coins per kilobyte, that should get a
+// transaction confirmed within the given number of blocks.
+func EstimateFee(blocks int) (int, error) {
+	if feeEstimator == nil {
+		return 0, errors.New("the network server is not running")
 	}
-	UTXOSet.Reindex()
 
-	fmt.Println("New Block mined")
+	return feeEstimator.EstimateFee(blocks)
+}
 
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.HashID)
-		delete(memoryPool, txID)
+// GetMempoolTx looks up an unconfirmed transaction in the node's mempool.
+func GetMempoolTx(txID []byte) (*blockchain.Transaction, bool) {
+	if memPool == nil {
+		return nil, false
 	}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, BLOCK, [][]byte{newBlock.Hash})
-		}
+	return memPool.Get(txID)
+}
+
+// startMining reports whether the caller may start mining, that is whether
+// no other search is running.
+func startMining() bool {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+
+	if mining {
+		return false
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	mining = true
+	return true
+}
+
+func stopMining() {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+
+	mining = false
+	cancelMining = nil
+}
+
+func setMiningCancel(cancel context.CancelFunc) {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+
+	cancelMining = cancel
+}
+
+// abortMining stops the block search in progress, if there is one.
+func abortMining() {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+
+	if cancelMining != nil {
+		cancelMining()
 	}
 }
 
@@ -509,16 +717,43 @@ func CloseDB(chain *blockchain.Blockchain) {
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
+		saveMempool()
 		chain.Database.Close()
 	})
 }
 
+// persistMempool saves the mempool every MEMPOOL_SAVE_INTERVAL, so a crash
+// loses at most that much of it.
+func persistMempool() {
+	for range time.Tick(MEMPOOL_SAVE_INTERVAL) {
+		saveMempool()
+	}
+}
+
+func saveMempool() {
+	if err := memPool.Save(mempoolPath); err != nil {
+		fmt.Printf("Could not save the mempool: %s\n", err)
+	}
+}
+
 // -----------------------------------------------------------------------
 
 func StartServer(chain *blockchain.Blockchain, port uint16, minerAddress string) {
 
 	nodeAddress = fmt.Sprintf("localhost:%d", port+1)
 	mineAddress = minerAddress
+	memPool = blockchain.NewMempool(chain)
+	mempoolPath = fmt.Sprintf(blockchain.MEMPOOL_PATH, port)
+
+	blockchain.OpenDB(chain)
+	feeEstimator = blockchain.NewFeeEstimator(chain.GetBestHeight())
+	chain.CloseDB()
+
+	if count, err := memPool.Load(mempoolPath); err != nil {
+		fmt.Printf("Could not load the mempool: %s\n", err)
+	} else {
+		fmt.Printf("Loaded %d transactions into the mempool\n", count)
+	}
 
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
@@ -527,6 +762,7 @@ func StartServer(chain *blockchain.Blockchain, port uint16, minerAddress string)
 
 	defer ln.Close()
 	go CloseDB(chain)
+	go persistMempool()
 
 	if nodeAddress != NODE_ZERO {
 		SendVersion(NODE_ZERO, chain)
@@ -0,0 +1,413 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/network"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+const (
+	// SHARE_TARGET_SHIFT makes shares 2^SHARE_TARGET_SHIFT times easier to
+	// find than blocks, though never easier than Params.PowLimit.
+	SHARE_TARGET_SHIFT = 8
+
+	JOB_REFRESH_INTERVAL = 30 * time.Second
+	TIP_POLL_INTERVAL    = time.Second
+
+	SUBSCRIBE = "subscribe"
+	NOTIFY    = "notify"
+	SUBMIT    = "submit"
+)
+
+// -------------------------------------------------------------
+//
+// Miners talk to the pool in newline-delimited JSON. A miner subscribes
+// with its worker name and payout address, after which the pool notifies
+// it of a new job whenever the work changes. Shares are submitted as the
+// job id and the nonce that solves it.
+//
+
+type Request struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	ID     int         `json:"id"`
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type Notification struct {
+	Method string `json:"method"`
+	Params Job    `json:"params"`
+}
+
+type SubscribeParams struct {
+	Worker  string `json:"worker"`
+	Address string `json:"address"`
+}
+
+type SubmitParams struct {
+	JobID string `json:"job_id"`
+	Nonce uint32 `json:"nonce"`
+}
+
+// Job is the work handed to one miner: a block header to find nonces for,
+// with the nonce at NonceOffset. A hash below ShareTarget earns a share; one
+// below BlockTarget also solves the block. Clean tells the miner to drop
+// its previous jobs, which are stale from then on.
+type Job struct {
+	ID          string `json:"job_id"`
+	Header      string `json:"header"`
+	NonceOffset int    `json:"nonce_offset"`
+	ShareTarget string `json:"share_target"`
+	BlockTarget string `json:"block_target"`
+	Clean       bool   `json:"clean"`
+}
+
+// -------------------------------------------------------------
+
+type job struct {
+	id          string
+	block       *blockchain.Block
+	shareTarget *big.Int
+	blockTarget *big.Int
+	nonces      map[uint32]bool
+}
+
+type session struct {
+	conn    net.Conn
+	enc     *json.Encoder
+	writeMu sync.Mutex
+	worker  string
+	address string
+	jobs    map[string]*job
+}
+
+func (s *session) send(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.enc.Encode(v)
+}
+
+// Server is a mining pool. It builds a job for every connected miner from
+// the node's block template, with a coinbase that pays out the last
+// PPLNS_WINDOW shares as they stand when the job is made, and submits the
+// blocks its miners solve to the node.
+type Server struct {
+	Shares *ShareLog
+
+	chain    *blockchain.Blockchain
+	operator string
+
+	mu         sync.Mutex
+	sessions   map[*session]bool
+	template   *blockchain.BlockTemplate
+	tip        []byte
+	refreshed  time.Time
+	nextJobID  uint64
+	extraNonce uint64
+}
+
+// NewServer creates a pool for the given chain. Rounding leftovers, and the
+// whole reward while there are no shares, go to the operator address.
+func NewServer(chain *blockchain.Blockchain, operator string) *Server {
+	return &Server{
+		Shares:   NewShareLog(),
+		chain:    chain,
+		operator: operator,
+		sessions: make(map[*session]bool),
+	}
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go srv.watchTip()
+
+	fmt.Println("Mining pool listening @:", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handleConnection(conn)
+	}
+}
+
+// watchTip hands out fresh jobs when the chain tip moves, which makes the
+// old ones stale, and every JOB_REFRESH_INTERVAL so new transactions and
+// shares make it into the work.
+func (srv *Server) watchTip() {
+	for range time.Tick(TIP_POLL_INTERVAL) {
+
+		tip := srv.chain.TipHash()
+
+		srv.mu.Lock()
+		tipMoved := !bytes.Equal(srv.tip, tip)
+		due := time.Since(srv.refreshed) >= JOB_REFRESH_INTERVAL
+		srv.mu.Unlock()
+
+		if tipMoved || due {
+			srv.refresh(tipMoved)
+		}
+	}
+}
+
+func (srv *Server) refresh(clean bool) {
+
+	template, err := network.GetBlockTemplate(srv.chain)
+	if err != nil {
+		fmt.Printf("Pool could not get a block template: %s\n", err)
+		return
+	}
+
+	srv.mu.Lock()
+	srv.template = template
+	srv.tip = template.PrevHash
+	srv.refreshed = time.Now()
+
+	sessions := make([]*session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.mu.Unlock()
+
+	for _, s := range sessions {
+		srv.sendJob(s, clean)
+	}
+}
+
+func (srv *Server) handleConnection(conn net.Conn) {
+
+	s := &session{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		jobs: make(map[string]*job),
+	}
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.sessions, s)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.send(Response{Error: "malformed request"})
+			continue
+		}
+
+		result, err := srv.handleRequest(s, req)
+
+		resp := Response{ID: req.ID, Result: result}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		if s.send(resp) != nil {
+			return
+		}
+
+		if req.Method == SUBSCRIBE && err == nil {
+			srv.sendJob(s, true)
+		}
+	}
+}
+
+func (srv *Server) handleRequest(s *session, req Request) (interface{}, error) {
+	switch req.Method {
+
+	case SUBSCRIBE:
+		var params SubscribeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		if params.Worker == "" || !wallet.ValidateAddress(params.Address) {
+			return nil, errors.New("a worker name and a valid payout address are required")
+		}
+
+		s.worker = params.Worker
+		s.address = params.Address
+
+		srv.mu.Lock()
+		srv.sessions[s] = true
+		srv.mu.Unlock()
+
+		return true, nil
+
+	case SUBMIT:
+		var params SubmitParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		if s.worker == "" {
+			return nil, errors.New("not subscribed")
+		}
+
+		return srv.submit(s, params)
+
+	default:
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+}
+
+// sendJob builds a new job for the session on the current template. Its
+// coinbase carries an extranonce unique to the job, so no two miners ever
+// search the same headers.
+func (srv *Server) sendJob(s *session, clean bool) {
+
+	srv.mu.Lock()
+	if srv.template == nil {
+		srv.mu.Unlock()
+		srv.refresh(clean)
+		return
+	}
+
+	template := srv.template
+	srv.nextJobID++
+	srv.extraNonce++
+	jobID := fmt.Sprintf("%x", srv.nextJobID)
+	extraNonce := srv.extraNonce
+	srv.mu.Unlock()
+
+	payouts := srv.Shares.Payouts(template.CoinbaseValue, srv.operator)
+	coinbase := blockchain.CoinbaseTXWithOutputs(fmt.Sprintf("pool/%d/%d", template.Height, extraNonce), payouts)
+
+	timestamp := time.Now().UnixNano()
+	if timestamp < template.MinTime {
+		timestamp = template.MinTime
+	}
+
+	block := &blockchain.Block{
+		BlockHeader: blockchain.BlockHeader{
+			Version:   template.Version,
+			PrevHash:  template.PrevHash,
+			Timestamp: timestamp,
+			Bits:      template.Bits,
+			Height:    template.Height,
+		},
+		Transactions: append([]*blockchain.Transaction{coinbase}, template.Transactions...),
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	blockTarget := blockchain.CompactToTarget(template.Bits)
+	shareTarget := new(big.Int).Lsh(blockTarget, SHARE_TARGET_SHIFT)
+	if shareTarget.Cmp(blockchain.Params.PowLimit) > 0 {
+		shareTarget.Set(blockchain.Params.PowLimit)
+	}
+
+	j := &job{
+		id:          jobID,
+		block:       block,
+		shareTarget: shareTarget,
+		blockTarget: blockTarget,
+		nonces:      make(map[uint32]bool),
+	}
+
+	s.writeMu.Lock()
+	if clean {
+		s.jobs = make(map[string]*job)
+	}
+	s.jobs[jobID] = j
+	s.writeMu.Unlock()
+
+	s.send(Notification{
+		Method: NOTIFY,
+		Params: Job{
+			ID:          jobID,
+			Header:      hex.EncodeToString(block.BlockHeader.Bytes()),
+			NonceOffset: blockchain.HEADER_NONCE_OFFSET,
+			ShareTarget: fmt.Sprintf("%064x", shareTarget),
+			BlockTarget: fmt.Sprintf("%064x", blockTarget),
+			Clean:       clean,
+		},
+	})
+}
+
+// submit checks a share. Shares are weighted by how hard they were to find
+// relative to the lowest difficulty allowed, so they keep their value when
+// the block target retargets.
+func (srv *Server) submit(s *session, params SubmitParams) (interface{}, error) {
+
+	s.writeMu.Lock()
+	j, ok := s.jobs[params.JobID]
+	duplicate := ok && j.nonces[params.Nonce]
+	if ok {
+		j.nonces[params.Nonce] = true
+	}
+	s.writeMu.Unlock()
+
+	if !ok {
+		srv.Shares.Reject(s.worker, s.address, true)
+		return false, errors.New("stale job")
+	}
+
+	if duplicate {
+		srv.Shares.Reject(s.worker, s.address, false)
+		return false, errors.New("duplicate share")
+	}
+
+	header := j.block.BlockHeader
+	header.Nonce = params.Nonce
+	hash := header.Hash()
+
+	if new(big.Int).SetBytes(hash).Cmp(j.shareTarget) != -1 {
+		srv.Shares.Reject(s.worker, s.address, false)
+		return false, errors.New("share does not meet the target")
+	}
+
+	weight, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(blockchain.Params.PowLimit),
+		new(big.Float).SetInt(j.shareTarget),
+	).Float64()
+
+	srv.Shares.Add(Share{
+		Worker:  s.worker,
+		Address: s.address,
+		Weight:  weight,
+		Time:    time.Now(),
+	})
+
+	if new(big.Int).SetBytes(hash).Cmp(j.blockTarget) == -1 {
+		block := *j.block
+		block.BlockHeader = header
+		block.Hash = hash
+
+		if _, err := network.SubmitBlock(srv.chain, &block); err != nil {
+			fmt.Printf("Pool block %x rejected: %s\n", hash, err)
+		} else {
+			fmt.Printf("Pool found block %x (worker %s)\n", hash, s.worker)
+			srv.Shares.FoundBlock(s.worker, s.address)
+			srv.refresh(true)
+		}
+	}
+
+	return true, nil
+}
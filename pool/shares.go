@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// PPLNS_WINDOW is how many of the most recent shares a block reward is split
+// over.
+const PPLNS_WINDOW = 1000
+
+type Share struct {
+	Worker  string
+	Address string
+	Weight  float64
+	Time    time.Time
+}
+
+// WorkerStats counts what a worker has submitted since the pool started.
+type WorkerStats struct {
+	Address   string    `json:"address"`
+	Accepted  int       `json:"accepted"`
+	Rejected  int       `json:"rejected"`
+	Stale     int       `json:"stale"`
+	Blocks    int       `json:"blocks"`
+	LastShare time.Time `json:"last_share"`
+}
+
+// ShareLog keeps the last PPLNS_WINDOW accepted shares and per-worker
+// statistics. It is safe for concurrent use.
+type ShareLog struct {
+	mu      sync.Mutex
+	shares  []Share
+	workers map[string]*WorkerStats
+}
+
+func NewShareLog() *ShareLog {
+	return &ShareLog{
+		workers: make(map[string]*WorkerStats),
+	}
+}
+
+func (sl *ShareLog) worker(name, address string) *WorkerStats {
+	stats, ok := sl.workers[name]
+	if !ok {
+		stats = &WorkerStats{Address: address}
+		sl.workers[name] = stats
+	}
+	return stats
+}
+
+func (sl *ShareLog) Add(share Share) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	stats := sl.worker(share.Worker, share.Address)
+	stats.Accepted++
+	stats.LastShare = share.Time
+
+	sl.shares = append(sl.shares, share)
+	if len(sl.shares) > PPLNS_WINDOW {
+		sl.shares = sl.shares[len(sl.shares)-PPLNS_WINDOW:]
+	}
+}
+
+// Reject counts a share that was turned down, either because it did not
+// meet the target or was a duplicate, or because its job was stale.
+func (sl *ShareLog) Reject(worker, address string, stale bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	stats := sl.worker(worker, address)
+	if stale {
+		stats.Stale++
+	} else {
+		stats.Rejected++
+	}
+}
+
+func (sl *ShareLog) FoundBlock(worker, address string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sl.worker(worker, address).Blocks++
+}
+
+func (sl *ShareLog) Stats() map[string]WorkerStats {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	stats := make(map[string]WorkerStats, len(sl.workers))
+	for name, worker := range sl.workers {
+		stats[name] = *worker
+	}
+	return stats
+}
+
+// Payouts splits value over the addresses behind the shares in the window,
+// in proportion to the weight of their shares. What is lost to rounding, or
+// all of it when there are no shares yet, goes to operator. Outputs are
+// sorted by address.
+func (sl *ShareLog) Payouts(value int, operator string) []blockchain.TxOutput {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	weights := make(map[string]float64)
+	total := 0.0
+
+	for _, share := range sl.shares {
+		weights[share.Address] += share.Weight
+		total += share.Weight
+	}
+
+	amounts := make(map[string]int)
+	paid := 0
+
+	if total > 0 {
+		for address, weight := range weights {
+			amount := int(math.Floor(float64(value) * weight / total))
+			if amount > 0 {
+				amounts[address] = amount
+				paid += amount
+			}
+		}
+	}
+
+	if value > paid {
+		amounts[operator] += value - paid
+	}
+
+	addresses := make([]string, 0, len(amounts))
+	for address := range amounts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	outputs := make([]blockchain.TxOutput, 0, len(addresses))
+	for _, address := range addresses {
+		outputs = append(outputs, *blockchain.NewTXOutput(amounts[address], address))
+	}
+
+	return outputs
+}
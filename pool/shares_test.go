@@ -0,0 +1,111 @@
+package pool
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func address() string {
+	return string(wallet.MakeAccount().Address())
+}
+
+// outputs returns the outputs paying amounts, sorted by address the way
+// Payouts sorts them.
+func outputs(amounts map[string]int) []blockchain.TxOutput {
+	addresses := make([]string, 0, len(amounts))
+	for address := range amounts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	outs := make([]blockchain.TxOutput, 0, len(addresses))
+	for _, address := range addresses {
+		outs = append(outs, *blockchain.NewTXOutput(amounts[address], address))
+	}
+	return outs
+}
+
+func TestPayouts(t *testing.T) {
+
+	alice, bob, operator := address(), address(), address()
+
+	tests := []struct {
+		name   string
+		shares []Share
+		value  int
+		want   map[string]int
+	}{
+		{
+			name:  "no shares",
+			value: 100,
+			want:  map[string]int{operator: 100},
+		},
+		{
+			name:   "split by weight",
+			shares: []Share{{Address: alice, Weight: 3}, {Address: bob, Weight: 1}},
+			value:  100,
+			want:   map[string]int{alice: 75, bob: 25},
+		},
+		{
+			name:   "shares of one address add up",
+			shares: []Share{{Address: alice, Weight: 1}, {Address: bob, Weight: 1}, {Address: alice, Weight: 2}},
+			value:  100,
+			want:   map[string]int{alice: 75, bob: 25},
+		},
+		{
+			name:   "rounding goes to the operator",
+			shares: []Share{{Address: alice, Weight: 1}, {Address: bob, Weight: 2}},
+			value:  100,
+			want:   map[string]int{alice: 33, bob: 66, operator: 1},
+		},
+		{
+			name:   "amounts that round to nothing are left out",
+			shares: []Share{{Address: alice, Weight: 1}, {Address: bob, Weight: 1000}},
+			value:  100,
+			want:   map[string]int{bob: 99, operator: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sl := NewShareLog()
+			for _, share := range test.shares {
+				sl.Add(share)
+			}
+
+			if got, want := sl.Payouts(test.value, operator), outputs(test.want); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %d outputs %v, want %v", len(got), got, want)
+			}
+		})
+	}
+}
+
+func TestPayoutsWindow(t *testing.T) {
+
+	alice, bob, operator := address(), address(), address()
+
+	sl := NewShareLog()
+	for i := 0; i < PPLNS_WINDOW; i++ {
+		sl.Add(Share{Worker: "a", Address: alice, Weight: 1})
+	}
+
+	//
+	// bob's shares push alice's oldest ones out of the window
+	//
+	for i := 0; i < PPLNS_WINDOW/4; i++ {
+		sl.Add(Share{Worker: "b", Address: bob, Weight: 1})
+	}
+
+	want := outputs(map[string]int{alice: 750, bob: 250})
+	if got := sl.Payouts(1000, operator); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if stats := sl.Stats(); stats["a"].Accepted != PPLNS_WINDOW || stats["b"].Accepted != PPLNS_WINDOW/4 {
+		t.Fatalf("accepted counts are %d and %d, the window should not limit them", stats["a"].Accepted, stats["b"].Accepted)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/i101dev/blockchain-Tensor/pool"
+)
+
+func init() {
+	log.SetPrefix("Pool Worker: ")
+}
+
+// worker mines the pool's current job on -threads goroutines, each taking
+// every threads-th nonce, and submits every hash below the share target.
+// A new job from the pool stops the search on the old one.
+type worker struct {
+	conn    net.Conn
+	enc     *json.Encoder
+	writeMu sync.Mutex
+	nextID  int
+	threads int
+	stop    chan struct{}
+}
+
+func (w *worker) call(method string, params interface{}) error {
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.nextID++
+	return w.enc.Encode(pool.Request{ID: w.nextID, Method: method, Params: raw})
+}
+
+func (w *worker) mine(job pool.Job) {
+
+	if w.stop != nil {
+		close(w.stop)
+	}
+	w.stop = make(chan struct{})
+
+	header, err := hex.DecodeString(job.Header)
+	if err != nil {
+		log.Printf("bad header in job %s: %s", job.ID, err)
+		return
+	}
+
+	shareTarget, ok := new(big.Int).SetString(job.ShareTarget, 16)
+	if !ok {
+		log.Printf("bad share target in job %s", job.ID)
+		return
+	}
+
+	for t := 0; t < w.threads; t++ {
+		go w.search(job.ID, header, job.NonceOffset, shareTarget, uint32(t), w.stop)
+	}
+}
+
+func (w *worker) search(jobID string, header []byte, offset int, target *big.Int, start uint32, stop chan struct{}) {
+
+	data := make([]byte, len(header))
+	copy(data, header)
+
+	var hashInt big.Int
+
+	for i, nonce := 0, uint64(start); nonce <= 0xffffffff; i, nonce = i+1, nonce+uint64(w.threads) {
+
+		if i%4096 == 0 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		binary.BigEndian.PutUint32(data[offset:], uint32(nonce))
+		hash := sha256.Sum256(data)
+
+		if hashInt.SetBytes(hash[:]).Cmp(target) == -1 {
+			log.Printf("share %x", hash)
+			if err := w.call(pool.SUBMIT, pool.SubmitParams{JobID: jobID, Nonce: uint32(nonce)}); err != nil {
+				log.Printf("submit failed: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func main() {
+
+	defer os.Exit(0)
+
+	poolAddr := flag.String("pool", "localhost:3333", "Address of the mining pool")
+	name := flag.String("worker", "worker", "Worker name reported to the pool")
+	address := flag.String("address", "", "Address the pool pays this worker's shares to")
+	threads := flag.Int("threads", 1, "Number of mining goroutines")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *poolAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := &worker{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		threads: max(*threads, 1),
+	}
+
+	if err := w.call(pool.SUBSCRIBE, pool.SubscribeParams{Worker: *name, Address: *address}); err != nil {
+		log.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+
+		var msg struct {
+			pool.Response
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("malformed message: %s", err)
+			continue
+		}
+
+		if msg.Method == pool.NOTIFY {
+			var job pool.Job
+			if err := json.Unmarshal(msg.Params, &job); err != nil {
+				log.Printf("malformed job: %s", err)
+				continue
+			}
+			log.Printf("new job %s", job.ID)
+			w.mine(job)
+			continue
+		}
+
+		if msg.Error != "" {
+			if msg.ID == 1 {
+				log.Fatalf("subscribe failed: %s", msg.Error)
+			}
+			log.Printf("request %d failed: %s", msg.ID, msg.Error)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
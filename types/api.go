@@ -5,8 +5,71 @@ type AddBlockReq struct {
 }
 
 type NewTxnReq struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      int    `json:"amount"`
+	Fee         int    `json:"fee"`
+	FeeRate     int    `json:"feerate"`
+	ConfTarget  int    `json:"conftarget"`
+	Replaceable bool   `json:"replaceable"`
+	LockTime    uint32 `json:"locktime"`
+	MineNow     bool   `json:"minenow"`
+}
+
+type BumpFeeReq struct {
+	TxID    string `json:"txid"`
 	From    string `json:"from"`
-	To      string `json:"to"`
-	Amount  int    `json:"amount"`
-	MineNow bool   `json:"minenow"`
+	FeeRate int    `json:"feerate"`
+}
+
+type SubmitBlockReq struct {
+	Data string `json:"data"`
+}
+
+type CreateMultiSigReq struct {
+	Required int      `json:"required"`
+	PubKeys  []string `json:"pubkeys"`
+}
+
+type SignMultiSigReq struct {
+	TxID   string `json:"txid"`
+	Data   string `json:"data"`
+	Signer string `json:"signer"`
+}
+
+type SendTxnReq struct {
+	TxID string `json:"txid"`
+}
+
+type InitiateSwapReq struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Amount     int    `json:"amount"`
+	Fee        int    `json:"fee"`
+	SecretHash string `json:"secret_hash"`
+	LockTime   uint32 `json:"locktime"`
+}
+
+type SpendSwapReq struct {
+	Contract string `json:"contract"`
+	TxID     string `json:"txid"`
+	Secret   string `json:"secret"`
+	Fee      int    `json:"fee"`
+}
+
+type NotarizeReq struct {
+	From string `json:"from"`
+	Hash string `json:"hash"`
+	Fee  int    `json:"fee"`
+}
+
+type PledgeReq struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Goal   int    `json:"goal"`
+	Amount int    `json:"amount"`
+}
+
+type CombinePledgesReq struct {
+	Pledges []string `json:"pledges"`
 }
@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
 	"log"
 
 	"github.com/i101dev/blockchain-Tensor/util"
@@ -16,6 +17,8 @@ import (
 const (
 	checksumLength = 4
 	version        = byte(0x00)
+	// scriptVersion prefixes addresses that pay to the hash of a script
+	scriptVersion = byte(0x05)
 )
 
 // -----------------------------------------------------------------------
@@ -23,6 +26,10 @@ const (
 type Account struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
+	// LegacyPublicKey is set for accounts made before public keys were
+	// compressed. Coins paid to its address can no longer be spent, as
+	// scripts only accept compressed keys.
+	LegacyPublicKey []byte
 }
 
 func (w Account) Address() []byte {
@@ -38,9 +45,28 @@ func (w Account) Address() []byte {
 	return address
 }
 
+// LegacyAddress returns the address of the account's uncompressed key, or
+// "" when it never had one.
+func (w Account) LegacyAddress() string {
+	if w.LegacyPublicKey == nil {
+		return ""
+	}
+	return PubKeyHashToAddr(PublicKeyHash(w.LegacyPublicKey))
+}
+
 func PubKeyHashToAddr(pubKeyHash []byte) string {
+	return encodeAddress(version, pubKeyHash)
+}
+
+// ScriptHashToAddr returns the address that pays to the script whose
+// Hash160 is scriptHash.
+func ScriptHashToAddr(scriptHash []byte) string {
+	return encodeAddress(scriptVersion, scriptHash)
+}
+
+func encodeAddress(version byte, hash []byte) string {
 
-	versionedHash := append([]byte{version}, pubKeyHash...)
+	versionedHash := append([]byte{version}, hash...)
 	checkSum := CheckSum(versionedHash)
 
 	fullHash := append(versionedHash, checkSum...)
@@ -49,6 +75,39 @@ func PubKeyHashToAddr(pubKeyHash []byte) string {
 	return string(address)
 }
 
+// DecodeAddress returns the hash an address pays to and whether it is the
+// hash of a script rather than of a public key.
+func DecodeAddress(address string) (hash []byte, isScript bool, err error) {
+
+	if !ValidateAddress(address) {
+		return nil, false, fmt.Errorf("invalid address %q", address)
+	}
+
+	decoded := util.Base58Decode([]byte(address))
+	hash = decoded[1 : len(decoded)-checksumLength]
+
+	if len(hash) != 20 {
+		return nil, false, fmt.Errorf("address %q does not hold a 20 byte hash", address)
+	}
+
+	switch decoded[0] {
+	case version:
+		return hash, false, nil
+	case scriptVersion:
+		return hash, true, nil
+	default:
+		return nil, false, fmt.Errorf("address %q has unknown version %d", address, decoded[0])
+	}
+}
+
+// AddrToPubKeyHash strips the version byte and checksum from an address.
+func AddrToPubKeyHash(address string) []byte {
+
+	pubKeyHash := util.Base58Decode([]byte(address))
+
+	return pubKeyHash[1 : len(pubKeyHash)-checksumLength]
+}
+
 func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 
 	curve := elliptic.P256()
@@ -58,9 +117,13 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Fatal(err)
 	}
 
-	public := append(private.X.Bytes(), private.Y.Bytes()...)
+	return *private, EncodePublicKey(&private.PublicKey)
+}
 
-	return *private, public
+// EncodePublicKey returns the bytes a public key is shared and hashed as:
+// its compressed SEC1 form, which has a fixed width of 33 bytes.
+func EncodePublicKey(pub *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
 }
 
 func MakeAccount() *Account {
@@ -72,8 +135,13 @@ func MakeAccount() *Account {
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
+	return Hash160(pubKey)
+}
 
-	pubHash := sha256.Sum256(pubKey)
+// Hash160 is RIPEMD-160 over SHA-256, the hash addresses are built from.
+func Hash160(data []byte) []byte {
+
+	pubHash := sha256.Sum256(data)
 	hasher := ripemd160.New()
 
 	if _, err := hasher.Write(pubHash[:]); err != nil {
@@ -96,6 +164,10 @@ func CheckSum(payload []byte) []byte {
 func ValidateAddress(address string) bool {
 
 	pubKeyHash := util.Base58Decode([]byte(address))
+	if len(pubKeyHash) <= 1+checksumLength {
+		return false
+	}
+
 	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
 
 	version := pubKeyHash[0]
@@ -17,12 +17,36 @@ const walletFile = "../tmp/wallets.data"
 
 type Wallet struct {
 	Accounts map[string]*Account
+	// MultiSigs are the M-of-N addresses the wallet takes part in, by
+	// address.
+	MultiSigs map[string]*MultiSig
+	// Partials are serialized transactions spending from MultiSigs that are
+	// still collecting signatures, by transaction id.
+	Partials map[string][]byte
+	// Locked are signed transactions held back until their lock time has
+	// passed, by transaction id.
+	Locked map[string][]byte
+	// Secrets are the atomic swap secrets the wallet knows, by the hex of
+	// their SHA-256.
+	Secrets map[string][]byte
+}
+
+// MultiSig is an address that needs signatures from M of PubKeys to spend,
+// along with the redeem script it pays to the hash of.
+type MultiSig struct {
+	M            int
+	PubKeys      [][]byte
+	RedeemScript []byte
 }
 
 func CreateWallets() (*Wallet, error) {
 
 	wallet := Wallet{}
 	wallet.Accounts = make(map[string]*Account)
+	wallet.MultiSigs = make(map[string]*MultiSig)
+	wallet.Partials = make(map[string][]byte)
+	wallet.Locked = make(map[string][]byte)
+	wallet.Secrets = make(map[string][]byte)
 
 	err := wallet.LoadFile()
 
@@ -34,8 +58,15 @@ func (w *Wallet) Print() {
 	fmt.Println("\nWallet Accounts:")
 	fmt.Println()
 	counter := 1
-	for addr := range w.Accounts {
+	for addr, account := range w.Accounts {
 		fmt.Printf(" - Address %d: %s\n", counter, addr)
+		if legacy := account.LegacyAddress(); legacy != "" {
+			fmt.Printf("   (legacy uncompressed key address %s)\n", legacy)
+		}
+		counter++
+	}
+	for addr, multiSig := range w.MultiSigs {
+		fmt.Printf(" - Address %d: %s (%d of %d multisig)\n", counter, addr, multiSig.M, len(multiSig.PubKeys))
 		counter++
 	}
 }
@@ -56,6 +87,38 @@ func (w *Wallet) AddAccount() string {
 	return addr
 }
 
+// GetMultiSigAccounts returns the local accounts whose keys are among the
+// participants of the multisig address.
+func (w *Wallet) GetMultiSigAccounts(address string) []*Account {
+
+	multiSig, ok := w.MultiSigs[address]
+	if !ok {
+		return nil
+	}
+
+	var accounts []*Account
+	for _, account := range w.Accounts {
+		for _, pubKey := range multiSig.PubKeys {
+			if bytes.Equal(account.PublicKey, pubKey) {
+				accounts = append(accounts, account)
+			}
+		}
+	}
+
+	return accounts
+}
+
+// FindAccount returns the account whose public key hashes to pubKeyHash, or
+// nil when the wallet has none.
+func (w *Wallet) FindAccount(pubKeyHash []byte) *Account {
+	for _, account := range w.Accounts {
+		if bytes.Equal(PublicKeyHash(account.PublicKey), pubKeyHash) {
+			return account
+		}
+	}
+	return nil
+}
+
 func (w *Wallet) GetAllAddresses() []string {
 
 	var addresses []string
@@ -83,7 +146,25 @@ func (w *Wallet) LoadFile() error {
 	err = decoder.Decode(&wallet)
 	util.HandleError(err, "LoadFile 2")
 
-	w.Accounts = wallet.Accounts
+	//
+	// accounts are keyed by address again, as the address of a key saved
+	// in the older encoding changes when it is loaded compressed
+	//
+	for _, account := range wallet.Accounts {
+		w.Accounts[string(account.Address())] = account
+	}
+	if wallet.MultiSigs != nil {
+		w.MultiSigs = wallet.MultiSigs
+	}
+	if wallet.Partials != nil {
+		w.Partials = wallet.Partials
+	}
+	if wallet.Locked != nil {
+		w.Locked = wallet.Locked
+	}
+	if wallet.Secrets != nil {
+		w.Secrets = wallet.Secrets
+	}
 
 	return nil
 }
@@ -105,6 +186,9 @@ type PrivKey struct {
 	D          *big.Int
 	PublicKeyX *big.Int
 	PublicKeyY *big.Int
+	// LegacyPublicKey is the key in the uncompressed encoding it was first
+	// saved in, if it was.
+	LegacyPublicKey []byte
 }
 
 func (w *Account) GobEncode() ([]byte, error) {
@@ -112,6 +196,8 @@ func (w *Account) GobEncode() ([]byte, error) {
 		D:          w.PrivateKey.D,
 		PublicKeyX: w.PrivateKey.PublicKey.X,
 		PublicKeyY: w.PrivateKey.PublicKey.Y,
+
+		LegacyPublicKey: w.LegacyPublicKey,
 	}
 
 	var buf bytes.Buffer
@@ -148,11 +234,22 @@ func (w *Account) GobDecode(data []byte) error {
 			Curve: elliptic.P256(),
 		},
 	}
-	w.PublicKey = make([]byte, buf.Len())
-	_, err = buf.Read(w.PublicKey)
-	if err != nil {
+	stored := make([]byte, buf.Len())
+	if _, err := buf.Read(stored); err != nil {
 		return err
 	}
 
+	//
+	// the public key is derived again, so keys saved in the older
+	// uncompressed encoding come back compressed, with the old encoding
+	// kept for the coins still paid to its address
+	//
+	w.PublicKey = EncodePublicKey(&w.PrivateKey.PublicKey)
+	w.LegacyPublicKey = privKey.LegacyPublicKey
+
+	if w.LegacyPublicKey == nil && len(stored) > 0 && !bytes.Equal(stored, w.PublicKey) {
+		w.LegacyPublicKey = stored
+	}
+
 	return nil
 }